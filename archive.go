@@ -0,0 +1,177 @@
+package main
+
+// 打包下载选中的消息。与 zip-all-files 命令不同，压缩包以流的方式直接发送给客户端，
+// 不写入磁盘，也不占用数据库容量。
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/go-send/model"
+	"github.com/ahui2016/go-send/storage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/gzip"
+)
+
+const (
+	zipFormat   = "zip"
+	tarGzFormat = "tar.gz"
+)
+
+// archiveFilter 用来选择要打包的消息。IDs 不为空时只打包这些消息，否则打包符合其余条件的全部消息。
+type archiveFilter struct {
+	IDs      []string
+	Type     model.MsgType // TextMsg 或 FileMsg, 为空表示不限
+	FileType string        // FileType 的前缀，例如 "image" 或 "text/plain"
+	From     string        // model.TimeRange 返回的 ISO8601 区间 [From, To), 与 UpdatedAt 对比
+	To       string
+	Tag      string
+}
+
+// readArchiveFilter 读取参数 ids (以逗号分隔), type, file-type, from, to, tag.
+func readArchiveFilter(get func(key string) string) (*archiveFilter, error) {
+	from, to, err := readTimeRange(get, "from", "to")
+	if err != nil {
+		return nil, err
+	}
+	filter := &archiveFilter{
+		Type:     model.MsgType(get("type")),
+		FileType: get("file-type"),
+		From:     from,
+		To:       to,
+		Tag:      get("tag"),
+	}
+	for _, id := range strings.Split(get("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			filter.IDs = append(filter.IDs, id)
+		}
+	}
+	switch filter.Type {
+	case "", model.TextMsg, model.FileMsg:
+	default:
+		return nil, fiber.NewError(400, "unknown type: "+string(filter.Type))
+	}
+	return filter, nil
+}
+
+// match 不包括回收站里的条目。
+func (filter *archiveFilter) match(message *Message) bool {
+	if message.DeletedAt != "" {
+		return false
+	}
+	if filter.Type != "" && message.Type != filter.Type {
+		return false
+	}
+	if !strings.HasPrefix(message.FileType, filter.FileType) {
+		return false
+	}
+	if filter.Tag != "" && !model.HasTag(message.Tags, filter.Tag) {
+		return false
+	}
+	return model.InTimeRange(message.UpdatedAt, filter.From, filter.To)
+}
+
+// selectMessages 返回符合 filter 的消息，指定的 ID 找不到时返回错误。
+func selectMessages(filter *archiveFilter) (messages []Message, err error) {
+	if len(filter.IDs) == 0 {
+		all, err := db.AllByUpdatedAt(filter.Tag)
+		if err != nil {
+			return nil, err
+		}
+		for i := range all {
+			if filter.match(&all[i]) {
+				messages = append(messages, all[i])
+			}
+		}
+		return messages, nil
+	}
+	for _, id := range filter.IDs {
+		message, err := db.GetByID(id)
+		if err != nil {
+			return nil, fiber.NewError(404, "id: "+id+" not found")
+		}
+		if filter.match(message) {
+			messages = append(messages, *message)
+		}
+	}
+	return messages, nil
+}
+
+// archiveHandler 打包下载，参数见 readArchiveFilter, 另有 format 为 zip (默认) 或 tar.gz.
+func archiveHandler(c *fiber.Ctx) error {
+	format := c.FormValue("format")
+	if format == "" {
+		format = zipFormat
+	}
+	if format != zipFormat && format != tarGzFormat {
+		return jsonError(c, "unknown format: "+format, 400)
+	}
+	filter, err := readArchiveFilter(formValue(c))
+	if err != nil {
+		return err
+	}
+	messages, err := selectMessages(filter)
+	if err != nil {
+		return err
+	}
+	files := zipperFiles(messages)
+	if len(files) == 0 {
+		return jsonError(c, "没有符合条件的消息", 404)
+	}
+
+	c.Attachment("gosend_archive_" + time.Now().Format("20060102-150405") + "." + format)
+	if format == tarGzFormat {
+		c.Set(fiber.HeaderContentType, "application/gzip")
+	}
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// 此时已开始发送，出错时只能中断，客户端会得到不完整的压缩包。
+		write := writeZip
+		if format == tarGzFormat {
+			write = writeTarGz
+		}
+		if err := write(w, files); err != nil {
+			log.Print("archive: ", err)
+			return
+		}
+		_ = w.Flush()
+	})
+	return nil
+}
+
+// writeTarGz 与 writeZip 一样，只是格式为 tar.gz.
+func writeTarGz(w io.Writer, files []archiveEntry) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for i := range files {
+		src, err := files[i].open()
+		if err == storage.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{
+			Name:    files[i].Name,
+			Mode:    0644,
+			Size:    files[i].Message.FileSize,
+			ModTime: files[i].modTime(),
+		}
+		err = tarWriter.WriteHeader(header)
+		if err == nil {
+			_, err = io.CopyN(tarWriter, src, header.Size)
+		}
+		_ = src.Close()
+		if err != nil {
+			return errors.New(files[i].Name + ": " + err.Error())
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
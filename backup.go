@@ -0,0 +1,480 @@
+package main
+
+// 备份与恢复。备份是一个 tar 文件，依次包含：
+//   gosend.db      数据库快照 (在一个只读事务里复制，因此是一致的)
+//   config         设置，去掉了密码与 S3 的 SecretKey, 只供参考，恢复时不使用
+//   keyring        加密保存时的 keyring (不含密钥本身)
+//   files/<name>   全部文件与缩略图，加密保存时原样复制密文
+//   manifest.json  以上全部内容的 sha256. 放在最后，因此也用来判断备份是否完整。
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/go-send/encryption"
+	"github.com/ahui2016/go-send/model"
+	"github.com/ahui2016/go-send/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	backupVersion  = 1
+	manifestName   = "manifest.json"
+	backupFilesDir = "files/"
+)
+
+// backupManifest 记录备份里的全部内容。
+type backupManifest struct {
+	Version   int
+	CreatedAt string // ISO8601
+	Encrypted bool   // 为 true 时数据库与文件都是密文，需要同一个 keyring 和密码 (或 KeyFile)
+	Files     []backupEntry
+
+	// Missing 是列出之后、复制之前被删除的文件，它们的条目仍在快照里，导入后可用 fsck 修复。
+	Missing []string
+}
+
+type backupEntry struct {
+	Name   string
+	Size   int64
+	SHA256 string // hex
+}
+
+// rawStore 返回不经加解密的 store, 备份与恢复都直接复制密文。
+func rawStore() storage.Storage {
+	if encStore, ok := store.(*encryption.Storage); ok {
+		return encStore.Inner()
+	}
+	return store
+}
+
+// isBlobName 判断 name 是否文件或缩略图。
+func isBlobName(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == gosendFileExt || ext == thumbFileExt
+}
+
+func backupHandler(c *fiber.Ctx) error {
+	c.Attachment("gosend-backup-" + time.Now().Format("20060102-150405") + ".tar")
+	c.Set(fiber.HeaderContentType, "application/x-tar")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// 此时已开始发送，出错时只能中断，缺少 manifest.json 的备份在导入时会被拒绝。
+		if err := exportBackup(w); err != nil {
+			log.Print("backup: ", err)
+			return
+		}
+		_ = w.Flush()
+	})
+	return nil
+}
+
+// exportBackupFile 把备份写入文件 path. 服务器运行时不能使用 (数据库被锁定)，应使用 /api/backup.
+func exportBackupFile(path string) error {
+	defer func() { _ = db.Close() }()
+
+	tempPath := path + tempFileExt
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	err = exportBackup(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	log.Print("exported backup to ", path)
+	return nil
+}
+
+// exportBackup 把备份写入 w. 复制数据库快照与列出文件时持有 filesMutex，以保证两者一致，
+// 复制文件时则不持有锁，以免长时间阻塞上传。
+func exportBackup(w io.Writer) error {
+	snapshot, files, err := backupSnapshot()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(snapshot) }()
+
+	manifest := &backupManifest{
+		Version:   backupVersion,
+		CreatedAt: model.TimeNow(),
+		Encrypted: config.Encrypt,
+	}
+	tw := tar.NewWriter(w)
+
+	if err := manifest.addFile(tw, databaseFileName, snapshot); err != nil {
+		return err
+	}
+	configJSON, err := backupConfig()
+	if err != nil {
+		return err
+	}
+	if err := manifest.add(tw, configFileName, bytes.NewReader(configJSON),
+		int64(len(configJSON)), time.Now()); err != nil {
+		return err
+	}
+	if config.Encrypt {
+		if err := manifest.addFile(tw, keyringFileName, keyringPath); err != nil {
+			return err
+		}
+	}
+
+	raw := rawStore()
+	for _, info := range files {
+		r, err := raw.Get(info.Name, 0, -1)
+		if err == storage.ErrNotFound {
+			manifest.Missing = append(manifest.Missing, info.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = manifest.add(tw, backupFilesDir+info.Name, r, info.Size, info.ModTime)
+		_ = r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, manifestName, bytes.NewReader(manifestJSON),
+		int64(len(manifestJSON)), time.Now()); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// backupSnapshot 把数据库快照写入临时文件，同时列出全部文件与缩略图。
+func backupSnapshot() (snapshot string, files []storage.Info, err error) {
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	tmp, err := ioutil.TempFile(dataDir, "backup-*"+tempFileExt)
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = db.Snapshot(tmp)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		var all []storage.Info
+		all, err = rawStore().List()
+		for _, info := range all {
+			if isBlobName(info.Name) {
+				files = append(files, info)
+			}
+		}
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), files, nil
+}
+
+// backupConfig 返回去掉了密码与 SecretKey 的设置。
+func backupConfig() ([]byte, error) {
+	cfg := config
+	cfg.Password = ""
+	cfg.Storage.SecretKey = ""
+	return json.MarshalIndent(cfg, "", "    ")
+}
+
+// add 把 r 写入 tw 并记录其 sha256, size 必须与 r 的长度一致。
+func (manifest *backupManifest) add(
+	tw *tar.Writer, name string, r io.Reader, size int64, modTime time.Time) error {
+
+	hash := sha256.New()
+	if err := writeTarEntry(tw, name, io.TeeReader(r, hash), size, modTime); err != nil {
+		return err
+	}
+	manifest.Files = append(manifest.Files, backupEntry{
+		Name:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	})
+	return nil
+}
+
+func (manifest *backupManifest) addFile(tw *tar.Writer, name, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return manifest.add(tw, name, file, info.Size(), info.ModTime())
+}
+
+func writeTarEntry(tw *tar.Writer, name string, r io.Reader, size int64, modTime time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0600, Size: size, ModTime: modTime}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, r, size); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// importBackup 导入备份 path. merge 为 false 时要求当前没有任何数据 (例如全新的数据文件夹),
+// 直接用备份里的数据库与文件恢复；merge 为 true 时把备份合并到现有数据，ID 冲突的条目会得到新 ID.
+// 本地的 config 不会被修改。应在停止服务后执行，执行完毕后 db 已关闭。
+func importBackup(path string, merge bool) error {
+	defer func() { _ = db.Close() }()
+
+	tempDir, err := ioutil.TempDir(dataDir, "import-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(tempDir) }()
+
+	manifest, err := extractBackup(path, tempDir)
+	if err != nil {
+		return err
+	}
+	if manifest.Encrypted && !config.Encrypt {
+		return errors.New(`the backup is encrypted, set "Encrypt": true in the config first`)
+	}
+	if merge {
+		return mergeBackup(manifest, tempDir)
+	}
+	return restoreBackup(manifest, tempDir)
+}
+
+// extractBackup 把备份解压到 tempDir, 并根据 manifest.json 检查内容是否完整、是否被修改。
+func extractBackup(path, tempDir string) (*backupManifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var manifest *backupManifest
+	checksums := make(map[string]string)
+	tr := tar.NewReader(bufio.NewReader(file))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == manifestName {
+			manifest = new(backupManifest)
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !isBackupEntryName(header.Name) {
+			return nil, errors.New("backup: unexpected entry " + header.Name)
+		}
+		checksum, err := extractEntry(tr, filepath.Join(tempDir, filepath.FromSlash(header.Name)))
+		if err != nil {
+			return nil, err
+		}
+		checksums[header.Name] = checksum
+	}
+
+	if manifest == nil {
+		return nil, errors.New("backup: " + manifestName + " not found, the backup is incomplete")
+	}
+	if manifest.Version != backupVersion {
+		return nil, fmt.Errorf("backup: unsupported version %d", manifest.Version)
+	}
+	for _, entry := range manifest.Files {
+		checksum, ok := checksums[entry.Name]
+		if !ok {
+			return nil, errors.New("backup: missing " + entry.Name)
+		}
+		if checksum != entry.SHA256 {
+			return nil, errors.New("backup: checksum mismatch " + entry.Name)
+		}
+		delete(checksums, entry.Name)
+	}
+	for name := range checksums {
+		return nil, errors.New("backup: " + name + " is not in the manifest")
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, databaseFileName)); err != nil {
+		return nil, errors.New("backup: " + databaseFileName + " not found")
+	}
+	return manifest, nil
+}
+
+// isBackupEntryName 只接受已知的文件名，以免解压到 tempDir 之外。
+func isBackupEntryName(name string) bool {
+	switch name {
+	case databaseFileName, configFileName, keyringFileName:
+		return true
+	}
+	base := strings.TrimPrefix(name, backupFilesDir)
+	return base != name && base == filepath.Base(base) && isBlobName(base)
+}
+
+// extractEntry 把 r 写入 filePath, 返回其 sha256.
+func extractEntry(r io.Reader, filePath string) (checksum string, err error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0700); err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), r)
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	return hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// restoreBackup 用备份替换 (空的) 数据库，并复制全部文件与 keyring.
+func restoreBackup(manifest *backupManifest, tempDir string) error {
+	empty, err := isEmptyStore()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return errors.New("the data folder is not empty, use -merge to merge the backup into it")
+	}
+
+	count := 0
+	raw := rawStore()
+	for _, entry := range manifest.Files {
+		name := strings.TrimPrefix(entry.Name, backupFilesDir)
+		if name == entry.Name {
+			continue
+		}
+		if err := storage.PutFile(raw, name, filepath.Join(tempDir, backupFilesDir, name)); err != nil {
+			return err
+		}
+		count++
+	}
+
+	if err := db.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath.Join(tempDir, databaseFileName), dbPath); err != nil {
+		return err
+	}
+	if manifest.Encrypted {
+		// 启动时要使用备份时的密码 (或 KeyFile) 才能通过这个 keyring 的验证。
+		if err := os.Rename(filepath.Join(tempDir, keyringFileName), keyringPath); err != nil {
+			return err
+		}
+	}
+	log.Printf("restored the database and %d files from the backup created at %s",
+		count, manifest.CreatedAt)
+	logMissing(manifest)
+	return nil
+}
+
+// isEmptyStore 判断数据库与文件存储是否都没有数据。
+func isEmptyStore() (bool, error) {
+	messages, err := db.DB.Count(new(Message))
+	if err != nil {
+		return false, err
+	}
+	clips, err := db.DB.Count(new(model.ClipText))
+	if err != nil {
+		return false, err
+	}
+	if messages+clips > 0 {
+		return false, nil
+	}
+	files, err := rawStore().List()
+	if err != nil {
+		return false, err
+	}
+	for _, info := range files {
+		if isBlobName(info.Name) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// mergeBackup 把备份合并到现有数据。加密的备份必须与现有数据使用同一个密钥。
+func mergeBackup(manifest *backupManifest, tempDir string) error {
+	if manifest.Encrypted {
+		key := store.(*encryption.Storage).Key()
+		if err := key.CheckKeyring(filepath.Join(tempDir, keyringFileName)); err != nil {
+			return errors.New("the backup is encrypted with a different key, " +
+				"it can only be restored into an empty data folder")
+		}
+	}
+
+	result, err := db.MergeFrom(filepath.Join(tempDir, databaseFileName), config.ClipsLimit)
+	if err != nil {
+		return err
+	}
+
+	// 先合并数据库再复制文件，如果中途出错，可用 fsck 删除没有文件的条目。
+	count := 0
+	raw := rawStore()
+	for oldID, newID := range result.Messages {
+		for _, names := range [][2]string{
+			{originName(oldID), originName(newID)},
+			{thumbName(oldID), thumbName(newID)},
+		} {
+			src := filepath.Join(tempDir, backupFilesDir, names[0])
+			if _, err := os.Stat(src); os.IsNotExist(err) {
+				continue
+			}
+			if err := storage.PutFile(raw, names[1], src); err != nil {
+				return err
+			}
+			count++
+		}
+	}
+
+	renamed := 0
+	for oldID, newID := range result.Messages {
+		if oldID != newID {
+			renamed++
+		}
+	}
+	log.Printf("merged %d messages (%d with new IDs), %d clips and %d files, skipped %d existing items",
+		len(result.Messages), renamed, result.Clips, count, result.Skipped)
+	logMissing(manifest)
+	return nil
+}
+
+func logMissing(manifest *backupManifest) {
+	if len(manifest.Missing) > 0 {
+		log.Printf("%d files were deleted while the backup was being made, run -fsck -repair to clean up: %s",
+			len(manifest.Missing), strings.Join(manifest.Missing, ", "))
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+// 文件的压缩保存 (zstd)。只压缩文本类的文件，压缩后的体积用于计算数据库总容量，
+// 而 FileSize 仍然是原文件的体积，下载时自动解压。
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/ahui2016/go-send/model"
+	"github.com/ahui2016/goutil"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressFile 如果启用了压缩并且 message 适合压缩，就压缩临时文件，
+// 压缩后的临时文件会取代原临时文件。如果压缩后没有变小，则保留原文件。
+// 无论是否压缩，都会设置 message.StoredSize.
+func compressFile(message *Message, file *uploadedFile) error {
+	message.StoredSize = file.Size
+	if !config.Compress || !message.IsCompressible() {
+		return nil
+	}
+
+	src, err := os.Open(file.TempPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := ioutil.TempFile(filesDir, "zstd-*"+tempFileExt)
+	if err != nil {
+		return err
+	}
+	encoder, err := zstd.NewWriter(dst)
+	if err != nil {
+		_ = dst.Close()
+		_ = os.Remove(dst.Name())
+		return err
+	}
+	_, err1 := io.Copy(encoder, src)
+	err2 := encoder.Close()
+	stat, err3 := dst.Stat()
+	err4 := dst.Close()
+	if err := goutil.WrapErrors(err1, err2, err3, err4); err != nil {
+		_ = os.Remove(dst.Name())
+		return err
+	}
+
+	// 压缩后没有变小，就不压缩了。
+	if stat.Size() >= file.Size {
+		return os.Remove(dst.Name())
+	}
+	_ = file.remove()
+	file.TempPath = dst.Name()
+	message.StoredSize = stat.Size()
+	message.Compression = model.Zstd
+	return nil
+}
+
+// readCloser 让 io.LimitReader 等 reader 也能关闭底层的文件。
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// zstdReadCloser 关闭时同时关闭 decoder 与底层的文件。
+type zstdReadCloser struct {
+	*zstd.Decoder
+	src io.Closer
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return r.src.Close()
+}
+
+// openFile 读取 message 对应的文件的原始内容 (如有必要则解压)。
+func openFile(message *Message) (io.ReadCloser, error) {
+	return openFileRange(message, 0, -1)
+}
+
+// openFileRange 读取原始内容从 offset 开始的 length 个字节，length < 0 表示读到末尾。
+// 压缩文件无法直接跳转，只能解压后丢弃 offset 之前的内容。
+func openFileRange(message *Message, offset, length int64) (io.ReadCloser, error) {
+	name := originName(message.ID)
+	if message.Compression == "" {
+		return store.Get(name, offset, length)
+	}
+
+	src, err := store.Get(name, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		_ = src.Close()
+		return nil, err
+	}
+	rc := zstdReadCloser{decoder, src}
+	if offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, rc, offset); err != nil {
+			_ = rc.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return rc, nil
+	}
+	return readCloser{io.LimitReader(rc, length), rc}, nil
+}
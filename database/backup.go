@@ -0,0 +1,228 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ahui2016/go-send/model"
+	"github.com/asdine/storm/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Snapshot 在一个只读事务里把整个数据库写入 w, 得到一致的快照，
+// 期间其他读写不受影响 (写事务不会等待这个读事务)。
+func (db *DB) Snapshot(w io.Writer) (n int64, err error) {
+	err = db.DB.Bolt.View(func(tx *bolt.Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return
+}
+
+// MergeResult 是 MergeFrom 的结果。
+type MergeResult struct {
+	// Messages 是导入的 Message 的旧 ID 到新 ID 的映射，ID 无冲突时新旧 ID 相同。
+	Messages map[string]string
+	Clips    int // 导入的 ClipText 的数量
+	Skipped  int // 因内容已存在而跳过的条目数量
+}
+
+// MergeFrom 把另一个数据库文件 srcPath (例如备份里的快照) 里的 Message 与 ClipText
+// 合并到 db. 内容已存在 (Checksum 或 TextMsg 相同) 的条目会被跳过，ID 冲突的条目会得到新 ID.
+// srcPath 必须能用 db.Codec 读取。整个合并在一个事务里，出错时 (例如总体积超过容量上限)
+// 不做任何修改。
+// 本函数只处理数据库，文件需要由调用者根据 MergeResult.Messages 复制。
+func (db *DB) MergeFrom(srcPath string, clipsLimit int) (*MergeResult, error) {
+	var options []func(*storm.Options) error
+	if db.Codec != nil {
+		options = append(options, storm.Codec(db.Codec))
+	}
+	src, err := storm.Open(srcPath, options...)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	var messages []Message
+	var clips []ClipText
+	if err := src.All(&messages); err != nil {
+		return nil, err
+	}
+	if err := src.All(&clips); err != nil {
+		return nil, err
+	}
+	// 旧版本的备份需要转换书签与时间的格式。
+	for i := range messages {
+		model.UpgradeAnchor(&messages[i])
+		if _, err := messages[i].UpgradeTimes(); err != nil {
+			return nil, fmt.Errorf("message %s: %w", messages[i].ID, err)
+		}
+		// 后台任务不会导入，因此不能保留等待处理的状态。
+		messages[i].Processing = ""
+	}
+	for i := range clips {
+		if _, err := clips[i].UpgradeTimes(); err != nil {
+			return nil, fmt.Errorf("clip %s: %w", clips[i].ID, err)
+		}
+	}
+
+	result := &MergeResult{Messages: make(map[string]string)}
+	err = db.update(func(tx *txn) error {
+		return db.merge(tx, messages, clips, clipsLimit, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// merge 在一个事务里导入 messages 与 clips, 出错时全部回滚。
+func (db *DB) merge(tx *txn, messages []Message, clips []ClipText, clipsLimit int, result *MergeResult) (err error) {
+	result.Skipped = len(messages) + len(clips)
+	if messages, err = db.newMessagesOnly(tx, messages); err != nil {
+		return err
+	}
+	if clips, err = newClipsOnly(tx, clips); err != nil {
+		return err
+	}
+	result.Skipped -= len(messages) + len(clips)
+
+	var addition int64
+	for _, message := range messages {
+		addition += message.DiskUsage()
+	}
+	if err := db.checkTotalSize(tx, addition); err != nil {
+		return err
+	}
+
+	// 先把 ID 计数器调整到不小于全部导入的 ID, 这样为冲突条目生成的新 ID
+	// 既不会与已有的条目冲突，也不会与稍后导入的条目冲突。
+	if err := raiseID(tx, currentIDKey, itemsToIDs(messages)); err != nil {
+		return err
+	}
+	if err := raiseID(tx, clipIDKey, itemsToIDs(clips)); err != nil {
+		return err
+	}
+
+	for i := range messages {
+		message := &messages[i]
+		oldID := message.ID
+		if err := tx.One("ID", oldID, new(Message)); err == nil {
+			id, err := nextID(tx, currentIDKey)
+			if err != nil {
+				return err
+			}
+			message.ID = id.String()
+		}
+		// 备份里的 ChecksumKey 可能来自不同的加密设置。
+		message.ChecksumKey = db.checksumKey(message.Checksum)
+		if err := tx.Save(message); err != nil {
+			return err
+		}
+		if err := db.indexMessage(tx, message); err != nil {
+			return err
+		}
+		result.Messages[oldID] = message.ID
+	}
+	if err := addTotalSize(tx, addition); err != nil {
+		return err
+	}
+
+	for i := range clips {
+		clip := &clips[i]
+		if err := tx.One("ID", clip.ID, new(ClipText)); err == nil {
+			id, err := nextID(tx, clipIDKey)
+			if err != nil {
+				return err
+			}
+			clip.ID = id.String()
+		}
+		if err := tx.Save(clip); err != nil {
+			return err
+		}
+		if err := db.indexClip(tx, clip); err != nil {
+			return err
+		}
+		result.Clips++
+	}
+	return db.checkClipLimit(tx, clipsLimit)
+}
+
+// newMessagesOnly 去除内容已存在于 db 的条目 (也去除 messages 内部重复的条目)。
+func (db *DB) newMessagesOnly(tx *txn, messages []Message) ([]Message, error) {
+	result := messages[:0]
+	seen := make(map[string]bool)
+	for _, message := range messages {
+		key := message.Checksum
+		if key == "" {
+			key = "text:" + message.TextMsg
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		var m Message
+		var err error
+		if message.Checksum != "" {
+			err = tx.One("ChecksumKey", db.checksumKey(message.Checksum), &m)
+		} else {
+			err = tx.One("TextMsg", message.TextMsg, &m)
+		}
+		if err == nil {
+			continue
+		}
+		if err != storm.ErrNotFound {
+			return nil, err
+		}
+		result = append(result, message)
+	}
+	return result, nil
+}
+
+// newClipsOnly 去除 TextMsg 已存在于 db 的 ClipText.
+func newClipsOnly(tx *txn, clips []ClipText) ([]ClipText, error) {
+	result := clips[:0]
+	seen := make(map[string]bool)
+	for _, clip := range clips {
+		if seen[clip.TextMsg] {
+			continue
+		}
+		err := tx.One("TextMsg", clip.TextMsg, new(ClipText))
+		if err == nil {
+			continue
+		}
+		if err != storm.ErrNotFound {
+			return nil, err
+		}
+		seen[clip.TextMsg] = true
+		result = append(result, clip)
+	}
+	return result, nil
+}
+
+// raiseID 如果 IDs 里有比 key 对应的 ID 计数器更大的 ID, 就把计数器设为该 ID.
+func raiseID(tx *txn, key string, IDs []string) error {
+	var current IncreaseID
+	if err := tx.Get(metadataBucket, key, &current); err != nil {
+		return err
+	}
+	max := current
+	for _, strID := range IDs {
+		if len(strID) < 4 {
+			return errors.New("invalid id: " + strID)
+		}
+		id, err := model.ParseID(strID)
+		if err != nil {
+			return errors.New("invalid id: " + strID)
+		}
+		if id.CompareTo(max) > 0 {
+			max = id
+		}
+	}
+	if max == current {
+		return nil
+	}
+	return tx.Set(metadataBucket, key, &max)
+}
@@ -0,0 +1,42 @@
+package database
+
+// storm 的索引放在子 bucket 里，不经过 codec, 因此加密数据库时索引值仍然是明文。
+// 为了不泄露文件的 checksum, 不直接索引 Message.Checksum, 而是索引 ChecksumKey:
+// 数据库加密时 (HashToken 不为 nil) 是 checksum 的 HMAC, 否则就是 checksum 本身。
+
+import (
+	"encoding/hex"
+)
+
+// checksumKey 返回 checksum 在索引里的形式，空字符串保持不变 (不建立索引)。
+func (db *DB) checksumKey(checksum string) string {
+	if checksum == "" || db.HashToken == nil {
+		return checksum
+	}
+	return hex.EncodeToString(db.HashToken(checksum))
+}
+
+// upgradeChecksumKeys 按当前设置重新计算全部 ChecksumKey, 并重建 Message 与 ClipText 的
+// storm 索引，同时删除旧版本留下的明文索引 (FileName 与 Checksum), 返回修改了的记录数量。
+func (db *DB) upgradeChecksumKeys(tx *txn) (n int, err error) {
+	var messages []Message
+	if err := tx.All(&messages); err != nil {
+		return 0, err
+	}
+	for i := range messages {
+		message := &messages[i]
+		key := db.checksumKey(message.Checksum)
+		if key == message.ChecksumKey {
+			continue
+		}
+		message.ChecksumKey = key
+		if err := tx.Save(message); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := tx.ReIndex(new(Message)); err != nil {
+		return n, err
+	}
+	return n, tx.ReIndex(new(ClipText))
+}
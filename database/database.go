@@ -3,26 +3,23 @@ package database // import "github.com/ahui2016/go-send/database"
 import (
 	"errors"
 	"fmt"
-	"sync"
+	"sort"
 	"time"
 
 	"github.com/ahui2016/go-send/model"
 	"github.com/ahui2016/goutil"
 	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/codec"
 	"github.com/asdine/storm/v3/q"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
+	bolt "go.etcd.io/bbolt"
 )
 
-const (
-	cookieName = "GosendCookie"
-
-	// 文件的最长保存时间
-	keepAlive = time.Hour * 24 * 30 // 30 days
+const cookieName = "GosendCookie"
 
-	// 文件变灰时间，应小于 keepAlive, 预警该文件即将被自动删除。
-	turnGrey = time.Hour * 24 * 15 // 15 days
-)
+// openTimeout 是等待数据库文件锁的时间。
+const openTimeout = 3 * time.Second
 
 // 用来保存数据库的当前状态.
 const (
@@ -45,26 +42,78 @@ type DB struct {
 	DB       *storm.DB
 	Sess     *session.Store
 
-	// 只在 package database 外部使用锁，不在 package database 内部使用锁。
-	sync.Mutex
+	// keepAlive 是文件的默认保存时间，turnGrey 是变灰时间 (应小于 keepAlive),
+	// 变灰表示预警该文件即将被自动删除。
+	keepAlive time.Duration
+	turnGrey  time.Duration
+
+	// Codec 如果不为 nil, 则代替 storm 默认的 JSON codec, 例如用来加密数据库里的记录。
+	// 必须在 Open 之前设置。
+	Codec codec.MarshalUnmarshaler
+
+	// HashToken 如果不为 nil, 全文检索的索引里保存词的 hash 而不是明文 (见 search.go),
+	// 例如在加密数据库时使用。必须在 Open 之前设置。
+	HashToken func(token string) []byte
+
+	// SkipMigrations 为 true 时 Open 不执行数据库迁移 (见 migrate.go),
+	// 用于查看与试运行待执行的迁移。必须在 Open 之前设置。
+	SkipMigrations bool
+}
+
+// txn 是一个读写事务。storm 的操作直接调用 txn (使用该事务的 storm.Node),
+// 全文检索的索引通过 Bolt 读写。
+type txn struct {
+	storm.Node
+	Bolt *bolt.Tx
+}
+
+// update 在一个读写事务里执行 fn, fn 返回错误时整个操作回滚。
+// 记录、ID 计数器、总体积与全文检索的索引都在同一个事务里修改，因此每个操作都是原子的，
+// 并且 bolt 同时只允许一个写事务，调用者不需要另外加锁。
+// 注意 fn 里只能使用 tx, 不可使用 db.DB, 否则会等待 fn 自己的事务而死锁。
+func (db *DB) update(fn func(tx *txn) error) error {
+	return db.DB.Bolt.Update(func(btx *bolt.Tx) error {
+		return fn(&txn{db.DB.WithTransaction(btx), btx})
+	})
 }
 
 // Open .
-func (db *DB) Open(maxAge time.Duration, cap int64, dbPath string) (err error) {
-	if db.DB, err = storm.Open(dbPath); err != nil {
+func (db *DB) Open(maxAge time.Duration, cap int64, keepAlive, turnGrey time.Duration, dbPath string) (err error) {
+	if turnGrey >= keepAlive {
+		return errors.New("turnGrey should be less than keepAlive")
+	}
+	// 设置 Timeout, 以免在服务器运行时执行命令 (例如 -fsck) 一直等待文件锁。
+	options := []func(*storm.Options) error{
+		storm.BoltOptions(0600, &bolt.Options{Timeout: openTimeout}),
+	}
+	if db.Codec != nil {
+		options = append(options, storm.Codec(db.Codec))
+	}
+	if db.DB, err = storm.Open(dbPath, options...); err != nil {
 		return err
 	}
 	db.path = dbPath
 	db.capacity = cap
+	db.keepAlive = keepAlive
+	db.turnGrey = turnGrey
 	db.Sess = session.New(session.Config{
 		Expiration: maxAge,
 		CookieName: cookieName,
 	})
-	err1 := db.createIndexes()
-	err2 := db.initFirstID()
-	err3 := db.initFirstClipID()
-	err4 := db.initTotalSize()
-	return goutil.WrapErrors(err1, err2, err3, err4)
+	err1 := db.initFirstID()
+	err2 := db.initFirstClipID()
+	err3 := db.initTotalSize()
+	if err := goutil.WrapErrors(err1, err2, err3); err != nil {
+		return err
+	}
+	// 使用 SkipMigrations 时不修改已有的数据库，连 storm 的索引也不创建。
+	if db.SkipMigrations {
+		return nil
+	}
+	if err := db.createIndexes(); err != nil {
+		return err
+	}
+	return db.migrate()
 }
 
 // Close 只是 db.DB.Close(), 不清空 db 里的其它部分。
@@ -76,7 +125,9 @@ func (db *DB) Close() error {
 func (db *DB) createIndexes() error {
 	err1 := db.DB.Init(&Message{})
 	err2 := db.DB.Init(&ClipText{})
-	return goutil.WrapErrors(err1, err2)
+	err3 := db.DB.Init(&Job{})
+	err4 := db.DB.Init(&TagRef{})
+	return goutil.WrapErrors(err1, err2, err3, err4)
 }
 
 func (db *DB) initFirstID() (err error) {
@@ -124,6 +175,20 @@ func (db *DB) getClipID() (id IncreaseID, err error) {
 	return
 }
 
+// nextID 把 key 对应的 ID 计数器加一并返回新的 ID, 计数器不存在时从 FirstID 开始。
+func nextID(tx *txn, key string) (id IncreaseID, err error) {
+	err = tx.Get(metadataBucket, key, &id)
+	if err == storm.ErrNotFound {
+		id, err = model.FirstID(), nil
+	}
+	if err != nil {
+		return
+	}
+	id = id.Increase()
+	err = tx.Set(metadataBucket, key, &id)
+	return
+}
+
 // GetTotalSize .
 func (db *DB) GetTotalSize() (size int64, err error) {
 	err = db.DB.Get(metadataBucket, totalSizeKey, &size)
@@ -134,41 +199,48 @@ func (db *DB) setTotalSize(size int64) error {
 	return db.DB.Set(metadataBucket, totalSizeKey, size)
 }
 
-func (db *DB) checkTotalSize(addition int64) error {
-	totalSize, err := db.GetTotalSize()
-	if err != nil {
+func (db *DB) checkTotalSize(tx *txn, addition int64) error {
+	var totalSize int64
+	if err := tx.Get(metadataBucket, totalSizeKey, &totalSize); err != nil {
 		return err
 	}
 	if totalSize+addition > db.capacity {
+		// 回收站里的条目仍然占用容量，清空回收站才会释放。
+		if trashSize, err := trashSize(tx); err == nil && trashSize > 0 {
+			return fmt.Errorf("超过数据库总容量上限 (其中回收站占用 %d bytes, 清空回收站可释放空间)", trashSize)
+		}
 		return errors.New("超过数据库总容量上限")
 	}
 	return nil
 }
 
-// addTotalSize 用于向数据库添加或删除单项内容时更新总体积。
-// 添加时，应先使用 db.checkTotalSize, 再使用 db.Save, 最后使才使用 db.addTotalSize
-// 删除时，应先获取即将删除项目的体积，再删除，最后使用 db.addTotalSize, 此时 addition 应为负数。
-func (db *DB) addTotalSize(addition int64) error {
-	totalSize, err := db.GetTotalSize()
-	if err != nil {
-		return err
+// addTotalSize 在添加、删除或修改条目的同一个事务里更新总体积，删除时 addition 为负数。
+func addTotalSize(tx *txn, addition int64) error {
+	if addition == 0 {
+		return nil
 	}
-	return db.setTotalSize(totalSize + addition)
-}
-
-// recountTotalSize 用于一次性删除多个项目时重新计算数据库总体积。
-func (db *DB) recountTotalSize() error {
-	var totalSize int64 = 0
-	err := db.DB.Select(q.True()).Each(
-		new(Message), func(record interface{}) error {
-			message := record.(*Message)
-			totalSize += message.FileSize
-			return nil
-		})
-	if err != nil {
+	var totalSize int64
+	if err := tx.Get(metadataBucket, totalSizeKey, &totalSize); err != nil {
 		return err
 	}
-	return db.setTotalSize(totalSize)
+	return tx.Set(metadataBucket, totalSizeKey, totalSize+addition)
+}
+
+// RecountTotalSize 重新计算数据库总体积，用于定期校正 (平时在每个操作里增减)。
+func (db *DB) RecountTotalSize() error {
+	return db.update(func(tx *txn) error {
+		var totalSize int64 = 0
+		err := tx.Select(q.True()).Each(
+			new(Message), func(record interface{}) error {
+				message := record.(*Message)
+				totalSize += message.DiskUsage()
+				return nil
+			})
+		if err != nil {
+			return err
+		}
+		return tx.Set(metadataBucket, totalSizeKey, totalSize)
+	})
 }
 
 // NewTextMsg .
@@ -184,12 +256,20 @@ func (db *DB) NewTextMsg(textMsg string) (*Message, error) {
 }
 
 // NewZipMsg 用于自动打包，具有特殊的文件类型，避免重复打包。
-// 注意在该函数里对文件名进行了特殊处理。
+// 注意在该函数里对文件名进行了特殊处理：文件名包含 ID, 因此要在 Insert 之前先分配 ID.
 func (db *DB) NewZipMsg(filename string) (*Message, error) {
 	message, err := db.NewFileMsg(filename)
 	if err != nil {
 		return nil, err
 	}
+	err = db.update(func(tx *txn) error {
+		id, err := nextID(tx, currentIDKey)
+		message.ID = id.String()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 	message.FileName = filename + "_" + message.ID + ".zip"
 	message.FileType = model.GosendZip
 	return message, nil
@@ -207,191 +287,285 @@ func (db *DB) NewFileMsg(filename string) (*Message, error) {
 	return message, nil
 }
 
+// newMessage 返回还没有 ID 的条目，ID 在 Insert 的事务里分配，
+// 这样插入失败 (例如超过容量) 时不会浪费 ID.
 func (db *DB) newMessage(msgType model.MsgType) (*Message, error) {
-	id, err := db.getNextID()
-	if err != nil {
-		return nil, err
-	}
-	message := model.NewMessage(id.String(), msgType)
-	return message, nil
+	return model.NewMessage("", msgType), nil
 }
 
-func (db *DB) newClip(textMsg string) (clip *ClipText, err error) {
-	id, err := db.nextClipID()
-	if err != nil {
-		return nil, err
-	}
-	clip = model.NewClipText(id.String(), model.TextMsg)
-	err = clip.SetTextMsg(textMsg)
-	return clip, nil
-
-}
-
-func (db *DB) getNextID() (nextID IncreaseID, err error) {
-	currentID, err := db.getCurrentID()
-	if err != nil {
-		return
-	}
-	nextID = currentID.Increase()
-	err = db.DB.Set(metadataBucket, currentIDKey, &nextID)
+// Insert 插入新条目。如果内容已存在 (TextMsg 相同或 Checksum 相同)，
+// 则只更新已存在条目的日期 (并加上 message 的标签)，并把 message 替换为该条目，此时 existed 为 true.
+// message 没有 ID 时在同一个事务里分配 ID.
+func (db *DB) Insert(message *Message) (existed bool, err error) {
+	err = db.update(func(tx *txn) error {
+		existed, err = db.insert(tx, message)
+		return err
+	})
 	return
 }
 
-func (db *DB) nextClipID() (nextID IncreaseID, err error) {
-	currentID, err := db.getClipID()
-	if err != nil {
-		return nextID, err
+func (db *DB) insert(tx *txn, message *Message) (existed bool, err error) {
+	// 如果是 TextMsg, 并且内容已存在，则只更新日期。
+	if message.Type == model.TextMsg {
+		var m Message
+		err := tx.One("TextMsg", message.TextMsg, &m)
+		if err == nil {
+			if err := db.touch(tx, &m); err != nil {
+				return false, err
+			}
+			err = db.mergeTags(tx, &m, message.Tags)
+			*message = m
+			return true, err
+		}
+		if err != storm.ErrNotFound {
+			return false, err
+		}
 	}
-	nextID = currentID.Increase()
-	if err := db.DB.Set(metadataBucket, clipIDKey, &nextID); err != nil {
-		return nextID, err
+
+	// 如果文件内容已存在，也只更新日期。
+	message.ChecksumKey = db.checksumKey(message.Checksum)
+	if message.Checksum != "" {
+		m, err := db.touchByChecksum(tx, message.Checksum)
+		if err == nil {
+			err = db.mergeTags(tx, m, message.Tags)
+			*message = *m
+			return true, err
+		}
+		if err != storm.ErrNotFound {
+			return false, err
+		}
 	}
-	return
-}
 
-// Insert .
-func (db *DB) Insert(message *Message) error {
 	// 检查容量冲突
-	if err := db.checkTotalSize(message.FileSize); err != nil {
-		return err
+	if err := db.checkTotalSize(tx, message.DiskUsage()); err != nil {
+		return false, err
 	}
 
-	// 如果是 TextMsg, 并且内容已存在，则只更新日期。
-	if message.Type == model.TextMsg {
-		var m Message
-		err := db.DB.One("TextMsg", message.TextMsg, &m)
-		if err == nil {
-			return db.DB.UpdateField(&m, "UpdatedAt", goutil.TimeNow(model.ISO8601))
+	if message.ID == "" {
+		id, err := nextID(tx, currentIDKey)
+		if err != nil {
+			return false, err
 		}
+		message.ID = id.String()
+	} else if err := tx.One("ID", message.ID, new(Message)); err == nil {
+		// 检查 ID 冲突
+		return false, errors.New("id: " + message.ID + " already exists")
 	}
 
-	// 检查 ID 冲突
-	_, err := db.getByID(message.ID)
-	if err == nil {
-		return errors.New("id: " + message.ID + " already exists")
+	// ID 无冲突，可以保存新条目。
+	if err := tx.Save(message); err != nil {
+		return false, err
+	}
+	if err := db.indexMessage(tx, message); err != nil {
+		return false, err
 	}
+	return false, addTotalSize(tx, message.DiskUsage())
+}
 
-	// ID 无冲突，可以保存新条目。
-	if err := db.DB.Save(message); err != nil {
+// TouchByChecksum 如果已存在 checksum 相同的条目，则更新其日期并返回该条目，
+// 否则返回 storm.ErrNotFound. 如果该条目在回收站里，则同时恢复它。
+func (db *DB) TouchByChecksum(checksum string) (message *Message, err error) {
+	err = db.update(func(tx *txn) error {
+		message, err = db.touchByChecksum(tx, checksum)
 		return err
+	})
+	return
+}
+
+func (db *DB) touchByChecksum(tx *txn, checksum string) (*Message, error) {
+	var message Message
+	if err := tx.One("ChecksumKey", db.checksumKey(checksum), &message); err != nil {
+		return nil, err
+	}
+	return &message, db.touch(tx, &message)
+}
+
+// SetChecksum 设置条目的 Checksum (以及 ChecksumKey).
+func (db *DB) SetChecksum(id, checksum string) error {
+	return db.update(func(tx *txn) error {
+		var message Message
+		if err := tx.One("ID", id, &message); err != nil {
+			return err
+		}
+		message.Checksum = checksum
+		message.ChecksumKey = db.checksumKey(checksum)
+		return tx.Save(&message)
+	})
+}
+
+// touch 更新条目的日期，如果该条目在回收站里，则同时恢复它。
+func (db *DB) touch(tx *txn, message *Message) error {
+	if message.DeletedAt != "" {
+		return restore(tx, message)
 	}
-	return db.addTotalSize(message.FileSize)
+	message.UpdatedAt = model.TimeNow()
+	return tx.UpdateField(message, "UpdatedAt", message.UpdatedAt)
 }
 
 // InsertClip inserts textMsg as a clip, and delete the oldest clip if
-// the numbers of clips is over limit.
-func (db *DB) InsertClip(textMsg string, limit int) (*ClipText, error) {
+// the numbers of clips is over limit. 插入与删除在同一个事务里。
+func (db *DB) InsertClip(textMsg string, tags []string, limit int) (clip *ClipText, err error) {
+	err = db.update(func(tx *txn) error {
+		clip, err = db.insertClip(tx, textMsg, tags, limit)
+		return err
+	})
+	return
+}
 
-	// 检查内容冲突，如果内容已存在，则只更新日期。
+func (db *DB) insertClip(tx *txn, textMsg string, tags []string, limit int) (*ClipText, error) {
+	// 检查内容冲突，如果内容已存在，则只更新日期 (并加上标签)。
 	var c ClipText
-	err := db.DB.One("TextMsg", textMsg, &c)
+	err := tx.One("TextMsg", textMsg, &c)
 	if err == nil {
-		err = db.DB.UpdateField(&c, "UpdatedAt", goutil.TimeNow(model.ISO8601))
+		c.UpdatedAt = model.TimeNow()
+		err = tx.UpdateField(&c, "UpdatedAt", c.UpdatedAt)
+		if err == nil && len(tags) > 0 {
+			if c.Tags, err = model.AddTags(c.Tags, tags); err == nil {
+				err = tx.UpdateField(&c, "Tags", c.Tags)
+			}
+			if err == nil {
+				err = db.indexClip(tx, &c)
+			}
+		}
 		return &c, err
 	}
+	if err != storm.ErrNotFound {
+		return nil, err
+	}
 
 	// 如果内容不存在，则新建 ClipText
-	clip, err := db.newClip(textMsg)
+	id, err := nextID(tx, clipIDKey)
 	if err != nil {
 		return nil, err
 	}
+	clip := model.NewClipText(id.String(), model.TextMsg)
+	if err := clip.SetTextMsg(textMsg); err != nil {
+		return nil, err
+	}
+	clip.Tags = tags
 
 	// 检查 ID 冲突
-	if err := db.DB.One("ID", clip.ID, &c); err == nil {
+	if err := tx.One("ID", clip.ID, &c); err == nil {
 		return nil, errors.New("clip id: " + clip.ID + " already exists")
 	}
 
 	// ID 无冲突，可以保存新条目。
-	if err := db.DB.Save(clip); err != nil {
+	if err := tx.Save(clip); err != nil {
+		return nil, err
+	}
+	if err := db.indexClip(tx, clip); err != nil {
 		return nil, err
 	}
 
 	// 检查数量，如果超过 clipTextLimit 则删除最老的数据。
-	err = db.checkClipLimit(limit)
-	return clip, err
+	return clip, db.checkClipLimit(tx, limit)
 }
 
 // 检查数量，如果超过 limit 则删除最老的数据。
-func (db *DB) checkClipLimit(limit int) error {
-	n, err := db.DB.Count(&ClipText{})
+func (db *DB) checkClipLimit(tx *txn, limit int) error {
+	n, err := tx.Count(&ClipText{})
 	if err != nil {
 		return err
 	}
 	if n < limit {
 		return nil
 	}
-	clips, err1 := db.OldClips(n - limit)
-	err2 := db.deleteClips(clips)
-	return goutil.WrapErrors(err1, err2)
+	var clips []ClipText
+	if err := tx.AllByIndex("UpdatedAt", &clips, storm.Limit(n-limit)); err != nil {
+		return err
+	}
+	return db.deleteClips(tx, clips)
 }
 
-// Delete by id
+// Delete by id, 永久删除 (不经过回收站)。
 func (db *DB) Delete(id string) error {
-	message, err1 := db.getByID(id)
-	err2 := db.DB.DeleteStruct(message)
-	if err := goutil.WrapErrors(err1, err2); err != nil {
-		return err
-	}
-	return db.addTotalSize(-message.FileSize)
+	return db.update(func(tx *txn) error {
+		var message Message
+		if err := tx.One("ID", id, &message); err != nil {
+			return err
+		}
+		return db.deleteMessages(tx, []Message{message})
+	})
 }
 
 // DeleteClip a clip by id
 func (db *DB) DeleteClip(id string) error {
-	return db.DB.Select(q.Eq("ID", id)).Delete(new(ClipText))
+	return db.update(func(tx *txn) error {
+		var clip ClipText
+		if err := tx.One("ID", id, &clip); err != nil {
+			return err
+		}
+		return db.deleteClips(tx, []ClipText{clip})
+	})
 }
 
-func (db *DB) getByID(id string) (*Message, error) {
+// GetByID .
+func (db *DB) GetByID(id string) (*Message, error) {
 	var message Message
 	err := db.DB.One("ID", id, &message)
 	return &message, err
 }
 
-// AllByUpdatedAt .
-func (db *DB) AllByUpdatedAt() (all []Message, err error) {
-	err = db.DB.AllByIndex("UpdatedAt", &all)
-	return
-}
-
-// AllClips .
-func (db *DB) AllClips() (all []ClipText, err error) {
-	err = db.DB.AllByIndex("UpdatedAt", &all)
+// AllByUpdatedAt 不包括回收站里的条目，下同。tag 不为空时只返回带有该标签的条目，下同。
+func (db *DB) AllByUpdatedAt(tag string) (all []Message, err error) {
+	if tag != "" {
+		if all, _, err = db.taggedItems(tag); err != nil {
+			return nil, err
+		}
+		sort.Slice(all, func(i, j int) bool {
+			if all[i].UpdatedAt != all[j].UpdatedAt {
+				return all[i].UpdatedAt < all[j].UpdatedAt
+			}
+			return all[i].ID < all[j].ID
+		})
+		return all, nil
+	}
+	err = db.DB.Select(notTrashed()).OrderBy("UpdatedAt").Find(&all)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
 	return
 }
 
 // AllFiles finds all files(Type = FileMsg).
 func (db *DB) AllFiles() (files []Message, err error) {
-	err = db.DB.Find("Type", model.FileMsg, &files)
+	err = db.DB.Select(q.Eq("Type", model.FileMsg), notTrashed()).Find(&files)
 	return
 }
 
-// AllAnchors finds all anchors(FileType = GosendAnchor).
-func (db *DB) AllAnchors() (anchors []Message, err error) {
-	err = db.DB.Select(q.Eq("FileType", model.GosendAnchor)).
-		OrderBy("UpdatedAt").
-		Find(&anchors)
-	return
-}
-
-// DeleteAllFiles .
-func (db *DB) DeleteAllFiles() error {
-	err := db.DB.Select(q.Eq("Type", model.FileMsg)).Delete(new(Message))
+// TrashAllFiles 把全部文件移到回收站，但不包括 Pinned 的文件。
+func (db *DB) TrashAllFiles() error {
+	var files []Message
+	err := db.DB.Select(q.Eq("Type", model.FileMsg), q.Eq("Pinned", false), notTrashed()).
+		Find(&files)
+	if err == storm.ErrNotFound {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	return db.recountTotalSize()
+	return db.TrashMessages(files)
 }
 
 // DeleteAllClips .
 func (db *DB) DeleteAllClips() error {
-	clip := ClipText{}
-	err1 := db.DB.Drop(&clip)
-	err2 := db.DB.Init(&clip)
-	return goutil.WrapErrors(err1, err2)
+	return db.update(func(tx *txn) error {
+		clip := ClipText{}
+		if err := tx.Drop(&clip); err != nil {
+			return err
+		}
+		if err := tx.Init(&clip); err != nil {
+			return err
+		}
+		return db.unindexAllClips(tx)
+	})
 }
 
 // OldItems 找出最老的 (更新日期最早的) n 条记录，返回 []Message.
+// 不包括 Pinned 的条目，下同。
 func (db *DB) OldItems(n int) (items []Message, err error) {
-	err = db.DB.AllByIndex("UpdatedAt", &items, storm.Limit(n))
+	err = db.DB.Select(q.Eq("Pinned", false), notTrashed()).
+		OrderBy("UpdatedAt").Limit(n).Find(&items)
 	return
 }
 
@@ -401,22 +575,76 @@ func (db *DB) OldClips(n int) (items []ClipText, err error) {
 	return
 }
 
-// GreyItems 找出变灰的条目
+// GreyItems 找出变灰的条目。变灰时间见 Expiry, 无法用索引查询，因此逐条计算。
 func (db *DB) GreyItems() (items []Message, err error) {
-	// 如果 UpdatedAt 在 turnGreyTime 之前，说明它已变灰。
-	turnGreyTime := time.Now().Add(-turnGrey).Format(model.ISO8601)
-	err = db.DB.Select(q.Lt("UpdatedAt", turnGreyTime)).Find(&items)
+	var all []Message
+	if err = db.DB.All(&all); err != nil {
+		return
+	}
+	now := model.TimeNow()
+	for i := range all {
+		if all[i].Pinned || all[i].DeletedAt != "" {
+			continue
+		}
+		turnGreyAt, _, err := db.Expiry(&all[i])
+		if err != nil {
+			return nil, err
+		}
+		if turnGreyAt < now {
+			items = append(items, all[i])
+		}
+	}
+	// 与 Select(...).Find 一样，找不到时返回 storm.ErrNotFound.
+	if len(items) == 0 {
+		err = storm.ErrNotFound
+	}
 	return
 }
 
-// ExpiredItems 找出过期的条目
+// ExpiredItems 找出过期的条目。设置了 ExpiresAt 的条目按 ExpiresAt 计算，
+// 否则在 UpdatedAt 之后的 keepAlive 过期。回收站里的条目另见 TrashedBefore.
 func (db *DB) ExpiredItems() (items []Message, err error) {
-	// 如果 UpdatedAt 在 expiredTime 之前，说明它已过期。
-	expiredTime := time.Now().Add(-keepAlive).Format(model.ISO8601)
-	err = db.DB.Select(q.Lt("UpdatedAt", expiredTime)).Find(&items)
+	now := time.Now()
+	err = db.DB.Select(q.Eq("Pinned", false), notTrashed(), q.Or(
+		q.And(
+			q.Eq("ExpiresAt", ""),
+			q.Lt("UpdatedAt", model.FormatTime(now.Add(-db.keepAlive))),
+		),
+		q.And(
+			q.Not(q.Eq("ExpiresAt", "")),
+			q.Lt("ExpiresAt", model.FormatTime(now)),
+		),
+	)).Find(&items)
 	return
 }
 
+// Expiry 计算 message 的变灰时间与过期 (自动删除) 时间，格式为 ISO8601.
+// Pinned 的条目永不过期，返回空字符串。
+// 没有 ExpiresAt 的条目在 UpdatedAt 之后的 turnGrey 变灰，keepAlive 过期；
+// 设置了 ExpiresAt 的条目按相同的比例变灰，例如默认设置下，在剩余时间过半时变灰。
+func (db *DB) Expiry(message *Message) (turnGreyAt, deleteAt string, err error) {
+	if message.Pinned {
+		return
+	}
+	updatedAt, err := model.ParseTime(message.UpdatedAt)
+	if err != nil {
+		return
+	}
+	expiresAt := updatedAt.Add(db.keepAlive)
+	greyAt := updatedAt.Add(db.turnGrey)
+	if message.ExpiresAt != "" {
+		if expiresAt, err = model.ParseTime(message.ExpiresAt); err != nil {
+			return
+		}
+		ratio := float64(db.turnGrey) / float64(db.keepAlive)
+		greyAt = updatedAt.Add(time.Duration(float64(expiresAt.Sub(updatedAt)) * ratio))
+		if greyAt.After(expiresAt) {
+			greyAt = expiresAt
+		}
+	}
+	return model.FormatTime(greyAt), model.FormatTime(expiresAt), nil
+}
+
 // OldFiles 找出最老的 (更新日期最早的) n 个文件 (Type = FileMsg)
 // 返回 []Message.
 func (db *DB) OldFiles(n int) (files []Message, err error) {
@@ -426,23 +654,60 @@ func (db *DB) OldFiles(n int) (files []Message, err error) {
 }
 
 func (db *DB) queryOldFiles(n int) storm.Query {
-	return db.DB.Select(q.Eq("Type", model.FileMsg)).
+	return db.DB.Select(q.Eq("Type", model.FileMsg), q.Eq("Pinned", false), notTrashed()).
 		OrderBy("UpdatedAt").Limit(n)
 }
 
-// DeleteMessages deletes messages by IDs.
+// DeleteMessages deletes messages by IDs, 永久删除 (不经过回收站)。
+// 已经不存在的条目会被忽略。
 func (db *DB) DeleteMessages(messages []Message) error {
-	IDs := itemsToIDs(messages)
-	err := db.DB.Select(q.In("ID", IDs)).Delete(new(Message))
-	if err != nil {
+	return db.update(func(tx *txn) error {
+		return db.deleteMessages(tx, messages)
+	})
+}
+
+// deleteMessages 删除条目及其索引与后台任务，并从总体积里减去这些条目的体积。
+// 体积按数据库里的记录计算，而不是按参数 (调用者手里的可能是旧数据)。
+func (db *DB) deleteMessages(tx *txn, messages []Message) error {
+	var IDs, docKeys []string
+	var size int64
+	for i := range messages {
+		var m Message
+		err := tx.One("ID", messages[i].ID, &m)
+		if err == storm.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteStruct(&m); err != nil {
+			return err
+		}
+		IDs = append(IDs, m.ID)
+		docKeys = append(docKeys, messageDocKey(m.ID))
+		size += m.DiskUsage()
+	}
+	if len(IDs) == 0 {
+		return nil
+	}
+	if err := db.unindex(tx, docKeys...); err != nil {
+		return err
+	}
+	if err := deleteJobsOf(tx, IDs...); err != nil {
 		return err
 	}
-	return db.recountTotalSize()
+	return addTotalSize(tx, -size)
 }
 
-func (db *DB) deleteClips(clips []ClipText) error {
-	IDs := itemsToIDs(clips)
-	return db.DB.Select(q.In("ID", IDs)).Delete(new(ClipText))
+func (db *DB) deleteClips(tx *txn, clips []ClipText) error {
+	docKeys := make([]string, len(clips))
+	for i := range clips {
+		if err := tx.DeleteStruct(&clips[i]); err != nil {
+			return err
+		}
+		docKeys[i] = clipDocKey(clips[i].ID)
+	}
+	return db.unindex(tx, docKeys...)
 }
 
 func itemsToIDs(items interface{}) (IDs []string) {
@@ -461,22 +726,179 @@ func itemsToIDs(items interface{}) (IDs []string) {
 	return
 }
 
+// SetPinned 固定或取消固定。
+func (db *DB) SetPinned(id string, pinned bool) error {
+	return db.DB.UpdateField(&Message{ID: id}, "Pinned", pinned)
+}
+
+// SetLink 把文本消息设为书签，或者更新书签的网页信息。
+func (db *DB) SetLink(id string, link *model.LinkPreview) error {
+	return db.update(func(tx *txn) error {
+		var message Message
+		if err := tx.One("ID", id, &message); err != nil {
+			return err
+		}
+		message.FileType = model.GosendAnchor
+		message.Link = link
+		if err := tx.Save(&message); err != nil {
+			return err
+		}
+		return db.indexMessage(tx, &message)
+	})
+}
+
+// upgradeAnchors 把旧版本的书签转换为新的形式 (见 model.UpgradeAnchor),
+// 并更新搜索索引与数据库总体积 (TextMsg 由 html 变为网址，体积也随之改变)。
+// 返回转换的条目数量。
+func (db *DB) upgradeAnchors(tx *txn) (n int, err error) {
+	var anchors []Message
+	err = tx.Select(q.Eq("FileType", model.GosendAnchor)).Find(&anchors)
+	if err == storm.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	for i := range anchors {
+		anchor := &anchors[i]
+		oldSize := anchor.DiskUsage()
+		if !model.UpgradeAnchor(anchor) {
+			continue
+		}
+		if err := tx.Save(anchor); err != nil {
+			return n, err
+		}
+		if err := db.indexMessage(tx, anchor); err != nil {
+			return n, err
+		}
+		if err := addTotalSize(tx, anchor.DiskUsage()-oldSize); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// notTrashed 排除回收站里的条目。
+func notTrashed() q.Matcher {
+	return q.Eq("DeletedAt", "")
+}
+
+// Trash 把条目移到回收站 (设置 DeletedAt), 不删除文件。找不到时返回 storm.ErrNotFound.
+// 回收站里的条目仍然计入数据库总体积，永久删除后才会释放。
+func (db *DB) Trash(id string) error {
+	return db.update(func(tx *txn) error {
+		var message Message
+		if err := tx.One("ID", id, &message); err != nil {
+			return err
+		}
+		return trash(tx, &message, model.TimeNow())
+	})
+}
+
+// TrashMessages 把多个条目移到回收站，已被删除的条目会被跳过。
+func (db *DB) TrashMessages(messages []Message) error {
+	now := model.TimeNow()
+	return db.update(func(tx *txn) error {
+		for i := range messages {
+			var message Message
+			err := tx.One("ID", messages[i].ID, &message)
+			if err == storm.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := trash(tx, &message, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// trash 设置 DeletedAt. 已在回收站里的条目保持不变，以免重新开始计算永久删除的时间。
+func trash(tx *txn, message *Message, now string) error {
+	if message.DeletedAt != "" {
+		return nil
+	}
+	return tx.UpdateField(message, "DeletedAt", now)
+}
+
+// Restore 从回收站恢复，同时更新日期，以免恢复后立即过期。
+// 如果单独设置的过期时间已过，则改为使用默认的保存时间。
+func (db *DB) Restore(id string) error {
+	return db.update(func(tx *txn) error {
+		var message Message
+		if err := tx.One("ID", id, &message); err != nil {
+			return err
+		}
+		if message.DeletedAt == "" {
+			return errors.New("id: " + id + " is not in the trash")
+		}
+		return restore(tx, &message)
+	})
+}
+
+func restore(tx *txn, message *Message) error {
+	now := model.TimeNow()
+	message.DeletedAt = ""
+	message.UpdatedAt = now
+	if message.ExpiresAt != "" && message.ExpiresAt < now {
+		message.ExpiresAt = ""
+	}
+	// 用 Save 而不是 Update, 因为 Update 会忽略零值 (空字符串)。
+	return tx.Save(message)
+}
+
+// TrashedItems 返回回收站里的全部条目，最近删除的排在最前。
+func (db *DB) TrashedItems() (items []Message, err error) {
+	err = db.DB.Select(q.Not(notTrashed())).OrderBy("DeletedAt").Reverse().Find(&items)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// TrashedBefore 返回在 deadline (ISO8601) 之前移到回收站的条目。
+func (db *DB) TrashedBefore(deadline string) (items []Message, err error) {
+	err = db.DB.Select(q.Not(notTrashed()), q.Lt("DeletedAt", deadline)).Find(&items)
+	return
+}
+
+// TrashSize 返回回收站里的条目的总体积。
+func (db *DB) TrashSize() (size int64, err error) {
+	return trashSize(db.DB)
+}
+
+func trashSize(node storm.Node) (size int64, err error) {
+	var items []Message
+	err = node.Select(q.Not(notTrashed())).Find(&items)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	for i := range items {
+		size += items[i].DiskUsage()
+	}
+	return
+}
+
 // UpdateDatetime ...
 func (db *DB) UpdateDatetime(id string) error {
 	return db.DB.UpdateField(
-		&Message{ID: id}, "UpdatedAt", goutil.TimeNow(model.ISO8601))
+		&Message{ID: id}, "UpdatedAt", model.TimeNow())
 }
 
 // UpdateClipDatetime ...
 func (db *DB) UpdateClipDatetime(id string) error {
 	return db.DB.UpdateField(
-		&ClipText{ID: id}, "UpdatedAt", goutil.TimeNow(model.ISO8601))
+		&ClipText{ID: id}, "UpdatedAt", model.TimeNow())
 }
 
-// LastTextMsg .
+// LastTextMsg 不包括端到端加密的消息，因为它们是密文。
 func (db *DB) LastTextMsg() (string, error) {
 	var message Message
-	err := db.DB.Select(q.Eq("Type", model.TextMsg)).
+	err := db.DB.Select(q.Eq("Type", model.TextMsg), q.Eq("Encrypted", false), notTrashed()).
 		OrderBy("UpdatedAt").Reverse().First(&message)
 	if err != nil {
 		return "", err
@@ -484,14 +906,6 @@ func (db *DB) LastTextMsg() (string, error) {
 	return message.TextMsg, nil
 }
 
-// InsertTextMsg .
-func (db *DB) InsertTextMsg(textMsg string) (message *Message, err error) {
-	if message, err = db.NewTextMsg(textMsg); err != nil {
-		return
-	}
-	return message, db.Insert(message)
-}
-
 // SessionCheck .
 func (db *DB) SessionCheck(c *fiber.Ctx) bool {
 	sess, err := db.Sess.Get(c)
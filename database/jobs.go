@@ -0,0 +1,190 @@
+package database
+
+import (
+	"github.com/ahui2016/go-send/model"
+	"github.com/asdine/storm/v3"
+	"github.com/asdine/storm/v3/q"
+)
+
+// Job 是后台任务，见 package main 的 jobs.go.
+type Job = model.Job
+
+// jobIDKey 保存最近一个后台任务的 ID.
+const jobIDKey = "job-id-key"
+
+// AddJob 为已写入数据库的 message 添加一个后台任务，并把 message 标记为等待处理。
+func (db *DB) AddJob(kind model.JobKind, message *Message) error {
+	return db.update(func(tx *txn) error {
+		id, err := nextID(tx, jobIDKey)
+		if err != nil {
+			return err
+		}
+		now := model.TimeNow()
+		job := &Job{
+			ID:        id.String(),
+			Kind:      kind,
+			MessageID: message.ID,
+			Status:    model.JobPending,
+			RunAt:     now,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+		if err := tx.Save(job); err != nil {
+			return err
+		}
+		message.Processing = model.JobPending
+		return tx.UpdateField(message, "Processing", message.Processing)
+	})
+}
+
+// ClaimJob 取出一个已到执行时间的任务，标记为正在执行并增加执行次数。
+// 没有任务时返回 nil. 查找与标记在同一个事务里，因此多个 worker 不会取得同一个任务。
+func (db *DB) ClaimJob() (job *Job, err error) {
+	err = db.update(func(tx *txn) error {
+		now := model.TimeNow()
+		var j Job
+		err := tx.Select(q.Eq("Status", model.JobPending), q.Lte("RunAt", now)).
+			OrderBy("RunAt", "ID").First(&j)
+		if err == storm.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		j.Status = model.JobRunning
+		j.Attempts++
+		j.UpdatedAt = now
+		job = &j
+		return tx.Save(job)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// CompleteJob 删除已完成的任务。如果该条目没有其它任务，则清除其 Processing.
+// 任务或条目已被删除时不算错误。
+func (db *DB) CompleteJob(job *Job) error {
+	return db.update(func(tx *txn) error {
+		if err := tx.DeleteStruct(job); err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		var others []Job
+		err := tx.Find("MessageID", job.MessageID, &others)
+		if err == storm.ErrNotFound {
+			return setProcessing(tx, job.MessageID, "")
+		}
+		return err
+	})
+}
+
+// FailJob 把任务标记为失败 (不再重试), 同时把条目标记为处理失败。
+func (db *DB) FailJob(job *Job, errMsg string) error {
+	return db.update(func(tx *txn) error {
+		if gone, err := jobDeleted(tx, job); gone || err != nil {
+			return err
+		}
+		job.Status = model.JobFailed
+		job.LastError = errMsg
+		job.UpdatedAt = model.TimeNow()
+		if err := tx.Save(job); err != nil {
+			return err
+		}
+		return setProcessing(tx, job.MessageID, model.JobFailed)
+	})
+}
+
+// RetryJobLater 把任务放回队列，在 runAt (ISO8601) 之后再执行。
+func (db *DB) RetryJobLater(job *Job, errMsg, runAt string) error {
+	return db.update(func(tx *txn) error {
+		if gone, err := jobDeleted(tx, job); gone || err != nil {
+			return err
+		}
+		job.Status = model.JobPending
+		job.LastError = errMsg
+		job.RunAt = runAt
+		job.UpdatedAt = model.TimeNow()
+		return tx.Save(job)
+	})
+}
+
+// RetryJob 立即重新执行一个失败的任务，执行次数从零开始计算。
+func (db *DB) RetryJob(id string) error {
+	return db.update(func(tx *txn) error {
+		var job Job
+		if err := tx.One("ID", id, &job); err != nil {
+			return err
+		}
+		if job.Status != model.JobFailed {
+			return nil
+		}
+		now := model.TimeNow()
+		job.Status = model.JobPending
+		job.Attempts = 0
+		job.RunAt = now
+		job.UpdatedAt = now
+		if err := tx.Save(&job); err != nil {
+			return err
+		}
+		return setProcessing(tx, job.MessageID, model.JobPending)
+	})
+}
+
+// ResetRunningJobs 把上次关闭程序时正在执行的任务放回队列，应在启动 worker 之前调用。
+func (db *DB) ResetRunningJobs() error {
+	return db.update(func(tx *txn) error {
+		var jobs []Job
+		err := tx.Find("Status", model.JobRunning, &jobs)
+		if err == storm.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i := range jobs {
+			jobs[i].Status = model.JobPending
+			if err := tx.Save(&jobs[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AllJobs 返回全部任务 (包括失败的任务), 按 ID 排序。
+func (db *DB) AllJobs() (jobs []Job, err error) {
+	err = db.DB.All(&jobs)
+	return
+}
+
+// deleteJobsOf 删除这些条目的全部任务。
+func deleteJobsOf(tx *txn, messageIDs ...string) error {
+	err := tx.Select(q.In("MessageID", messageIDs)).Delete(new(Job))
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// jobDeleted 判断任务是否在执行期间被删除 (条目被删除时一起删除), 此时不可再保存该任务。
+func jobDeleted(tx *txn, job *Job) (bool, error) {
+	err := tx.One("ID", job.ID, new(Job))
+	if err == storm.ErrNotFound {
+		return true, nil
+	}
+	return false, err
+}
+
+// setProcessing 设置条目的 Processing, 条目已被删除时不算错误。
+func setProcessing(tx *txn, messageID, status string) error {
+	var message Message
+	err := tx.One("ID", messageID, &message)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return tx.UpdateField(&message, "Processing", status)
+}
@@ -0,0 +1,342 @@
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/ahui2016/go-send/model"
+	"github.com/asdine/storm/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+// 排序方式。
+const (
+	SortByUpdated = "updated"
+	SortByCreated = "created"
+	SortBySize    = "size"
+	SortByName    = "name"
+)
+
+// storm 把字段的索引保存在该类型的 bucket 里名为 stormIndexPrefix+字段名 的子 bucket 里，
+// key 是 "字段值__ID", value 是 ID (另有一个名为 stormIDsKey 的子 bucket).
+const (
+	stormIndexPrefix = "__storm_index_"
+	stormIDsKey      = "storm__ids"
+)
+
+// ErrBadCursor 表示 cursor 无法解析或与排序方式不一致。
+var ErrBadCursor = errors.New("bad cursor")
+
+// ListQuery 是分页列表的条件。字符串为空、数字为零表示不限。
+// 日期范围是 model.TimeRange 返回的 ISO8601 区间，From 包括在内，To 不包括在内。
+type ListQuery struct {
+	Sort   string // SortByUpdated (默认), SortByCreated, SortBySize 或 SortByName
+	Asc    bool   // 默认从新到旧 (从大到小)
+	Cursor string // 上一页返回的 next cursor, 为空表示第一页
+	Limit  int    // 每页的条目数量，为零表示不分页
+
+	Type        model.MsgType
+	FileType    string // FileType 的前缀，例如 "image" 或 "text/plain"
+	MinSize     int64
+	MaxSize     int64
+	CreatedFrom string
+	CreatedTo   string
+	UpdatedFrom string
+	UpdatedTo   string
+	Tag         string
+	Pinned      string // "1" 表示只要固定的条目，"0" 表示只要未固定的条目
+}
+
+// listCursor 是 cursor 解码后的内容，即上一页最后一个条目的排序值与 ID.
+type listCursor struct {
+	Sort  string
+	Value string `json:",omitempty"`
+	Size  int64  `json:",omitempty"`
+	ID    string
+}
+
+// listEntry 是排序与筛选用到的字段，Message 与 ClipText 共用。
+type listEntry struct {
+	ID        string
+	Type      model.MsgType
+	FileName  string
+	FileType  string
+	FileSize  int64
+	CreatedAt string
+	UpdatedAt string
+	Tags      []string
+	Pinned    bool
+}
+
+func messageEntry(m *Message) listEntry {
+	return listEntry{m.ID, m.Type, m.FileName, m.FileType, m.FileSize, m.CreatedAt, m.UpdatedAt, m.Tags, m.Pinned}
+}
+
+func clipEntry(clip *ClipText) listEntry {
+	return listEntry{clip.ID, clip.Type, clip.FileName, clip.FileType, clip.FileSize, clip.CreatedAt, clip.UpdatedAt, clip.Tags, false}
+}
+
+// ListMessages 按 query 返回一页消息 (不包括回收站里的条目) 以及下一页的 cursor,
+// 没有下一页时 next 为空。
+//
+// 按标签筛选时通过标签索引只读取带有该标签的条目，然后在内存里排序。
+// 否则，按 UpdatedAt 或 CreatedAt 排序时直接遍历 storm 的索引，只解码需要的条目，
+// 因此第一页的速度与条目总数无关。按体积或文件名排序时 (文本消息没有文件名，不在索引里)
+// 需要读取全部条目再排序。
+func (db *DB) ListMessages(query ListQuery) (messages []Message, next string, err error) {
+	cursor, err := query.decodeCursor()
+	if err != nil {
+		return nil, "", err
+	}
+	var all []Message
+	switch {
+	case query.Tag != "":
+		if all, _, err = db.taggedItems(query.Tag); err != nil {
+			return nil, "", err
+		}
+	case query.Sort == SortByUpdated:
+		return db.listByIndex("UpdatedAt", query, cursor)
+	case query.Sort == SortByCreated:
+		return db.listByIndex("CreatedAt", query, cursor)
+	default:
+		if err := db.DB.Select(notTrashed()).Find(&all); err != nil && err != storm.ErrNotFound {
+			return nil, "", err
+		}
+	}
+	entries := make([]listEntry, len(all))
+	for i := range all {
+		entries[i] = messageEntry(&all[i])
+	}
+	page, next := query.paginate(entries, cursor)
+	messages = make([]Message, len(page))
+	for i, j := range page {
+		messages[i] = all[j]
+	}
+	return messages, next, nil
+}
+
+// ListClips 与 ListMessages 相同，用于 ClipText. ClipText 的数量有上限，因此总是在内存里排序。
+func (db *DB) ListClips(query ListQuery) (clips []ClipText, next string, err error) {
+	cursor, err := query.decodeCursor()
+	if err != nil {
+		return nil, "", err
+	}
+	var all []ClipText
+	if query.Tag != "" {
+		_, all, err = db.taggedItems(query.Tag)
+	} else {
+		err = db.DB.All(&all)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	entries := make([]listEntry, len(all))
+	for i := range all {
+		entries[i] = clipEntry(&all[i])
+	}
+	page, next := query.paginate(entries, cursor)
+	clips = make([]ClipText, len(page))
+	for i, j := range page {
+		clips[i] = all[j]
+	}
+	return clips, next, nil
+}
+
+// listByIndex 从 cursor 之后开始遍历 field 的索引，逐条解码并筛选，直到凑够一页。
+func (db *DB) listByIndex(field string, query ListQuery, cursor *listCursor) (messages []Message, next string, err error) {
+	err = db.DB.Bolt.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("Message"))
+		if bucket == nil {
+			return nil
+		}
+		index := bucket.Bucket([]byte(stormIndexPrefix + field))
+		if index == nil {
+			return nil
+		}
+		c := index.Cursor()
+		step := c.Next
+		if !query.Asc {
+			step = c.Prev
+		}
+
+		var k, id []byte
+		switch {
+		case cursor == nil && query.Asc:
+			k, id = c.First()
+		case cursor == nil:
+			k, id = c.Last()
+		default:
+			// 跳过 cursor 本身 (以及 Seek 落到的下一个 key), 从严格在 cursor 之后的位置开始。
+			after := []byte(cursor.Value + "__" + cursor.ID)
+			k, id = c.Seek(after)
+			switch {
+			case !query.Asc && k == nil:
+				k, id = c.Last()
+			case !query.Asc:
+				k, id = c.Prev()
+			case bytes.Equal(k, after):
+				k, id = c.Next()
+			}
+		}
+
+		for ; k != nil; k, id = step() {
+			if id == nil || bytes.Equal(k, []byte(stormIDsKey)) {
+				continue
+			}
+			raw := bucket.Get(id)
+			if raw == nil {
+				continue
+			}
+			var m Message
+			if err := db.DB.Codec().Unmarshal(raw, &m); err != nil {
+				return err
+			}
+			if m.DeletedAt != "" {
+				continue
+			}
+			entry := messageEntry(&m)
+			if !query.match(&entry) {
+				continue
+			}
+			if query.Limit > 0 && len(messages) == query.Limit {
+				next = query.encodeCursor(&messages[len(messages)-1])
+				return nil
+			}
+			messages = append(messages, m)
+		}
+		return nil
+	})
+	return
+}
+
+// paginate 筛选并排序 entries, 返回当前页的条目在 entries 里的位置以及下一页的 cursor.
+func (query *ListQuery) paginate(entries []listEntry, cursor *listCursor) (page []int, next string) {
+	for i := range entries {
+		e := &entries[i]
+		if !query.match(e) {
+			continue
+		}
+		if cursor != nil && !query.before(cursor, e) {
+			continue
+		}
+		page = append(page, i)
+	}
+	sort.Slice(page, func(i, j int) bool {
+		a := query.cursorOf(&entries[page[i]])
+		return query.before(&a, &entries[page[j]])
+	})
+	if query.Limit > 0 && len(page) > query.Limit {
+		page = page[:query.Limit]
+		last := query.cursorOf(&entries[page[len(page)-1]])
+		next = last.encode()
+	}
+	return
+}
+
+// match 判断 e 是否符合筛选条件 (不检查 DeletedAt).
+func (query *ListQuery) match(e *listEntry) bool {
+	if query.Type != "" && e.Type != query.Type {
+		return false
+	}
+	if !strings.HasPrefix(e.FileType, query.FileType) {
+		return false
+	}
+	if query.MinSize > 0 && e.FileSize < query.MinSize {
+		return false
+	}
+	if query.MaxSize > 0 && e.FileSize > query.MaxSize {
+		return false
+	}
+	if !model.InTimeRange(e.CreatedAt, query.CreatedFrom, query.CreatedTo) {
+		return false
+	}
+	if !model.InTimeRange(e.UpdatedAt, query.UpdatedFrom, query.UpdatedTo) {
+		return false
+	}
+	if query.Tag != "" && !model.HasTag(e.Tags, query.Tag) {
+		return false
+	}
+	if query.Pinned != "" && e.Pinned != (query.Pinned == "1") {
+		return false
+	}
+	return true
+}
+
+// cursorOf 返回 e 在当前排序方式下的排序值与 ID.
+func (query *ListQuery) cursorOf(e *listEntry) listCursor {
+	cursor := listCursor{Sort: query.Sort, ID: e.ID}
+	switch query.Sort {
+	case SortByCreated:
+		cursor.Value = e.CreatedAt
+	case SortBySize:
+		cursor.Size = e.FileSize
+	case SortByName:
+		cursor.Value = e.FileName
+	default:
+		cursor.Value = e.UpdatedAt
+	}
+	return cursor
+}
+
+// before 判断在当前排序方式下 cursor 是否排在 e 前面。排序值相同时按 ID 排序，
+// 与 storm 索引里 "字段值__ID" 的顺序一致。
+func (query *ListQuery) before(cursor *listCursor, e *listEntry) bool {
+	other := query.cursorOf(e)
+	var cmp int
+	switch {
+	case cursor.Size != other.Size:
+		cmp = -1
+		if cursor.Size > other.Size {
+			cmp = 1
+		}
+	case cursor.Value != other.Value:
+		cmp = strings.Compare(cursor.Value, other.Value)
+	default:
+		cmp = strings.Compare(cursor.ID, other.ID)
+	}
+	if query.Asc {
+		return cmp < 0
+	}
+	return cmp > 0
+}
+
+func (query *ListQuery) encodeCursor(m *Message) string {
+	entry := messageEntry(m)
+	cursor := query.cursorOf(&entry)
+	return cursor.encode()
+}
+
+func (cursor *listCursor) encode() string {
+	blob, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(blob)
+}
+
+// decodeCursor 解码 query.Cursor, 同时检查 query.Sort (为空时设为默认值).
+func (query *ListQuery) decodeCursor() (*listCursor, error) {
+	switch query.Sort {
+	case "":
+		query.Sort = SortByUpdated
+	case SortByUpdated, SortByCreated, SortBySize, SortByName:
+	default:
+		return nil, errors.New("unknown sort: " + query.Sort)
+	}
+	if query.Cursor == "" {
+		return nil, nil
+	}
+	blob, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(blob, &cursor); err != nil || cursor.ID == "" {
+		return nil, ErrBadCursor
+	}
+	if cursor.Sort != query.Sort {
+		return nil, ErrBadCursor
+	}
+	return &cursor, nil
+}
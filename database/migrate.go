@@ -0,0 +1,290 @@
+package database
+
+// 数据库迁移：修改 Message 等记录的格式 (例如新增字段、转换旧数据) 时，在 migrations 末尾
+// 添加一个迁移，版本号加一。metadataBucket 里的 schemaVersionKey 记录已执行到哪个版本，
+// Open 时按顺序执行其余的迁移，每个迁移与版本号的更新在同一个事务里，出错时该迁移全部回滚，
+// 下次启动时重新执行。执行之前先把数据库文件备份到同一个文件夹里 (见 backupBeforeMigrate)。
+// 迁移必须是幂等的 (重复执行不会出错也不会再改变数据), 因为旧版本的数据库没有版本号，
+// 只能从第一个迁移开始执行。
+// 另外，导入旧版本的备份时 (MergeFrom) 也需要相应地转换数据。
+//
+// 索引 (ChecksumKey, 全文检索与标签) 也由迁移建立，它们的形式取决于是否加密 (HashToken)。
+// 加密设置改变后 (例如 -encrypt-store), 索引与当前设置不符，migrate 在备份之后
+// 重新执行这些迁移 (见 indexMigrations)。使用 SkipMigrations 打开时不执行任何迁移。
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/asdine/storm/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+const schemaVersionKey = "schema-version-key"
+
+// errDryRun 用来让试运行的事务回滚。
+var errDryRun = errors.New("dry run")
+
+// migration 是一个数据库迁移，run 返回修改了的记录数量。
+type migration struct {
+	version int
+	name    string
+	run     func(db *DB, tx *txn) (n int, err error)
+}
+
+// migrations 按版本号排列，只能在末尾添加，不可修改已有的版本号。
+var migrations = []migration{
+	{1, "convert anchors to structured link previews", (*DB).upgradeAnchors},
+	{2, "convert timestamps to UTC ISO8601", func(_ *DB, tx *txn) (int, error) {
+		return upgradeTimestamps(tx)
+	}},
+	{3, "index checksums by ChecksumKey, drop plaintext indexes", (*DB).upgradeChecksumKeys},
+	{4, "build the full-text search index", (*DB).rebuildSearchIndex},
+	{5, "build the tag index", (*DB).rebuildTagIndex},
+}
+
+// indexMigrations 是建立索引的迁移，加密设置改变后需要重新执行。
+var indexMigrations = []int{3, 4, 5}
+
+// latestSchemaVersion 是本程序的数据库版本。
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// MigrationInfo 是一个迁移的状态。
+type MigrationInfo struct {
+	Version int
+	Name    string
+	Applied bool
+	Changes int `json:",omitempty"` // 试运行时修改的记录数量
+}
+
+// MigrationReport 是 DryRunMigrations 的结果。
+type MigrationReport struct {
+	Version    int // 数据库当前的版本
+	Latest     int // 本程序的版本
+	Migrations []MigrationInfo
+}
+
+// SchemaVersion 返回数据库当前的版本，旧版本的数据库没有版本号，返回零。
+func (db *DB) SchemaVersion() (version int, err error) {
+	err = db.DB.Get(metadataBucket, schemaVersionKey, &version)
+	if err == storm.ErrNotFound {
+		err = nil
+	}
+	return
+}
+
+// pendingMigrations 返回版本号大于 version 的迁移。
+func pendingMigrations(version int) []migration {
+	for i, m := range migrations {
+		if m.version > version {
+			return migrations[i:]
+		}
+	}
+	return nil
+}
+
+// migrate 执行待执行的迁移，以及与加密设置不符的索引的迁移 (见 indexMigrations)。
+// 新建的 (没有任何条目的) 数据库不需要备份。
+func (db *DB) migrate() error {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > latestSchemaVersion() {
+		return fmt.Errorf("the database schema version %d is newer than this program (%d)",
+			version, latestSchemaVersion())
+	}
+	pending := pendingMigrations(version)
+	outdated, err := db.indexesOutdated()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 && !outdated {
+		return nil
+	}
+	empty, err := db.isEmpty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		backup, err := db.backupBeforeMigrate(version)
+		if err != nil {
+			return err
+		}
+		log.Printf("database: backed up to %s before migrating from version %d", backup, version)
+	}
+	for _, m := range pending {
+		if err := db.runMigration(m); err != nil {
+			return err
+		}
+	}
+
+	// 待执行的迁移已按当前设置建立索引，因此要重新判断。
+	if outdated, err = db.indexesOutdated(); err != nil || !outdated {
+		return err
+	}
+	for _, m := range migrations {
+		for _, v := range indexMigrations {
+			if m.version == v {
+				if err := db.runMigration(m); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// runMigration 在一个事务里执行 m 并更新版本号 (版本号不会降低)。
+func (db *DB) runMigration(m migration) error {
+	var n int
+	err := db.update(func(tx *txn) (err error) {
+		if n, err = m.run(db, tx); err != nil {
+			return err
+		}
+		var version int
+		if err := tx.Get(metadataBucket, schemaVersionKey, &version); err != nil && err != storm.ErrNotFound {
+			return err
+		}
+		if m.version <= version {
+			return nil
+		}
+		return tx.Set(metadataBucket, schemaVersionKey, m.version)
+	})
+	if err != nil {
+		return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+	}
+	log.Printf("database: migration %d (%s): %d records changed", m.version, m.name, n)
+	return nil
+}
+
+// indexesOutdated 判断索引是否与当前的加密设置不符。还没有全文检索索引的旧数据库
+// 由迁移 4 建立索引，不算在内。
+func (db *DB) indexesOutdated() (outdated bool, err error) {
+	version, err := db.SchemaVersion()
+	if err != nil || version < 4 {
+		return false, err
+	}
+	err = db.DB.Bolt.View(func(tx *bolt.Tx) error {
+		outdated = db.searchIndexOutdated(tx)
+		return nil
+	})
+	return
+}
+
+// DryRunMigrations 列出全部迁移，并在一个事务里执行待执行的迁移然后回滚，
+// 得到每个迁移将会修改的记录数量。数据库应使用 SkipMigrations 打开。
+func (db *DB) DryRunMigrations() (*MigrationReport, error) {
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	report := &MigrationReport{Version: version, Latest: latestSchemaVersion()}
+	for _, m := range migrations {
+		report.Migrations = append(report.Migrations, MigrationInfo{
+			Version: m.version,
+			Name:    m.name,
+			Applied: m.version <= version,
+		})
+	}
+	err = db.update(func(tx *txn) error {
+		for i, m := range migrations {
+			if m.version <= version {
+				continue
+			}
+			n, err := m.run(db, tx)
+			if err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+			}
+			report.Migrations[i].Changes = n
+		}
+		return errDryRun
+	})
+	if err != errDryRun {
+		return nil, err
+	}
+	return report, nil
+}
+
+// isEmpty 判断数据库里是否没有任何条目。
+func (db *DB) isEmpty() (bool, error) {
+	messages, err := db.DB.Count(new(Message))
+	if err != nil {
+		return false, err
+	}
+	clips, err := db.DB.Count(new(ClipText))
+	if err != nil {
+		return false, err
+	}
+	return messages+clips == 0, nil
+}
+
+// backupBeforeMigrate 把数据库完整地复制到 db.path 所在的文件夹，
+// 文件名包括版本号与时间，例如 gosend.db.v1-20201220-150405.bak, 返回备份的路径。
+func (db *DB) backupBeforeMigrate(version int) (string, error) {
+	path := fmt.Sprintf("%s.v%d-%s.bak", db.path, version, time.Now().Format("20060102-150405"))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Snapshot(f); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// upgradeTimestamps 把 Message, ClipText 与 Job 里旧版本的时间转换为 ISO8601 并更新索引
+// (见 model.ISO8601), 返回修改了的记录数量。
+func upgradeTimestamps(tx *txn) (n int, err error) {
+	var messages []Message
+	if err := tx.All(&messages); err != nil {
+		return 0, err
+	}
+	var clips []ClipText
+	if err := tx.All(&clips); err != nil {
+		return 0, err
+	}
+	var jobs []Job
+	if err := tx.All(&jobs); err != nil {
+		return 0, err
+	}
+	type record interface {
+		UpgradeTimes() (bool, error)
+	}
+	var records []record
+	var ids []string
+	for i := range messages {
+		records, ids = append(records, &messages[i]), append(ids, messages[i].ID)
+	}
+	for i := range clips {
+		records, ids = append(records, &clips[i]), append(ids, clips[i].ID)
+	}
+	for i := range jobs {
+		records, ids = append(records, &jobs[i]), append(ids, jobs[i].ID)
+	}
+	for i, r := range records {
+		changed, err := r.UpgradeTimes()
+		if err != nil {
+			return n, fmt.Errorf("%T %s: %w", r, ids[i], err)
+		}
+		if !changed {
+			continue
+		}
+		if err := tx.Save(r); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,292 @@
+package database
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahui2016/go-send/model"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testdata/legacy.db 是旧版本 (没有版本号) 的数据库，包括：
+//   - 文本 1ka1 "hello world", 标签 red 与 blue
+//   - 文件 1ka2 photo.jpg, 标签 red; 文件 1ka3 notes.txt
+//   - 文本 1ka4 "to be trashed", 在回收站里
+//   - 旧格式的书签 1ka5 (TextMsg 是 <a> 标签，没有 Link)
+//   - 剪贴板 1ka1 "clip text", 标签 green
+//
+// 时间是旧格式 (+00:00), 有明文的 FileName 与 Checksum 索引，没有全文检索与标签索引。
+const legacyFixture = "testdata/legacy.db"
+
+// copyFixture 把 legacyFixture 复制到临时文件夹，返回新文件的路径。
+func copyFixture(t *testing.T) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(legacyFixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "gosend.db")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func openTestDB(t *testing.T, path string, skipMigrations bool) *DB {
+	t.Helper()
+	db := &DB{SkipMigrations: skipMigrations}
+	if err := db.Open(time.Hour, 1<<30, 30*24*time.Hour, 20*24*time.Hour, path); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// backups 返回 path 的迁移前备份。
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+	files, err := filepath.Glob(path + ".v*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDryRunMigrations(t *testing.T) {
+	path := copyFixture(t)
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t, path, true)
+	report, err := db.DryRunMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Version != 0 || report.Latest != latestSchemaVersion() {
+		t.Errorf("Version = %d, Latest = %d", report.Version, report.Latest)
+	}
+	tests := []struct {
+		version int
+		changes int
+	}{
+		{1, 1}, // 书签 1ka5
+		{2, 6}, // 五个消息与一个剪贴板条目
+		{3, 2}, // 两个文件
+		{4, 6},
+		{5, 3}, // 带有标签的条目
+	}
+	if len(report.Migrations) != len(tests) {
+		t.Fatalf("got %d migrations, want %d", len(report.Migrations), len(tests))
+	}
+	for i, tt := range tests {
+		m := report.Migrations[i]
+		if m.Version != tt.version || m.Applied || m.Changes != tt.changes {
+			t.Errorf("migration %d: got %+v, want %d changes", tt.version, m, tt.changes)
+		}
+	}
+
+	// 试运行之后数据库没有任何改变。
+	if version, err := db.SchemaVersion(); err != nil || version != 0 {
+		t.Errorf("SchemaVersion = %d, %v", version, err)
+	}
+	anchor, err := db.GetByID("1ka5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anchor.Link != nil || !strings.HasPrefix(anchor.TextMsg, "<a ") {
+		t.Errorf("the anchor was converted: %+v", anchor)
+	}
+	if !strings.HasSuffix(anchor.CreatedAt, "+00:00") {
+		t.Errorf("the timestamp was converted: %s", anchor.CreatedAt)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("the database file was modified")
+	}
+	if files := backups(t, path); len(files) > 0 {
+		t.Errorf("unexpected backups: %v", files)
+	}
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	path := copyFixture(t)
+	db := openTestDB(t, path, false)
+	defer func() { _ = db.Close() }()
+
+	if version, err := db.SchemaVersion(); err != nil || version != latestSchemaVersion() {
+		t.Fatalf("SchemaVersion = %d, %v", version, err)
+	}
+	files := backups(t, path)
+	if len(files) != 1 || !strings.Contains(files[0], ".v0-") {
+		t.Fatalf("backups = %v", files)
+	}
+	backup := openTestDB(t, files[0], true)
+	if version, err := backup.SchemaVersion(); err != nil || version != 0 {
+		t.Errorf("backup: SchemaVersion = %d, %v", version, err)
+	}
+	if m, err := backup.GetByID("1ka5"); err != nil || m.Link != nil {
+		t.Errorf("backup: the anchor was converted: %+v, %v", m, err)
+	}
+	_ = backup.Close()
+
+	// 时间全部转换为 ISO8601.
+	var messages []Message
+	if err := db.DB.All(&messages); err != nil {
+		t.Fatal(err)
+	}
+	var clips []ClipText
+	if err := db.DB.All(&clips); err != nil {
+		t.Fatal(err)
+	}
+	var times []string
+	for _, m := range messages {
+		times = append(times, m.CreatedAt, m.UpdatedAt, m.DeletedAt)
+	}
+	for _, c := range clips {
+		times = append(times, c.CreatedAt, c.UpdatedAt)
+	}
+	for _, s := range times {
+		if s == "" {
+			continue
+		}
+		if _, err := time.Parse(model.ISO8601, s); err != nil || !strings.HasSuffix(s, "Z") {
+			t.Errorf("timestamp %q is not ISO8601", s)
+		}
+	}
+
+	// 旧格式的书签
+	anchor, err := db.GetByID("1ka5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anchor.TextMsg != "https://example.com/docs" || anchor.Link == nil ||
+		anchor.Link.URL != anchor.TextMsg || anchor.Link.Title != "Example & Docs" {
+		t.Errorf("anchor = %+v, Link = %+v", anchor, anchor.Link)
+	}
+
+	// checksum 通过 ChecksumKey 查找，旧版本的明文索引已删除。
+	photo, err := db.GetByID("1ka2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := db.TouchByChecksum(photo.Checksum)
+	if err != nil || found == nil || found.ID != "1ka2" {
+		t.Errorf("TouchByChecksum = %v, %v", found, err)
+	}
+	err = db.DB.Bolt.View(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{"Message", "ClipText"} {
+			for _, index := range []string{"FileName", "Checksum"} {
+				if tx.Bucket([]byte(bucket)).Bucket([]byte("__storm_index_"+index)) != nil {
+					t.Errorf("%s still has the plaintext %s index", bucket, index)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 全文检索 (回收站里的条目除外)
+	searchTests := []struct {
+		query string
+		want  []string
+	}{
+		{"hello", []string{"message/1ka1"}},
+		{"docs", []string{"message/1ka5"}},
+		{"photo", []string{"message/1ka2"}},
+		{"clip", []string{"clip/1ka1"}},
+		{"trashed", nil},
+	}
+	for _, tt := range searchTests {
+		results, err := db.Search(SearchQuery{Query: tt.query})
+		if err != nil {
+			t.Errorf("Search(%q): %v", tt.query, err)
+			continue
+		}
+		var got []string
+		for _, r := range results {
+			if r.Message != nil {
+				got = append(got, "message/"+r.Message.ID)
+			} else {
+				got = append(got, "clip/"+r.Clip.ID)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Search(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	// 标签索引
+	tags, err := db.AllTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTags := []TagCount{{"red", 2, 0}, {"blue", 1, 0}, {"green", 0, 1}}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Tag < tags[j].Tag })
+	sort.Slice(wantTags, func(i, j int) bool { return wantTags[i].Tag < wantTags[j].Tag })
+	if len(tags) != len(wantTags) {
+		t.Fatalf("AllTags = %+v, want %+v", tags, wantTags)
+	}
+	for i := range tags {
+		if tags[i] != wantTags[i] {
+			t.Errorf("AllTags = %+v, want %+v", tags, wantTags)
+			break
+		}
+	}
+	tagTests := []struct {
+		tag  string
+		want []string
+	}{
+		{"red", []string{"1ka1", "1ka2"}},
+		{"blue", []string{"1ka1"}},
+		{"green", nil},
+		{"none", nil},
+	}
+	for _, tt := range tagTests {
+		list, _, err := db.ListMessages(ListQuery{Tag: tt.tag, Sort: SortByCreated, Asc: true})
+		if err != nil {
+			t.Errorf("ListMessages(%q): %v", tt.tag, err)
+			continue
+		}
+		var got []string
+		for _, m := range list {
+			got = append(got, m.ID)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("ListMessages(%q) = %v, want %v", tt.tag, got, tt.want)
+		}
+	}
+
+	// 再次打开时没有待执行的迁移，不再备份。
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestDB(t, path, false)
+	if files := backups(t, path); len(files) != 1 {
+		t.Errorf("backups after reopening = %v", files)
+	}
+}
+
+func TestMigrateEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gosend.db")
+	db := openTestDB(t, path, false)
+	defer func() { _ = db.Close() }()
+	if version, err := db.SchemaVersion(); err != nil || version != latestSchemaVersion() {
+		t.Errorf("SchemaVersion = %d, %v", version, err)
+	}
+	if files := backups(t, path); len(files) > 0 {
+		t.Errorf("an empty database should not be backed up: %v", files)
+	}
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/asdine/storm/v3/codec"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Recode 把数据库文件 srcPath 复制到新文件 dstPath, 复制时用 c 重新编码每一条记录，
+// 例如把明文数据库加密。c 必须能读取 srcPath 里的数据 (例如 encryption.Codec 可以读取明文)。
+//
+// storm 只对顶层 bucket 里的值使用 codec, 索引和 storm 自身的 metadata 都在子 bucket 里，
+// 原样复制。复制到新文件而不是原地修改，是因为 bolt 的空闲页可能还留有旧的明文。
+// 全文检索与标签的索引不复制，因为它们可能包含明文，下次启动时迁移会重建 (见 migrate)。
+func Recode(srcPath, dstPath string, c codec.MarshalUnmarshaler) error {
+	src, err := bolt.Open(srcPath, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := bolt.Open(dstPath, 0600, nil)
+	if err != nil {
+		return err
+	}
+	err = src.View(func(srcTx *bolt.Tx) error {
+		return dst.Update(func(dstTx *bolt.Tx) error {
+			return srcTx.ForEach(func(name []byte, srcBucket *bolt.Bucket) error {
+				if string(name) == searchBucket || string(name) == tagRefBucket {
+					return nil
+				}
+				dstBucket, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(dstBucket, srcBucket, c)
+			})
+		})
+	})
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(dstPath)
+	}
+	return err
+}
+
+// copyBucket 复制 src 到 dst. c 不为 nil 时重新编码 src 里的值，子 bucket 一律原样复制。
+func copyBucket(dst, src *bolt.Bucket, c codec.MarshalUnmarshaler) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			sub, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(sub, src.Bucket(k), nil)
+		}
+		if c != nil {
+			var raw json.RawMessage
+			if err := c.Unmarshal(v, &raw); err != nil {
+				return err
+			}
+			var err error
+			if v, err = c.Marshal(raw); err != nil {
+				return err
+			}
+		}
+		return dst.Put(k, v)
+	})
+}
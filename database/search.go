@@ -0,0 +1,547 @@
+package database
+
+// 全文检索。倒排索引保存在同一个 bolt 文件里 (searchBucket), 与 storm 的数据分开：
+//   postings  词 + 0x00 + 条目 → 该词在条目里出现的次数 (按字段加权)
+//   docs      条目 → 该条目的全部词与长度，用于更新或删除索引
+//   meta      索引的版本、条目数量与总长度 (用于 BM25 排序)
+// 条目的 key 是 "m" + Message.ID 或 "c" + ClipText.ID.
+// 回收站里的条目仍在索引里 (恢复时不需要重建)，只在搜索时排除。
+//
+// 索引放在子 bucket 里，因此不经过 storm 的 codec (见 Recode). 数据库加密时 (HashToken 不为 nil)
+// 索引里保存的是词的 hash 而不是明文，此时不支持前缀搜索。
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ahui2016/go-send/model"
+	"github.com/ahui2016/go-send/search"
+	"github.com/asdine/storm/v3"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	searchBucket     = "search-index"
+	postingsBucket   = "postings"
+	docsBucket       = "docs"
+	searchMetaBucket = "meta"
+
+	// searchVersion 在索引的格式或分词方式改变时加一，同时在 migrations 里添加重建索引的迁移
+	// (见 migrate.go)。
+	searchVersion = "2"
+
+	// hashedTokenSize 是词的 hash 的长度。
+	hashedTokenSize = 16
+
+	// BM25 的参数
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// 搜索的条目类型，见 SearchQuery.Type.
+const (
+	SearchText     = "text"
+	SearchFile     = "file"
+	SearchBookmark = "bookmark"
+	SearchClip     = "clip"
+)
+
+// ErrEmptyQuery 表示搜索语句里没有可以搜索的词。
+var ErrEmptyQuery = errors.New("the search query is empty")
+
+// SearchQuery 是搜索的参数。
+type SearchQuery struct {
+	Query string
+	Type  string // SearchText, SearchFile, SearchBookmark 或 SearchClip, 为空表示不限
+	From  string // model.TimeRange 返回的 ISO8601 区间 [From, To), 与 UpdatedAt 对比
+	To    string
+	Tag   string
+	Limit int
+}
+
+// SearchResult 是一个搜索结果，Message 与 Clip 只有一个不为 nil.
+type SearchResult struct {
+	Score   float64
+	Text    string // 用于生成摘要的文本 (文件名、书签标题或文本内容)
+	Message *Message
+	Clip    *ClipText
+}
+
+// searchDoc 是 docs bucket 里的值。
+type searchDoc struct {
+	Tokens [][]byte // 不重复的词 (索引里的形式)
+	Length int      // 加权后的词数
+}
+
+// searchField 是条目里需要索引的一段文本，weight 是其中每个词的权重。
+type searchField struct {
+	text   string
+	weight int
+}
+
+func messageDocKey(id string) string { return "m" + id }
+func clipDocKey(id string) string    { return "c" + id }
+
+// messageText 返回 message 里主要的文本，端到端加密的文本消息返回空字符串。
+func messageText(m *Message) string {
+	switch {
+	case m.Type == model.FileMsg:
+		return m.FileName
+	case m.Encrypted:
+		return ""
+	case m.FileType == model.GosendAnchor && m.Link != nil:
+		return m.Link.Title
+	}
+	return m.TextMsg
+}
+
+// messageFields 返回需要索引的文本。文件名与书签标题的权重较高；端到端加密的文本是密文，不索引。
+// 书签的网址保存在 TextMsg 里。
+func messageFields(m *Message) (fields []searchField) {
+	switch {
+	case m.Type == model.FileMsg:
+		fields = append(fields, searchField{m.FileName, 3})
+	case m.Encrypted:
+	case m.FileType == model.GosendAnchor && m.Link != nil:
+		fields = append(fields,
+			searchField{m.Link.Title, 3},
+			searchField{m.Link.SiteName, 2},
+			searchField{m.Link.Description, 1},
+			searchField{m.TextMsg, 1})
+	default:
+		fields = append(fields, searchField{m.TextMsg, 1})
+	}
+	for _, tag := range m.Tags {
+		fields = append(fields, searchField{tag, 2})
+	}
+	return
+}
+
+func clipFields(c *ClipText) []searchField {
+	fields := []searchField{{c.TextMsg, 1}}
+	for _, tag := range c.Tags {
+		fields = append(fields, searchField{tag, 2})
+	}
+	return fields
+}
+
+// searchIndexVersion 包括是否使用 hash, 因此加密旧数据 (-encrypt-store) 后
+// 迁移时会重建索引 (见 indexesOutdated)。
+func (db *DB) searchIndexVersion() string {
+	if db.HashToken != nil {
+		return searchVersion + "-hashed"
+	}
+	return searchVersion
+}
+
+// tokenKey 返回词在索引里的形式。
+func (db *DB) tokenKey(token string) []byte {
+	if db.HashToken != nil {
+		return db.HashToken(token)[:hashedTokenSize]
+	}
+	return []byte(token)
+}
+
+// searchIndexOutdated 判断索引是否不存在 (例如 Recode 之后) 或版本与当前设置不符。
+func (db *DB) searchIndexOutdated(tx *bolt.Tx) bool {
+	root := tx.Bucket([]byte(searchBucket))
+	if root == nil {
+		return true
+	}
+	return string(root.Bucket([]byte(searchMetaBucket)).Get([]byte("version"))) != db.searchIndexVersion()
+}
+
+// RebuildSearchIndex 删除并重建整个索引，返回已索引的条目数量。
+func (db *DB) RebuildSearchIndex() (n int, err error) {
+	err = db.update(func(tx *txn) error {
+		n, err = db.rebuildSearchIndex(tx)
+		return err
+	})
+	return n, err
+}
+
+func (db *DB) rebuildSearchIndex(tx *txn) (n int, err error) {
+	var messages []Message
+	var clips []ClipText
+	if err := tx.All(&messages); err != nil {
+		return 0, err
+	}
+	if err := tx.All(&clips); err != nil {
+		return 0, err
+	}
+
+	if tx.Bolt.Bucket([]byte(searchBucket)) != nil {
+		if err := tx.Bolt.DeleteBucket([]byte(searchBucket)); err != nil {
+			return 0, err
+		}
+	}
+	root, err := tx.Bolt.CreateBucket([]byte(searchBucket))
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range []string{postingsBucket, docsBucket, searchMetaBucket} {
+		if _, err := root.CreateBucket([]byte(name)); err != nil {
+			return 0, err
+		}
+	}
+	meta := root.Bucket([]byte(searchMetaBucket))
+	if err := meta.Put([]byte("version"), []byte(db.searchIndexVersion())); err != nil {
+		return 0, err
+	}
+	for i := range messages {
+		if err := db.indexDoc(root, messageDocKey(messages[i].ID), messageFields(&messages[i])); err != nil {
+			return 0, err
+		}
+	}
+	for i := range clips {
+		if err := db.indexDoc(root, clipDocKey(clips[i].ID), clipFields(&clips[i])); err != nil {
+			return 0, err
+		}
+	}
+	return len(messages) + len(clips), nil
+}
+
+// updateSearchIndex 在修改条目的同一个事务里修改索引。索引不存在时 (数据库尚未迁移，
+// 例如使用 SkipMigrations 打开的命令行功能) 什么都不做，迁移时会重建整个索引。
+func updateSearchIndex(tx *txn, fn func(root *bolt.Bucket) error) error {
+	root := tx.Bolt.Bucket([]byte(searchBucket))
+	if root == nil {
+		return nil
+	}
+	return fn(root)
+}
+
+// indexMessage 新增或更新 message 的索引 (包括标签索引，见 tags.go), 下同。
+func (db *DB) indexMessage(tx *txn, m *Message) error {
+	if err := db.indexTags(tx, messageDocKey(m.ID), m.Tags); err != nil {
+		return err
+	}
+	return updateSearchIndex(tx, func(root *bolt.Bucket) error {
+		return db.indexDoc(root, messageDocKey(m.ID), messageFields(m))
+	})
+}
+
+func (db *DB) indexClip(tx *txn, c *ClipText) error {
+	if err := db.indexTags(tx, clipDocKey(c.ID), c.Tags); err != nil {
+		return err
+	}
+	return updateSearchIndex(tx, func(root *bolt.Bucket) error {
+		return db.indexDoc(root, clipDocKey(c.ID), clipFields(c))
+	})
+}
+
+// unindex 删除条目的索引，docKeys 见 messageDocKey 与 clipDocKey.
+func (db *DB) unindex(tx *txn, docKeys ...string) error {
+	if err := db.unindexTags(tx, docKeys...); err != nil {
+		return err
+	}
+	return updateSearchIndex(tx, func(root *bolt.Bucket) error {
+		for _, docKey := range docKeys {
+			if err := unindexDoc(root, docKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// unindexAllClips 删除全部 ClipText 的索引。
+func (db *DB) unindexAllClips(tx *txn) error {
+	if err := db.unindexAllClipTags(tx); err != nil {
+		return err
+	}
+	return updateSearchIndex(tx, func(root *bolt.Bucket) error {
+		var keys []string
+		prefix := []byte(clipDocKey(""))
+		c := root.Bucket([]byte(docsBucket)).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		for _, docKey := range keys {
+			if err := unindexDoc(root, docKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *DB) indexDoc(root *bolt.Bucket, docKey string, fields []searchField) error {
+	if err := unindexDoc(root, docKey); err != nil {
+		return err
+	}
+	tf := make(map[string]int)
+	doc := searchDoc{}
+	for _, field := range fields {
+		for _, token := range search.Tokens(field.text) {
+			tf[string(db.tokenKey(token))] += field.weight
+			doc.Length += field.weight
+		}
+	}
+	if doc.Length == 0 {
+		return nil
+	}
+	postings := root.Bucket([]byte(postingsBucket))
+	for token, n := range tf {
+		value := make([]byte, binary.MaxVarintLen64)
+		value = value[:binary.PutUvarint(value, uint64(n))]
+		if err := postings.Put(postingKey([]byte(token), docKey), value); err != nil {
+			return err
+		}
+		doc.Tokens = append(doc.Tokens, []byte(token))
+	}
+	blob, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := root.Bucket([]byte(docsBucket)).Put([]byte(docKey), blob); err != nil {
+		return err
+	}
+	return addSearchStats(root, 1, doc.Length)
+}
+
+func unindexDoc(root *bolt.Bucket, docKey string) error {
+	docs := root.Bucket([]byte(docsBucket))
+	blob := docs.Get([]byte(docKey))
+	if blob == nil {
+		return nil
+	}
+	var doc searchDoc
+	if err := json.Unmarshal(blob, &doc); err != nil {
+		return err
+	}
+	postings := root.Bucket([]byte(postingsBucket))
+	for _, token := range doc.Tokens {
+		if err := postings.Delete(postingKey(token, docKey)); err != nil {
+			return err
+		}
+	}
+	if err := docs.Delete([]byte(docKey)); err != nil {
+		return err
+	}
+	return addSearchStats(root, -1, -doc.Length)
+}
+
+func postingKey(token []byte, docKey string) []byte {
+	key := make([]byte, 0, len(token)+1+len(docKey))
+	key = append(key, token...)
+	key = append(key, 0)
+	return append(key, docKey...)
+}
+
+// searchStats 返回已索引的条目数量与总长度。
+func searchStats(root *bolt.Bucket) (docs, length int) {
+	meta := root.Bucket([]byte(searchMetaBucket))
+	docs, _ = strconv.Atoi(string(meta.Get([]byte("docs"))))
+	length, _ = strconv.Atoi(string(meta.Get([]byte("length"))))
+	return
+}
+
+func addSearchStats(root *bolt.Bucket, docs, length int) error {
+	meta := root.Bucket([]byte(searchMetaBucket))
+	oldDocs, oldLength := searchStats(root)
+	if err := meta.Put([]byte("docs"), []byte(strconv.Itoa(oldDocs+docs))); err != nil {
+		return err
+	}
+	return meta.Put([]byte("length"), []byte(strconv.Itoa(oldLength+length)))
+}
+
+// postings 返回包含 token 的条目及其词频。prefix 为 true 时，包含以 token 开头的词的条目都算。
+func (db *DB) postings(root *bolt.Bucket, token string, prefix bool) map[string]int {
+	result := make(map[string]int)
+	key := db.tokenKey(token)
+	if !prefix {
+		key = append(key, 0)
+	}
+	c := root.Bucket([]byte(postingsBucket)).Cursor()
+	for k, v := c.Seek(key); k != nil && bytes.HasPrefix(k, key); k, v = c.Next() {
+		i := bytes.IndexByte(k[len(key)-1:], 0)
+		if i < 0 {
+			continue
+		}
+		n, _ := binary.Uvarint(v)
+		result[string(k[len(key)-1+i+1:])] += int(n)
+	}
+	return result
+}
+
+// docLength 返回条目的长度 (加权后的词数)。
+func docLength(root *bolt.Bucket, docKey string) int {
+	var doc searchDoc
+	_ = json.Unmarshal(root.Bucket([]byte(docsBucket)).Get([]byte(docKey)), &doc)
+	return doc.Length
+}
+
+// Search 搜索包含全部词的条目，按 BM25 排序。如果数据库没有加密，
+// 而且搜索语句不以空格结尾，最后一个词 (中日韩文字除外) 可以只是开头的一部分，例如 “prog” 可以找到 “program”.
+func (db *DB) Search(query SearchQuery) ([]SearchResult, error) {
+	tokens := search.QueryTokens(query.Query)
+	if len(tokens) == 0 {
+		return nil, ErrEmptyQuery
+	}
+	last := tokens[len(tokens)-1]
+	lastRune, _ := utf8.DecodeLastRuneInString(query.Query)
+	prefixLast := db.HashToken == nil && !unicode.IsSpace(lastRune) && !search.IsCJK([]rune(last)[0])
+
+	// 按标签筛选时先通过标签索引找出带有该标签的条目，以便尽早排除。
+	var tagged map[string]bool
+	if query.Tag != "" {
+		var err error
+		if tagged, err = db.taggedDocKeys(query.Tag); err != nil {
+			return nil, err
+		}
+	}
+
+	scores := make(map[string]float64)
+	err := db.DB.Bolt.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(searchBucket))
+		if root == nil {
+			return errors.New("the search index does not exist")
+		}
+		n, totalLength := searchStats(root)
+		if n == 0 {
+			return nil
+		}
+		avgLength := float64(totalLength) / float64(n)
+		lengths := make(map[string]float64)
+		for i, token := range tokens {
+			postings := db.postings(root, token, prefixLast && i == len(tokens)-1)
+			df := float64(len(postings))
+			idf := math.Log(1 + (float64(n)-df+0.5)/(df+0.5))
+			next := make(map[string]float64)
+			for docKey, tf := range postings {
+				if !query.matchKind(docKey) || (tagged != nil && !tagged[docKey]) {
+					continue
+				}
+				if _, ok := scores[docKey]; i > 0 && !ok {
+					continue
+				}
+				length, ok := lengths[docKey]
+				if !ok {
+					length = float64(docLength(root, docKey))
+					lengths[docKey] = length
+				}
+				f := float64(tf)
+				next[docKey] = scores[docKey] +
+					idf*f*(bm25K1+1)/(f+bm25K1*(1-bm25B+bm25B*length/avgLength))
+			}
+			if scores = next; len(scores) == 0 {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []SearchResult
+	for docKey, score := range scores {
+		result, err := db.searchResult(docKey, score)
+		if err == storm.ErrNotFound {
+			continue // 索引与数据不一致，见 RebuildSearchIndex
+		}
+		if err != nil {
+			return nil, err
+		}
+		if query.match(result) {
+			results = append(results, *result)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].updatedAt() > results[j].updatedAt()
+	})
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+	return results, nil
+}
+
+func (db *DB) searchResult(docKey string, score float64) (*SearchResult, error) {
+	result := &SearchResult{Score: math.Round(score*1000) / 1000}
+	id := docKey[1:]
+	if strings.HasPrefix(docKey, clipDocKey("")) {
+		var clip ClipText
+		if err := db.DB.One("ID", id, &clip); err != nil {
+			return nil, err
+		}
+		result.Clip = &clip
+		result.Text = clip.TextMsg
+		return result, nil
+	}
+	message, err := db.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	result.Message = message
+	result.Text = messageText(message)
+	return result, nil
+}
+
+func (result *SearchResult) updatedAt() string {
+	if result.Clip != nil {
+		return result.Clip.UpdatedAt
+	}
+	return result.Message.UpdatedAt
+}
+
+func (result *SearchResult) tags() []string {
+	if result.Clip != nil {
+		return result.Clip.Tags
+	}
+	return result.Message.Tags
+}
+
+// matchKind 根据条目的 key 判断是否符合 query.Type, 以便尽早排除。
+func (query *SearchQuery) matchKind(docKey string) bool {
+	isClip := strings.HasPrefix(docKey, clipDocKey(""))
+	switch query.Type {
+	case "":
+		return true
+	case SearchClip:
+		return isClip
+	}
+	return !isClip
+}
+
+// match 检查 query 的其余条件，并排除回收站里的条目。
+func (query *SearchQuery) match(result *SearchResult) bool {
+	if m := result.Message; m != nil {
+		if m.DeletedAt != "" {
+			return false
+		}
+		isAnchor := m.FileType == model.GosendAnchor
+		switch query.Type {
+		case SearchText:
+			if m.Type != model.TextMsg || isAnchor {
+				return false
+			}
+		case SearchFile:
+			if m.Type != model.FileMsg {
+				return false
+			}
+		case SearchBookmark:
+			if !isAnchor {
+				return false
+			}
+		}
+	}
+	if !model.InTimeRange(result.updatedAt(), query.From, query.To) {
+		return false
+	}
+	if query.Tag != "" && !model.HasTag(result.tags(), query.Tag) {
+		return false
+	}
+	return true
+}
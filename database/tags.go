@@ -0,0 +1,288 @@
+package database
+
+// 标签索引：每个条目的每个标签是一条 TagRef 记录，按标签筛选 (列表、搜索、打包下载) 与
+// AllTags 都通过这个索引，不需要读取全部条目。storm 不能索引 []string 里的每个元素，因此单独保存。
+// storm 的索引与 bolt 的 key 都是明文，因此与 ChecksumKey 一样只索引 TagKey (见 tagKey),
+// 标签本身只保存在记录里，经过 codec 加密。
+// 修改条目时 indexMessage 与 indexClip 同时更新标签索引，删除条目时 unindex 同时删除。
+// 索引由迁移建立 (见 rebuildTagIndex), 加密设置改变后与其它索引一起重建。
+
+import (
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"github.com/ahui2016/go-send/model"
+	"github.com/asdine/storm/v3"
+)
+
+// tagRefBucket 是 TagRef 的 bucket, storm 以类型名作为 bucket 名。
+const tagRefBucket = "TagRef"
+
+// TagRef 表示条目 DocKey (见 messageDocKey 与 clipDocKey) 带有标签 Tag.
+type TagRef struct {
+	ID     string // TagKey + "/" + DocKey
+	TagKey string `storm:"index"`
+	DocKey string `storm:"index"`
+	Tag    string
+}
+
+// TagCount 是一个标签的使用次数，不包括回收站里的条目。
+type TagCount struct {
+	Tag      string
+	Messages int
+	Clips    int
+}
+
+// tagKey 返回标签在索引里的形式：数据库加密时 (HashToken 不为 nil) 是标签的 HMAC,
+// 否则就是标签本身。加上前缀是为了与全文检索里同样的词区分开。
+func (db *DB) tagKey(tag string) string {
+	if db.HashToken == nil {
+		return tag
+	}
+	return hex.EncodeToString(db.HashToken("tag:" + tag))
+}
+
+// indexTags 把条目 docKey 的标签索引改为 tags.
+func (db *DB) indexTags(tx *txn, docKey string, tags []string) error {
+	if err := db.unindexTags(tx, docKey); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		key := db.tagKey(tag)
+		ref := &TagRef{ID: key + "/" + docKey, TagKey: key, DocKey: docKey, Tag: tag}
+		if err := tx.Save(ref); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexTags 删除条目的标签索引。
+func (db *DB) unindexTags(tx *txn, docKeys ...string) error {
+	for _, docKey := range docKeys {
+		var refs []TagRef
+		err := tx.Find("DocKey", docKey, &refs)
+		if err == storm.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for i := range refs {
+			if err := tx.DeleteStruct(&refs[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unindexAllClipTags 删除全部 ClipText 的标签索引。
+func (db *DB) unindexAllClipTags(tx *txn) error {
+	var refs []TagRef
+	err := tx.Prefix("DocKey", clipDocKey(""), &refs)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := range refs {
+		if err := tx.DeleteStruct(&refs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildTagIndex 删除并重建整个标签索引，返回带有标签的条目数量。
+func (db *DB) rebuildTagIndex(tx *txn) (n int, err error) {
+	var messages []Message
+	var clips []ClipText
+	if err := tx.All(&messages); err != nil {
+		return 0, err
+	}
+	if err := tx.All(&clips); err != nil {
+		return 0, err
+	}
+	// 旧版本的数据库 (例如试运行迁移时) 还没有 TagRef bucket.
+	if tx.Bolt.Bucket([]byte(tagRefBucket)) != nil {
+		if err := tx.Drop(new(TagRef)); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Init(new(TagRef)); err != nil {
+		return 0, err
+	}
+	for i := range messages {
+		if len(messages[i].Tags) == 0 {
+			continue
+		}
+		if err := db.indexTags(tx, messageDocKey(messages[i].ID), messages[i].Tags); err != nil {
+			return n, err
+		}
+		n++
+	}
+	for i := range clips {
+		if len(clips[i].Tags) == 0 {
+			continue
+		}
+		if err := db.indexTags(tx, clipDocKey(clips[i].ID), clips[i].Tags); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// taggedDocKeys 通过标签索引返回带有标签 tag 的全部条目 (包括回收站里的)。
+func (db *DB) taggedDocKeys(tag string) (map[string]bool, error) {
+	var refs []TagRef
+	err := db.DB.Find("TagKey", db.tagKey(tag), &refs)
+	if err != nil && err != storm.ErrNotFound {
+		return nil, err
+	}
+	docKeys := make(map[string]bool, len(refs))
+	for i := range refs {
+		docKeys[refs[i].DocKey] = true
+	}
+	return docKeys, nil
+}
+
+// taggedItems 通过标签索引返回带有标签 tag 的条目，不包括回收站里的条目。
+func (db *DB) taggedItems(tag string) (messages []Message, clips []ClipText, err error) {
+	docKeys, err := db.taggedDocKeys(tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	for docKey := range docKeys {
+		id := docKey[1:]
+		if strings.HasPrefix(docKey, clipDocKey("")) {
+			var clip ClipText
+			if err := db.DB.One("ID", id, &clip); err == nil {
+				clips = append(clips, clip)
+			} else if err != storm.ErrNotFound {
+				return nil, nil, err
+			}
+			continue
+		}
+		var m Message
+		if err := db.DB.One("ID", id, &m); err == nil {
+			if m.DeletedAt == "" {
+				messages = append(messages, m)
+			}
+		} else if err != storm.ErrNotFound {
+			return nil, nil, err
+		}
+	}
+	return messages, clips, nil
+}
+
+// mergeTags 把 tags 加到已存在的条目 m 上 (用于重复的内容), tags 为空时什么都不做。
+func (db *DB) mergeTags(tx *txn, m *Message, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	merged, err := model.AddTags(m.Tags, tags)
+	if err != nil {
+		return err
+	}
+	m.Tags = merged
+	if err := tx.UpdateField(m, "Tags", merged); err != nil {
+		return err
+	}
+	return db.indexMessage(tx, m)
+}
+
+// UpdateTags 用 update 修改条目的标签，返回修改后的条目。
+func (db *DB) UpdateTags(id string, update func([]string) ([]string, error)) (*Message, error) {
+	var message Message
+	err := db.update(func(tx *txn) error {
+		if err := tx.One("ID", id, &message); err != nil {
+			return err
+		}
+		tags, err := update(message.Tags)
+		if err != nil {
+			return err
+		}
+		message.Tags = tags
+		// 用 Save 而不是 UpdateField, 以免删除全部标签时出现零值的问题。
+		if err := tx.Save(&message); err != nil {
+			return err
+		}
+		return db.indexMessage(tx, &message)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// UpdateClipTags 与 UpdateTags 相同，用于 ClipText.
+func (db *DB) UpdateClipTags(id string, update func([]string) ([]string, error)) (*ClipText, error) {
+	var clip ClipText
+	err := db.update(func(tx *txn) error {
+		if err := tx.One("ID", id, &clip); err != nil {
+			return err
+		}
+		tags, err := update(clip.Tags)
+		if err != nil {
+			return err
+		}
+		clip.Tags = tags
+		if err := tx.Save(&clip); err != nil {
+			return err
+		}
+		return db.indexClip(tx, &clip)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &clip, nil
+}
+
+// AllTags 返回全部标签及其使用次数，使用次数多的排在前面。只读取标签索引与回收站里的条目。
+func (db *DB) AllTags() ([]TagCount, error) {
+	var refs []TagRef
+	if err := db.DB.All(&refs); err != nil {
+		return nil, err
+	}
+	// storm 不索引零值，因此 DeletedAt 的索引里只有回收站里的条目。
+	var trashed []Message
+	if err := db.DB.AllByIndex("DeletedAt", &trashed); err != nil {
+		return nil, err
+	}
+	inTrash := make(map[string]bool, len(trashed))
+	for i := range trashed {
+		inTrash[messageDocKey(trashed[i].ID)] = true
+	}
+	counts := make(map[string]*TagCount)
+	for i := range refs {
+		ref := &refs[i]
+		if inTrash[ref.DocKey] {
+			continue
+		}
+		if counts[ref.Tag] == nil {
+			counts[ref.Tag] = &TagCount{Tag: ref.Tag}
+		}
+		if strings.HasPrefix(ref.DocKey, clipDocKey("")) {
+			counts[ref.Tag].Clips++
+		} else {
+			counts[ref.Tag].Messages++
+		}
+	}
+
+	result := []TagCount{}
+	for _, c := range counts {
+		result = append(result, *c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Messages+a.Clips != b.Messages+b.Clips {
+			return a.Messages+a.Clips > b.Messages+b.Clips
+		}
+		return a.Tag < b.Tag
+	})
+	return result, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/go-send/model"
+	"github.com/ahui2016/go-send/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+// byteRange 表示 HTTP Range 里的一段，Length 为该段的长度。
+type byteRange struct {
+	Start  int64
+	Length int64
+}
+
+func downloadHandler(c *fiber.Ctx) error {
+	message, err := db.GetByID(c.Params("id"))
+	if err != nil || message.Type != model.FileMsg {
+		return jsonError(c, "file not found", 404)
+	}
+	disposition := "attachment"
+	if c.Query("inline") != "" {
+		disposition = "inline"
+	}
+	return sendMessageFile(c, message, disposition)
+}
+
+// filesHandler 代替原来的 app.Static("/files", filesDir), 因为文件未必保存在本地。
+// 前端用 /files/<id>.send 显示大图，用 /files/<id>.small 显示缩略图。
+func filesHandler(c *fiber.Ctx) error {
+	name := c.Params("name")
+	if strings.HasSuffix(name, thumbFileExt) {
+		return sendBlob(c, name, "image/jpeg", "")
+	}
+	if id := strings.TrimSuffix(name, gosendFileExt); id != name {
+		message, err := db.GetByID(id)
+		if err == nil {
+			return sendMessageFile(c, message, "inline")
+		}
+	}
+	return jsonError(c, "file not found", 404)
+}
+
+// sendMessageFile 发送 message 对应的文件，使用原文件名。压缩保存的文件会自动解压。
+func sendMessageFile(c *fiber.Ctx, message *Message, disposition string) error {
+	c.Set(fiber.HeaderContentDisposition, contentDisposition(disposition, message.FileName))
+	name := originName(message.ID)
+	info, err := store.Stat(name)
+	if err == storage.ErrNotFound {
+		return jsonError(c, "file not found", 404)
+	}
+	if err != nil {
+		return err
+	}
+
+	// 优先使用 checksum 作为 ETag, 旧数据没有 checksum 则使用体积与修改时间。
+	etag := ""
+	if message.Checksum != "" {
+		etag = `"` + message.Checksum + `"`
+	}
+	if message.Compression == "" {
+		return sendContent(c, info, message.FileType, etag, func(offset, length int64) (io.ReadCloser, error) {
+			return store.Get(name, offset, length)
+		})
+	}
+	info.Size = message.FileSize
+	return sendContent(c, info, message.FileType, etag, func(offset, length int64) (io.ReadCloser, error) {
+		return openFileRange(message, offset, length)
+	})
+}
+
+// sendBlob 从 store 读取 name 并直接发送。
+func sendBlob(c *fiber.Ctx, name, fileType, etag string) error {
+	info, err := store.Stat(name)
+	if err == storage.ErrNotFound {
+		return jsonError(c, "file not found", 404)
+	}
+	if err != nil {
+		return err
+	}
+	return sendContent(c, info, fileType, etag, func(offset, length int64) (io.ReadCloser, error) {
+		return store.Get(name, offset, length)
+	})
+}
+
+// sendContent 发送体积为 info.Size 的内容，支持 Range 与 If-Range,
+// 因此可以断点续传，视频也可以拖动进度条。
+// open 用来读取内容的一部分。etag 为空时，使用体积与修改时间生成 ETag.
+func sendContent(c *fiber.Ctx, info storage.Info, fileType, etag string,
+	open func(offset, length int64) (io.ReadCloser, error)) error {
+
+	size := info.Size
+	modTime := info.ModTime.UTC().Truncate(time.Second)
+	if etag == "" {
+		etag = fmt.Sprintf(`"%x-%x"`, size, info.ModTime.UnixNano())
+	}
+	if fileType == "" {
+		fileType = fiber.MIMEOctetStream
+	}
+	c.Set(fiber.HeaderContentType, fileType)
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, modTime.Format(http.TimeFormat))
+
+	rangeHeader := c.Get(fiber.HeaderRange)
+	if rangeHeader != "" && !ifRangeMatches(c.Get(fiber.HeaderIfRange), etag, modTime) {
+		rangeHeader = ""
+	}
+
+	// 多段 Range 很少用到，按协议可以忽略 Range 并发送整个文件。
+	ranges, err := parseRange(rangeHeader, size)
+	if err != nil {
+		c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+		return jsonError(c, err.Error(), fiber.StatusRequestedRangeNotSatisfiable)
+	}
+	r := byteRange{0, size}
+	if len(ranges) == 1 {
+		r = ranges[0]
+		c.Status(fiber.StatusPartialContent)
+		c.Set(fiber.HeaderContentRange,
+			fmt.Sprintf("bytes %d-%d/%d", r.Start, r.Start+r.Length-1, size))
+	} else {
+		c.Status(200)
+	}
+
+	// fasthttp 发送完毕后会自动关闭 body.
+	body, err := open(r.Start, r.Length)
+	if err != nil {
+		return err
+	}
+	c.Context().SetBodyStream(body, int(r.Length))
+	return nil
+}
+
+// ifRangeMatches 如果没有 If-Range, 或 If-Range 与当前文件一致，则返回 true,
+// 否则说明文件已经变化，应忽略 Range 发送整个文件。
+func ifRangeMatches(ifRange, etag string, modTime time.Time) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == etag // If-Range 只能使用强比较
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && modTime.Equal(t)
+}
+
+// parseRange 解析 Range header (RFC 7233), header 为空时返回 nil.
+// 只有全部都无法满足时才返回错误。
+func parseRange(header string, size int64) ([]byteRange, error) {
+	if header == "" {
+		return nil, nil
+	}
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, nil // 不认识的单位，忽略 Range
+	}
+	var ranges []byteRange
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, nil // 格式错误，忽略 Range
+		}
+		startStr, endStr := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		var r byteRange
+		if startStr == "" {
+			// bytes=-N 表示最后 N 个字节
+			n, err := strconv.ParseInt(endStr, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n > size {
+				n = size
+			}
+			if n == 0 {
+				continue // 空文件没有最后 N 个字节
+			}
+			r.Start = size - n
+			r.Length = n
+		} else {
+			start, err := strconv.ParseInt(startStr, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			if start >= size {
+				continue
+			}
+			end := size - 1
+			if endStr != "" {
+				end, err = strconv.ParseInt(endStr, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			r.Start = start
+			r.Length = end - start + 1
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("range not satisfiable: %s", header)
+	}
+	return ranges, nil
+}
+
+// contentDisposition 按 RFC 6266 与 RFC 5987 生成 Content-Disposition,
+// filename 是给旧浏览器用的 ASCII 文件名，filename* 是 UTF-8 原文件名。
+func contentDisposition(disposition, filename string) string {
+	var ascii strings.Builder
+	for _, r := range filename {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			ascii.WriteByte('_')
+		} else {
+			ascii.WriteRune(r)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`,
+		disposition, ascii.String(), rfc5987Escape(filename))
+}
+
+// rfc5987Escape 只保留 RFC 5987 的 attr-char, 其余字节一律 %XX.
+func rfc5987Escape(s string) string {
+	const attrChars = "!#$&+-.^_`|~"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') ||
+			('0' <= ch && ch <= '9') || strings.IndexByte(attrChars, ch) >= 0 {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
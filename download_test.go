@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	const size = 1000
+	tests := []struct {
+		header string
+		want   []byteRange
+		err    bool
+	}{
+		{"", nil, false},
+		{"bytes=0-99", []byteRange{{0, 100}}, false},
+		{"bytes=0-0", []byteRange{{0, 1}}, false},
+		{"bytes=900-", []byteRange{{900, 100}}, false},
+		{"bytes=999-", []byteRange{{999, 1}}, false},
+
+		// 后缀
+		{"bytes=-100", []byteRange{{900, 100}}, false},
+		{"bytes=-1", []byteRange{{999, 1}}, false},
+		{"bytes=-1000", []byteRange{{0, 1000}}, false},
+		{"bytes=-5000", []byteRange{{0, 1000}}, false},
+		{"bytes=-0", nil, true},
+
+		// 超出文件末尾
+		{"bytes=900-5000", []byteRange{{900, 100}}, false},
+		{"bytes=1000-", nil, true},
+		{"bytes=1000-2000", nil, true},
+		{"bytes=5000-6000", nil, true},
+
+		// 多个区间，无法满足的区间被忽略
+		{"bytes=0-9,20-29", []byteRange{{0, 10}, {20, 10}}, false},
+		{"bytes=0-9, -10", []byteRange{{0, 10}, {990, 10}}, false},
+		{"bytes= 0-9 , 1000-1100 ,", []byteRange{{0, 10}}, false},
+		{"bytes=1000-,2000-2999", nil, true},
+		{"bytes=0-9,-0", []byteRange{{0, 10}}, false},
+
+		// 格式错误或不认识的单位，忽略 Range
+		{"items=0-9", nil, false},
+		{"bytes=abc", nil, false},
+		{"bytes=9-0", nil, false},
+		{"bytes=-x", nil, false},
+		{"bytes=x-9", nil, false},
+		{"bytes=0-9,bad", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, size)
+		if (err != nil) != tt.err {
+			t.Errorf("parseRange(%q) error = %v, want error %v", tt.header, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRange(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	// 空文件的任何区间都无法满足。
+	for _, header := range []string{"bytes=0-", "bytes=-1", "bytes=0-0"} {
+		if _, err := parseRange(header, 0); err == nil {
+			t.Errorf("parseRange(%q, 0) should fail", header)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+// 静态加密 (encryption at rest)。启用后，文件、缩略图和数据库里的记录都会加密保存，
+// 读取时自动解密。未加密的旧数据仍然可以读取，用 -encrypt-store 可以一次性加密全部旧数据。
+// 数据库的索引不经过加密：checksum 与搜索关键词只保存 HMAC, 日期等字段仍是明文。
+// 注意：未完成的断点续传 (uploadsDir) 和处理中的临时文件不加密，webdav 文件夹也不加密。
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ahui2016/go-send/database"
+	"github.com/ahui2016/go-send/encryption"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// passphraseEnv 是提供密码的环境变量。
+const passphraseEnv = "GOSEND_PASSPHRASE"
+
+// setEncryption 如果启用了加密，就加载密钥，并让 store 和 db 透明地加解密。
+// 应在 db.Open 之前调用。
+func setEncryption() error {
+	if !config.Encrypt {
+		return nil
+	}
+	passphrase := ""
+	if config.KeyFile == "" {
+		var err error
+		if passphrase, err = readPassphrase(); err != nil {
+			return err
+		}
+	}
+	key, err := encryption.LoadKey(keyringPath, config.KeyFile, passphrase)
+	if err != nil {
+		return err
+	}
+	store = encryption.NewStorage(store, key)
+	db.Codec = encryption.NewCodec(key)
+	db.HashToken = func(token string) []byte { return key.MAC([]byte(token)) }
+	return nil
+}
+
+// readPassphrase 优先使用环境变量，否则在启动时输入密码。
+func readPassphrase() (string, error) {
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	fmt.Fprint(os.Stderr, "Encryption passphrase: ")
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		passphrase, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(passphrase), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if line = strings.TrimRight(line, "\r\n"); line == "" {
+		return "", errors.New("encryption is enabled, but no passphrase is given (set " +
+			passphraseEnv + " or KeyFile)")
+	}
+	return line, nil
+}
+
+// encryptStore 加密全部未加密的文件、缩略图以及整个数据库，可以重复执行。
+// 应在停止服务后执行，执行完毕后 db 已关闭。
+func encryptStore() error {
+	encStore, ok := store.(*encryption.Storage)
+	if !ok {
+		return errors.New(`set "Encrypt": true in the config first`)
+	}
+
+	files, err := encStore.Inner().List()
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name, gosendFileExt) && !strings.HasSuffix(file.Name, thumbFileExt) {
+			continue
+		}
+		encrypted, err := encryptBlob(encStore, file.Name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.Name, err)
+		}
+		if encrypted {
+			count++
+		}
+	}
+	log.Printf("encrypted %d files", count)
+
+	if err := db.Close(); err != nil {
+		return err
+	}
+	tempPath := dbPath + tempFileExt
+	if err := database.Recode(dbPath, tempPath, db.Codec); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, dbPath); err != nil {
+		return err
+	}
+	log.Print("encrypted the database ", dbPath)
+	return nil
+}
+
+// encryptBlob 如果 name 未加密，就先复制到临时文件，再加密写回。
+func encryptBlob(encStore *encryption.Storage, name string) (encrypted bool, err error) {
+	inner := encStore.Inner()
+	r, err := inner.Get(name, 0, encryption.HeaderSize)
+	if err != nil {
+		return false, err
+	}
+	header, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil || encryption.IsEncrypted(header) {
+		return false, err
+	}
+
+	r, err = inner.Get(name, 0, -1)
+	if err != nil {
+		return false, err
+	}
+	temp, err := saveTempFile(name, r)
+	_ = r.Close()
+	if err != nil {
+		return false, err
+	}
+	defer temp.remove()
+	file, err := os.Open(temp.TempPath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	return true, encStore.Put(name, file, temp.Size)
+}
@@ -0,0 +1,50 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// recordMagic 加在加密的记录前面。JSON 不可能以 0 字节开头，因此可以区分新旧数据。
+var recordMagic = []byte("\x00GSE1")
+
+// Codec 是 storm 的 codec, 用 JSON 编码后再加密整条记录。
+// 读取时如果不是加密的记录，就当作普通的 JSON, 因此可以直接打开未加密的旧数据库。
+// 注意 storm 的索引不经过 codec, 仍然是明文，因此只索引日期、状态等不敏感的字段，
+// Checksum 则以 HMAC 的形式索引 (见 model.Message.ChecksumKey)。
+// 另外被索引的字段只能是 string 或整数，其它类型的索引值会经过 codec,
+// 而加密使用随机 nonce, 同一个值每次的结果都不同，就无法查询了。
+type Codec struct {
+	key *Key
+}
+
+// NewCodec .
+func NewCodec(key *Key) *Codec {
+	return &Codec{key}
+}
+
+// Marshal .
+func (c *Codec) Marshal(v interface{}) ([]byte, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, recordMagic...), c.key.Seal(plain)...), nil
+}
+
+// Unmarshal .
+func (c *Codec) Unmarshal(b []byte, v interface{}) error {
+	if !bytes.HasPrefix(b, recordMagic) {
+		return json.Unmarshal(b, v)
+	}
+	plain, err := c.key.Open(b[len(recordMagic):])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// Name 与 storm 默认的 JSON codec 同名，否则 storm 会拒绝打开旧数据库 (ErrDifferentCodec).
+func (c *Codec) Name() string {
+	return "json"
+}
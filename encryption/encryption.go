@@ -0,0 +1,210 @@
+// Package encryption 实现静态加密 (encryption at rest), 使用 AES-256-GCM.
+// 文件与缩略图以分块的流格式加密 (见 stream.go), 数据库记录由 Codec 加密。
+// 密钥由密码经 scrypt 派生，或直接来自密钥文件。
+package encryption // import "github.com/ahui2016/go-send/encryption"
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeySize 是密钥的长度 (AES-256)。
+const KeySize = 32
+
+// checkText 用来检查密码是否正确。
+const checkText = "go-send encryption check"
+
+var (
+	// ErrWrongKey 表示密码或密钥文件与数据不符。
+	ErrWrongKey = errors.New("encryption: wrong passphrase or key")
+
+	// ErrCorrupted 表示密文已损坏或被篡改。
+	ErrCorrupted = errors.New("encryption: data corrupted")
+)
+
+// Key 是已验证的密钥。
+type Key struct {
+	aead cipher.AEAD
+	mac  []byte // 由密钥派生的 HMAC 子密钥，见 MAC
+}
+
+// keyring 保存在数据目录里，不含密钥本身，只有 salt 和用于验证密钥的密文。
+type keyring struct {
+	Salt  []byte
+	Check []byte
+}
+
+// NewKey 用 raw (32 字节) 创建密钥。
+func NewKey(raw []byte) (*Key, error) {
+	if len(raw) != KeySize {
+		return nil, errors.New("encryption: key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{aead: aead, mac: hmacSHA256(raw, []byte("go-send mac"))}, nil
+}
+
+// MAC 返回 data 的 HMAC-SHA256. 结果是确定的，因此可以代替明文用作索引 (例如全文检索的词),
+// 使用由密钥派生的子密钥，不会泄露加密用的密钥。
+func (key *Key) MAC(data []byte) []byte {
+	return hmacSHA256(key.mac, data)
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// ReadKeyFile 读取密钥文件，内容是 64 个十六进制字符 (首尾空白会被忽略)。
+func ReadKeyFile(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(raw) != KeySize {
+		return nil, errors.New("encryption: key file must contain 64 hex characters")
+	}
+	return raw, nil
+}
+
+// GenerateKeyFile 生成新的随机密钥并写入 path, 如果 path 已存在则返回错误。
+func GenerateKeyFile(path string) error {
+	raw := make([]byte, KeySize)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(hex.EncodeToString(raw) + "\n")
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// LoadKey 从 passphrase 或 keyFile 得到密钥 (keyFile 优先), 并用 keyringPath 验证。
+// keyringPath 不存在时会新建，因此第一次启动时使用的密码就是以后的密码。
+func LoadKey(keyringPath, keyFile, passphrase string) (*Key, error) {
+	ring, err := readKeyring(keyringPath)
+	if os.IsNotExist(err) {
+		ring = new(keyring)
+		ring.Salt = make([]byte, 16)
+		if _, err := rand.Read(ring.Salt); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	if keyFile != "" {
+		raw, err = ReadKeyFile(keyFile)
+	} else if passphrase != "" {
+		raw, err = scrypt.Key([]byte(passphrase), ring.Salt, 1<<15, 8, 1, KeySize)
+	} else {
+		err = errors.New("encryption: no passphrase or key file")
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := NewKey(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if ring.Check == nil {
+		ring.Check = key.Seal([]byte(checkText))
+		return key, writeKeyring(keyringPath, ring)
+	}
+	plain, err := key.Open(ring.Check)
+	if err != nil || string(plain) != checkText {
+		return nil, ErrWrongKey
+	}
+	return key, nil
+}
+
+// CheckKeyring 检查 key 是否就是 keyringPath 所对应的密钥，例如用来判断备份是否使用同一个密钥。
+// 注意即使密码相同，不同的 keyring 的 salt 也不同，得到的密钥也不同。
+func (key *Key) CheckKeyring(keyringPath string) error {
+	ring, err := readKeyring(keyringPath)
+	if err != nil {
+		return err
+	}
+	plain, err := key.Open(ring.Check)
+	if err != nil || string(plain) != checkText {
+		return ErrWrongKey
+	}
+	return nil
+}
+
+func readKeyring(path string) (*keyring, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ring := new(keyring)
+	if err := json.Unmarshal(blob, ring); err != nil {
+		return nil, err
+	}
+	if len(ring.Salt) == 0 {
+		return nil, errors.New("encryption: invalid keyring " + path)
+	}
+	return ring, nil
+}
+
+func writeKeyring(path string, ring *keyring) error {
+	blob, err := json.MarshalIndent(ring, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, blob, 0600)
+}
+
+// Seal 加密一小段数据，结果为 nonce + 密文。
+func (key *Key) Seal(plaintext []byte) []byte {
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return key.aead.Seal(nonce, nonce, plaintext, nil)
+}
+
+// Open 解密 Seal 的结果。
+func (key *Key) Open(sealed []byte) ([]byte, error) {
+	n := key.aead.NonceSize()
+	if len(sealed) < n+key.aead.Overhead() {
+		return nil, ErrCorrupted
+	}
+	plain, err := key.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	return plain, nil
+}
+
+// IsEncrypted 判断 header (文件的开头) 是否为加密的流格式。
+func IsEncrypted(header []byte) bool {
+	return len(header) >= len(streamMagic) && bytes.Equal(header[:len(streamMagic)], streamMagic)
+}
@@ -0,0 +1,246 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ahui2016/go-send/storage"
+)
+
+func newTestKey(t *testing.T) *Key {
+	t.Helper()
+	raw := make([]byte, KeySize)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// seal 用流格式加密 plain.
+func seal(t *testing.T, key *Key, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := key.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// open 解密整个流。
+func open(key *Key, sealed []byte) ([]byte, error) {
+	r, err := key.NewReader(bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// chunk 返回 sealed 里第 i 个密文块。
+func chunk(sealed []byte, i int) []byte {
+	start := int(HeaderSize) + i*sealedChunk
+	end := start + sealedChunk
+	if end > len(sealed) {
+		end = len(sealed)
+	}
+	return sealed[start:end]
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := newTestKey(t)
+	for _, size := range []int{0, 1, 100, chunkSize - 1, chunkSize, chunkSize + 1, 2 * chunkSize, 3*chunkSize + 5} {
+		plain := randomBytes(t, size)
+		sealed := seal(t, key, plain)
+		if got := int64(len(sealed)); got != SealedSize(int64(size)) {
+			t.Errorf("size %d: sealed %d bytes, SealedSize = %d", size, got, SealedSize(int64(size)))
+		}
+		if got := PlainSize(int64(len(sealed))); got != int64(size) {
+			t.Errorf("size %d: PlainSize = %d", size, got)
+		}
+		got, err := open(key, sealed)
+		if err != nil {
+			t.Errorf("size %d: %v", size, err)
+			continue
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("size %d: the decrypted data does not match", size)
+		}
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	key := newTestKey(t)
+	plain := randomBytes(t, 2*chunkSize+100) // 三块，最后一块较短
+	sealed := seal(t, key, plain)
+	exact := seal(t, key, randomBytes(t, 2*chunkSize)) // 两个整块
+
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	header := sealed[:HeaderSize]
+	flipped := append([]byte{}, sealed...)
+	flipped[HeaderSize+10] ^= 1
+
+	tests := []struct {
+		name   string
+		key    *Key
+		sealed []byte
+	}{
+		{"empty", key, nil},
+		{"header only", key, header},
+		{"short header", key, sealed[:HeaderSize-1]},
+		{"drop the last chunk", key, sealed[:HeaderSize+2*sealedChunk]},
+		{"drop the last full chunk", key, exact[:HeaderSize+sealedChunk]},
+		{"truncate the last chunk", key, sealed[:len(sealed)-1]},
+		{"truncate a middle chunk", key, sealed[:HeaderSize+sealedChunk+100]},
+		{"swap chunks", key, join(header, chunk(sealed, 1), chunk(sealed, 0), chunk(sealed, 2))},
+		{"repeat a chunk", key, join(header, chunk(sealed, 0), chunk(sealed, 0), chunk(sealed, 1), chunk(sealed, 2))},
+		{"append data", key, join(sealed, chunk(sealed, 2))},
+		{"chunk from another stream", key, join(header, chunk(exact, 0), chunk(sealed, 1), chunk(sealed, 2))},
+		{"flip a bit", key, flipped},
+		{"wrong key", newTestKey(t), sealed},
+	}
+	for _, tt := range tests {
+		if _, err := open(tt.key, tt.sealed); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: err = %v, want ErrCorrupted", tt.name, err)
+		}
+	}
+}
+
+func TestStorageGet(t *testing.T) {
+	key := newTestKey(t)
+	s := NewStorage(storage.NewLocal(t.TempDir()), key)
+	plain := randomBytes(t, 3*chunkSize+5)
+	if err := s.Put("a", bytes.NewReader(plain), int64(len(plain))); err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.Stat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(plain)) {
+		t.Errorf("Stat: Size = %d, want %d", info.Size, len(plain))
+	}
+
+	n := int64(len(plain))
+	tests := []struct {
+		offset, length int64
+	}{
+		{0, -1},
+		{0, 10},
+		{1, 10},
+		{chunkSize - 1, 2},
+		{chunkSize, 10},
+		{chunkSize + 1, chunkSize},
+		{2*chunkSize + 7, -1},
+		{n - 5, -1},
+		{n - 5, 5},
+		{n, -1},
+		{10, 0},
+	}
+	for _, tt := range tests {
+		r, err := s.Get("a", tt.offset, tt.length)
+		if err != nil {
+			t.Errorf("Get(%d, %d): %v", tt.offset, tt.length, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			t.Errorf("Get(%d, %d): %v", tt.offset, tt.length, err)
+			continue
+		}
+		end := n
+		if tt.length >= 0 {
+			end = tt.offset + tt.length
+		}
+		if !bytes.Equal(got, plain[tt.offset:end]) {
+			t.Errorf("Get(%d, %d): got %d bytes, want %d", tt.offset, tt.length, len(got), end-tt.offset)
+		}
+	}
+}
+
+func TestCodec(t *testing.T) {
+	type record struct {
+		ID   string
+		Text string
+	}
+	c := NewCodec(newTestKey(t))
+	want := record{"1", "你好"}
+	blob, err := c.Marshal(&want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(blob, []byte(want.Text)) {
+		t.Error("the encrypted record contains the plaintext")
+	}
+	tests := []struct {
+		name string
+		blob []byte
+		ok   bool
+	}{
+		{"encrypted", blob, true},
+		{"plain JSON", []byte(`{"ID":"1","Text":"你好"}`), true},
+		{"truncated", blob[:len(blob)-1], false},
+		{"wrong key", mustMarshal(t, NewCodec(newTestKey(t)), &want), false},
+	}
+	for _, tt := range tests {
+		var got record
+		err := c.Unmarshal(tt.blob, &got)
+		if tt.ok && (err != nil || got != want) {
+			t.Errorf("%s: got %+v, err = %v", tt.name, got, err)
+		}
+		if !tt.ok && !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%s: err = %v, want ErrCorrupted", tt.name, err)
+		}
+	}
+}
+
+func mustMarshal(t *testing.T, c *Codec, v interface{}) []byte {
+	t.Helper()
+	blob, err := c.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blob
+}
+
+// 确保 io.Reader 在读完之后继续返回 io.EOF.
+func TestReaderEOF(t *testing.T) {
+	key := newTestKey(t)
+	r, err := key.NewReader(bytes.NewReader(seal(t, key, []byte("hello"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+			t.Errorf("Read after EOF = %d, %v", n, err)
+		}
+	}
+}
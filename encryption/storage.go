@@ -0,0 +1,121 @@
+package encryption
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ahui2016/go-send/storage"
+)
+
+// Storage 包装另一个 storage.Storage, 写入时加密，读取时解密，
+// 因此上层 (下载、缩略图、打包等) 不需要知道文件是否加密。
+// 读取时会检查 header, 未加密的旧文件按原样读取，方便逐步迁移。
+type Storage struct {
+	storage.Storage
+	key *Key
+}
+
+// NewStorage .
+func NewStorage(s storage.Storage, key *Key) *Storage {
+	return &Storage{s, key}
+}
+
+// Inner 返回被包装的 storage.Storage, 用于读取原始的 (加密后的) 内容。
+func (s *Storage) Inner() storage.Storage {
+	return s.Storage
+}
+
+// Key 返回加解密所用的密钥。
+func (s *Storage) Key() *Key {
+	return s.key
+}
+
+// Put 一边加密一边写入，不需要临时文件。
+func (s *Storage) Put(name string, r io.Reader, size int64) error {
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := s.key.NewWriter(pw)
+		if err == nil {
+			_, err = io.CopyN(w, r, size)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	err := s.Storage.Put(name, pr, SealedSize(size))
+	_ = pr.CloseWithError(err)
+	return err
+}
+
+// header 读取 name 的 header, 如果未加密则返回 nil prefix.
+func (s *Storage) header(name string) (prefix []byte, err error) {
+	r, err := s.Storage.Get(name, 0, HeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	header, err := ioutil.ReadAll(r)
+	if err != nil || !IsEncrypted(header) {
+		return nil, err
+	}
+	return header[len(streamMagic):], nil
+}
+
+// Get 直接从 offset 所在的块开始读取并解密，不必解密前面的内容。
+func (s *Storage) Get(name string, offset, length int64) (io.ReadCloser, error) {
+	prefix, err := s.header(name)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == nil {
+		return s.Storage.Get(name, offset, length)
+	}
+	if length == 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	counter := offset / chunkSize
+	src, err := s.Storage.Get(name, HeaderSize+counter*sealedChunk, -1)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = s.key.newChunkReader(src, prefix, counter)
+	if skip := offset % chunkSize; skip > 0 {
+		if _, err := io.CopyN(ioutil.Discard, r, skip); err != nil {
+			_ = src.Close()
+			return nil, err
+		}
+	}
+	if length > 0 {
+		r = io.LimitReader(r, length)
+	}
+	return readCloser{r, src}, nil
+}
+
+// Stat 返回的 Size 是明文的体积。
+func (s *Storage) Stat(name string) (storage.Info, error) {
+	info, err := s.Storage.Stat(name)
+	if err != nil {
+		return info, err
+	}
+	prefix, err := s.header(name)
+	if err != nil {
+		return info, err
+	}
+	if prefix != nil {
+		info.Size = PlainSize(info.Size)
+	}
+	return info, nil
+}
+
+// List 为了避免逐个读取 header, 返回的 Size 是加密后的体积。
+func (s *Storage) List() ([]storage.Info, error) {
+	return s.Storage.List()
+}
+
+// readCloser 关闭时关闭底层的 src.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
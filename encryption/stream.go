@@ -0,0 +1,216 @@
+package encryption
+
+// 流格式：header (magic + 7 字节的随机 nonce 前缀) 之后是连续的密文块，
+// 每块明文 64 KiB (最后一块可以较短，也可以为空), 加密后多 16 字节。
+// 第 i 块的 nonce = 前缀 + 大端 uint32(i) + 是否最后一块 (0 或 1),
+// 因此块不能被调换、删减或截断，而且可以直接跳到某一块开始解密。
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	chunkSize   = 64 * 1024
+	prefixSize  = 7
+	tagSize     = 16
+	sealedChunk = chunkSize + tagSize
+)
+
+var streamMagic = []byte("GSENC\x01")
+
+// HeaderSize 是流格式的 header 长度。
+var HeaderSize = int64(len(streamMagic) + prefixSize)
+
+// SealedSize 返回 n 字节的明文加密后的长度。
+func SealedSize(n int64) int64 {
+	chunks := (n + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return HeaderSize + n + chunks*tagSize
+}
+
+// PlainSize 是 SealedSize 的逆运算。
+func PlainSize(sealed int64) int64 {
+	body := sealed - HeaderSize
+	if body < tagSize {
+		return 0
+	}
+	full, rem := body/sealedChunk, body%sealedChunk
+	if rem == 0 {
+		return full * chunkSize
+	}
+	return full*chunkSize + rem - tagSize
+}
+
+func chunkNonce(prefix []byte, counter int64, last bool) []byte {
+	nonce := make([]byte, prefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], uint32(counter))
+	if last {
+		nonce[prefixSize+4] = 1
+	}
+	return nonce
+}
+
+// writer 加密写入的内容，必须调用 Close 才会写入最后一块。
+type writer struct {
+	key     *Key
+	dst     io.Writer
+	prefix  []byte
+	buf     []byte
+	counter int64
+	err     error
+}
+
+// NewWriter 返回一个 io.WriteCloser, 写入的内容会被加密后写入 dst.
+// Close 不会关闭 dst.
+func (key *Key) NewWriter(dst io.Writer) (io.WriteCloser, error) {
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(append(append([]byte{}, streamMagic...), prefix...)); err != nil {
+		return nil, err
+	}
+	return &writer{
+		key:    key,
+		dst:    dst,
+		prefix: prefix,
+		buf:    make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (w *writer) Write(p []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	for len(p) > 0 {
+		// 缓冲区满了并且还有数据，说明这一块不是最后一块。
+		if len(w.buf) == chunkSize {
+			if w.err = w.flush(false); w.err != nil {
+				return n, w.err
+			}
+		}
+		m := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+func (w *writer) flush(last bool) error {
+	if w.counter > math.MaxUint32 {
+		return errors.New("encryption: file too large")
+	}
+	nonce := chunkNonce(w.prefix, w.counter, last)
+	sealed := w.key.aead.Seal(nil, nonce, w.buf, nil)
+	w.buf = w.buf[:0]
+	w.counter++
+	_, err := w.dst.Write(sealed)
+	return err
+}
+
+func (w *writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.flush(true)
+	if w.err == nil {
+		w.err = errors.New("encryption: writer closed")
+		return nil
+	}
+	return w.err
+}
+
+// reader 解密从第 counter 块开始的密文。
+type reader struct {
+	key     *Key
+	src     *bufio.Reader
+	prefix  []byte
+	counter int64
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+// ReadHeader 读取并检查流格式的 header, 返回 nonce 前缀。
+func ReadHeader(r io.Reader) (prefix []byte, err error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrCorrupted
+		}
+		return nil, err
+	}
+	if !IsEncrypted(header) {
+		return nil, ErrCorrupted
+	}
+	return header[len(streamMagic):], nil
+}
+
+// NewReader 解密整个流 (包括 header)。
+func (key *Key) NewReader(src io.Reader) (io.Reader, error) {
+	prefix, err := ReadHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	return key.newChunkReader(src, prefix, 0), nil
+}
+
+// newChunkReader 解密从第 counter 块开始的密文，src 应该正好位于该块的开头。
+func (key *Key) newChunkReader(src io.Reader, prefix []byte, counter int64) *reader {
+	return &reader{
+		key:     key,
+		src:     bufio.NewReaderSize(src, sealedChunk),
+		prefix:  prefix,
+		counter: counter,
+		sealed:  make([]byte, sealedChunk),
+	}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// next 读取并解密下一块。不足一整块，或者后面已经没有数据，就是最后一块。
+func (r *reader) next() error {
+	n, err := io.ReadFull(r.src, r.sealed)
+	last := false
+	switch err {
+	case nil:
+		if _, err := r.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF, io.EOF:
+		last = true
+	default:
+		return err
+	}
+	plain, err := r.key.aead.Open(r.sealed[:0], chunkNonce(r.prefix, r.counter, last), r.sealed[:n], nil)
+	if err != nil {
+		return ErrCorrupted
+	}
+	r.plain = plain
+	r.counter++
+	r.done = last
+	return nil
+}
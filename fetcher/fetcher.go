@@ -0,0 +1,256 @@
+// Package fetcher 安全地获取网页或图片 (用于书签的网页信息):
+// 限制连接与读取的时间、读取的体积和重定向的次数，并且拒绝访问本机与内网地址
+// (防止 SSRF), 白名单里的地址除外。
+//
+// 地址在连接时检查 (即 DNS 解析之后), 因此域名解析到内网地址，
+// 或者重定向到内网地址时也会被拒绝。
+package fetcher // import "github.com/ahui2016/go-send/fetcher"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/html/charset"
+)
+
+// 默认值，见 Options.
+const (
+	DefaultConnectTimeout = 5 * time.Second
+	DefaultTimeout        = 15 * time.Second
+	DefaultMaxBytes       = 5 * 1024 * 1024
+	DefaultMaxRedirects   = 5
+)
+
+var (
+	// ErrBlocked 表示目标是本机或内网地址，并且不在白名单里。
+	ErrBlocked = errors.New("fetcher: the address is not allowed")
+
+	// ErrTooManyRedirects 表示重定向的次数超过了 MaxRedirects.
+	ErrTooManyRedirects = errors.New("fetcher: too many redirects")
+)
+
+// internalNets 是默认拒绝访问的地址：本机、内网 (RFC 1918, IPv6 ULA), 链路本地、
+// 运营商级 NAT, 未指定的地址，以及 IETF 协议分配 (192.0.0.0/24)、基准测试 (198.18.0.0/15)
+// 与保留的地址 (240.0.0.0/4, 包括广播地址 255.255.255.255)。
+// NAT64, 6to4 与 Teredo 的地址里嵌有 IPv4 地址，可能经转换后到达内网，因此也一并拒绝。
+var internalNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"2001::/32",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+// Options 是 New 的参数，数值为零时使用默认值。
+type Options struct {
+	ConnectTimeout time.Duration // 建立连接的时间
+	Timeout        time.Duration // 整个请求的时间，包括重定向与读取内容
+	MaxBytes       int64         // 最多读取的体积 (每次 Get 可以另外指定更小的值)
+	MaxRedirects   int
+
+	// Allow 是允许访问的本机或内网地址，IP 或 CIDR, 例如 "192.168.1.10" 或 "10.0.0.0/8".
+	Allow []string
+}
+
+// Fetcher 可以同时在多个 goroutine 里使用。
+type Fetcher struct {
+	client   *http.Client
+	maxBytes int64
+	allow    []*net.IPNet
+}
+
+// Response 是已读取的内容，Body 不需要关闭。
+type Response struct {
+	URL         *url.URL // 重定向之后的网址
+	ContentType string
+	Body        []byte
+
+	// Truncated 为 true 表示内容超过了体积限制，Body 只是开头的部分。
+	Truncated bool
+}
+
+// New 按 opts 创建 Fetcher.
+func New(opts Options) (*Fetcher, error) {
+	if opts.ConnectTimeout <= 0 {
+		opts.ConnectTimeout = DefaultConnectTimeout
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.MaxRedirects <= 0 {
+		opts.MaxRedirects = DefaultMaxRedirects
+	}
+	allow, err := parseCIDRs(opts.Allow...)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Fetcher{maxBytes: opts.MaxBytes, allow: allow}
+	dialer := &net.Dialer{
+		Timeout: opts.ConnectTimeout,
+		Control: f.control,
+	}
+	f.client = &http.Client{
+		Timeout: opts.Timeout,
+		Transport: &http.Transport{
+			// 不使用代理，否则检查的是代理的地址而不是目标地址。
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   opts.ConnectTimeout,
+			ResponseHeaderTimeout: opts.Timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       time.Minute,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > opts.MaxRedirects {
+				return ErrTooManyRedirects
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("fetcher: unsupported redirect: %s", req.URL)
+			}
+			return nil
+		},
+	}
+	return f, nil
+}
+
+// Get 获取 addr 的内容，最多读取 maxBytes (为零或超过 Options.MaxBytes 时使用后者)。
+// accept 是请求的 Accept header. 只接受 http 与 https, 以及状态码 200.
+func (f *Fetcher) Get(addr, accept string, maxBytes int64) (*Response, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("fetcher: unsupported url: %s", addr)
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetcher: %s: %s", addr, res.Status)
+	}
+	if maxBytes <= 0 || maxBytes > f.maxBytes {
+		maxBytes = f.maxBytes
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	response := &Response{
+		URL:         res.Request.URL,
+		ContentType: res.Header.Get("Content-Type"),
+		Body:        body,
+	}
+	if int64(len(body)) > maxBytes {
+		response.Body = body[:maxBytes]
+		response.Truncated = true
+	}
+	return response, nil
+}
+
+// UTF8 返回转换为 UTF-8 的内容。编码根据 BOM, Content-Type 与 html 开头部分的
+// <meta charset> 判断 (与浏览器的做法相同)，例如 GBK 或 Big5 的网页。
+func (res *Response) UTF8() ([]byte, error) {
+	encoding, name, _ := charset.DetermineEncoding(res.Body, res.ContentType)
+	if name == "utf-8" {
+		return res.Body, nil
+	}
+	return encoding.NewDecoder().Bytes(res.Body)
+}
+
+// control 在建立连接之前检查目标地址 (DNS 解析之后的 IP)。
+func (f *Fetcher) control(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ErrBlocked
+	}
+	if isInternal(ip) && !contains(f.allow, ip) {
+		return ErrBlocked
+	}
+	return nil
+}
+
+// isInternal 判断 ip 是否为本机、内网、链路本地或组播地址。
+func isInternal(ip net.IP) bool {
+	return ip.IsMulticast() || contains(internalNets, ip)
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs 解析 CIDR 或单个 IP.
+func parseCIDRs(values ...string) (nets []*net.IPNet, err error) {
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("fetcher: invalid address: %s", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("fetcher: invalid address: %s", v)
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+func mustParseCIDRs(values ...string) []*net.IPNet {
+	nets, err := parseCIDRs(values...)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
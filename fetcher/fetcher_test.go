@@ -0,0 +1,295 @@
+package fetcher
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+// newTestServer 返回一个 httptest 服务器 (地址是 127.0.0.1) 与允许访问它的 Fetcher.
+func newTestServer(t *testing.T, opts Options, handler http.HandlerFunc) (*httptest.Server, *Fetcher) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	opts.Allow = []string{"127.0.0.1"}
+	f, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, f
+}
+
+func TestControl(t *testing.T) {
+	f, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked := []string{
+		"127.0.0.1:80",
+		"10.1.2.3:80",
+		"172.16.0.1:80",
+		"192.168.1.1:80",
+		"100.64.0.1:80",
+		"169.254.169.254:80",
+		"0.0.0.0:80",
+		"224.0.0.1:80",
+		"192.0.0.8:80",
+		"198.18.0.1:80",
+		"198.19.255.254:80",
+		"240.0.0.1:80",
+		"255.255.255.255:80",
+		"[::1]:80",
+		"[::]:80",
+		"[::ffff:127.0.0.1]:80",
+		"[fd00::1]:80",
+		"[fe80::1]:80",
+		"[64:ff9b::7f00:1]:80",
+		"[64:ff9b::a9fe:a9fe]:80",
+		"[2002:7f00:1::1]:80",
+		"[2002:c0a8:101::1]:80",
+		"[2001:0:4136:e378:8000:63bf:3fff:fdd2]:80",
+		"[::ffff:198.18.0.1]:80",
+		"localhost:80",
+	}
+	for _, address := range blocked {
+		if err := f.control("tcp", address, nil); err != ErrBlocked {
+			t.Errorf("control(%s) = %v, want ErrBlocked", address, err)
+		}
+	}
+	allowed := []string{
+		"93.184.216.34:80",
+		"8.8.8.8:443",
+		"192.0.1.1:80",
+		"198.20.0.1:80",
+		"223.255.255.254:80",
+		"[2606:4700::1111]:443",
+		"[2001:4860:4860::8888]:443",
+	}
+	for _, address := range allowed {
+		if err := f.control("tcp", address, nil); err != nil {
+			t.Errorf("control(%s) = %v, want nil", address, err)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	f, err := New(Options{Allow: []string{"127.0.0.1", " 10.0.0.0/8 ", "fd00::/8", "64:ff9b::/96"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		address string
+		want    error
+	}{
+		{"127.0.0.1:80", nil},
+		{"[::ffff:127.0.0.1]:80", nil},
+		{"127.0.0.2:80", ErrBlocked},
+		{"10.20.30.40:80", nil},
+		{"192.168.1.1:80", ErrBlocked},
+		{"[fd12::1]:80", nil},
+		{"[fe80::1]:80", ErrBlocked},
+		{"[64:ff9b::7f00:1]:80", nil},
+		{"[::1]:80", ErrBlocked},
+	}
+	for _, tt := range tests {
+		if err := f.control("tcp", tt.address, nil); err != tt.want {
+			t.Errorf("control(%s) = %v, want %v", tt.address, err, tt.want)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs("192.168.1.10", "10.0.0.0/8", "::1", "fd00::/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.168.1.10/32", "10.0.0.0/8", "::1/128", "fd00::/8"}
+	if len(nets) != len(want) {
+		t.Fatalf("got %d nets, want %d", len(nets), len(want))
+	}
+	for i, n := range nets {
+		if n.String() != want[i] {
+			t.Errorf("nets[%d] = %s, want %s", i, n, want[i])
+		}
+	}
+	for _, v := range []string{"", "example.com", "10.0.0.0/33", "192.168.1.300", "fd00::/129"} {
+		if _, err := parseCIDRs(v); err == nil {
+			t.Errorf("parseCIDRs(%q) should fail", v)
+		}
+	}
+	if _, err := New(Options{Allow: []string{"not-an-ip"}}); err == nil {
+		t.Error("New should reject an invalid Allow entry")
+	}
+}
+
+func TestGetBlocked(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the request should not reach the server")
+	}))
+	defer server.Close()
+
+	f, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Get(server.URL, "", 0); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Get(%s) error = %v, want ErrBlocked", server.URL, err)
+	}
+}
+
+func TestGetRedirectToBlocked(t *testing.T) {
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the redirect should not reach the internal server")
+	}))
+	defer internal.Close()
+	// 白名单只有 127.0.0.1, 因此重定向到 [::1] 会被拒绝 (不需要真的监听 ::1).
+	target := strings.Replace(internal.URL, "127.0.0.1", "[::1]", 1)
+
+	server, f := newTestServer(t, Options{}, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+	if _, err := f.Get(server.URL, "", 0); !errors.Is(err, ErrBlocked) {
+		t.Errorf("Get error = %v, want ErrBlocked", err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	server, f := newTestServer(t, Options{}, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, r.Header.Get("Accept"))
+	})
+	res, err := f.Get(server.URL+"/page", "text/html", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Body) != "text/html" || res.Truncated {
+		t.Errorf("Body = %q, Truncated = %v", res.Body, res.Truncated)
+	}
+	if res.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("ContentType = %q", res.ContentType)
+	}
+	if res.URL.Path != "/page" {
+		t.Errorf("URL = %s", res.URL)
+	}
+	if _, err := f.Get(server.URL+"/missing", "", 0); err == nil {
+		t.Error("Get should fail on 404")
+	}
+	for _, addr := range []string{"ftp://127.0.0.1/", "file:///etc/passwd", "127.0.0.1"} {
+		if _, err := f.Get(addr, "", 0); err == nil {
+			t.Errorf("Get(%s) should fail", addr)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	// /r/n 重定向 n 次之后返回 200.
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var n int
+		fmt.Sscanf(r.URL.Path, "/r/%d", &n)
+		if n > 0 {
+			http.Redirect(w, r, fmt.Sprintf("/r/%d", n-1), http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "done")
+	}
+	server, f := newTestServer(t, Options{MaxRedirects: 3}, handler)
+
+	res, err := f.Get(server.URL+"/r/3", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Body) != "done" || res.URL.Path != "/r/0" {
+		t.Errorf("Body = %q, URL = %s", res.Body, res.URL)
+	}
+	if _, err := f.Get(server.URL+"/r/4", "", 0); !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("Get error = %v, want ErrTooManyRedirects", err)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	body := strings.Repeat("0123456789", 10)
+	server, f := newTestServer(t, Options{MaxBytes: 50}, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body[:len(r.URL.Path)-1])
+	})
+	path := func(size int) string {
+		return server.URL + "/" + strings.Repeat("x", size)
+	}
+	tests := []struct {
+		size      int   // 响应的体积
+		maxBytes  int64 // Get 的参数
+		wantSize  int
+		truncated bool
+	}{
+		{50, 0, 50, false},
+		{51, 0, 50, true},
+		{100, 0, 50, true},
+		{100, 200, 50, true}, // 不可超过 Options.MaxBytes
+		{20, 10, 10, true},
+		{10, 10, 10, false},
+		{0, 10, 0, false},
+	}
+	for _, tt := range tests {
+		res, err := f.Get(path(tt.size), "", tt.maxBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Body) != tt.wantSize || res.Truncated != tt.truncated {
+			t.Errorf("size %d, maxBytes %d: got %d bytes, Truncated = %v",
+				tt.size, tt.maxBytes, len(res.Body), res.Truncated)
+		}
+		if !bytes.Equal(res.Body, []byte(body[:len(res.Body)])) {
+			t.Errorf("size %d, maxBytes %d: Body = %q", tt.size, tt.maxBytes, res.Body)
+		}
+	}
+}
+
+func TestUTF8(t *testing.T) {
+	const text = "<title>你好，世界</title>"
+	gbk, err := simplifiedchinese.GBK.NewEncoder().String(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big5, err := traditionalchinese.Big5.NewEncoder().String("<title>網頁標題</title>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"utf-8", "text/html; charset=utf-8", text, text},
+		{"gbk header", "text/html; charset=gbk", gbk, text},
+		{"gb2312 header", "text/html; charset=GB2312", gbk, text},
+		{"gbk meta", "text/html", `<meta charset="gbk">` + gbk, `<meta charset="gbk">` + text},
+		{"big5 header", "text/html; charset=big5", big5, "<title>網頁標題</title>"},
+		{"big5 meta", "text/html",
+			`<meta http-equiv="Content-Type" content="text/html; charset=big5">` + big5,
+			`<meta http-equiv="Content-Type" content="text/html; charset=big5">` + "<title>網頁標題</title>"},
+		// BOM 优先于 Content-Type, 内容不变 (包括 BOM).
+		{"bom", "text/html; charset=gbk", "\xef\xbb\xbf" + text, "\xef\xbb\xbf" + text},
+	}
+	for _, tt := range tests {
+		res := &Response{ContentType: tt.contentType, Body: []byte(tt.body)}
+		got, err := res.UTF8()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+// fsck 检查数据库与文件是否一致。上传时先写入数据库再保存文件，删除时先删除文件再修改数据库，
+// 如果在两步之间崩溃，就会出现没有文件的条目或没有条目的文件，数据库总体积也可能不准确。
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ahui2016/go-send/model"
+	"github.com/asdine/storm/v3"
+)
+
+// fsckReport 是检查的结果。Repair 为 false 时只检查不修复 (dry-run)。
+type fsckReport struct {
+	Repair           bool
+	OrphanFiles      []string // 没有对应条目的 .send/.small 文件，修复时删除
+	MissingFiles     []string // 文件不存在的条目的 ID, 修复时删除该条目
+	MissingThumbs    []string // 缺少缩略图的图片的 ID, 修复时重新生成缩略图
+	BadChecksums     []string // 内容与 checksum 不符的条目的 ID, 无法修复，只报告
+	MissingChecksums []string // 没有 checksum 的旧条目的 ID, 修复时补上
+	StoredTotalSize  int64    // 数据库里记录的总体积
+	TotalSize        int64    // 重新计算的总体积，修复时写入数据库
+	Errors           []string
+	Summary          string
+}
+
+// fsck 检查 (repair 为 true 时同时修复) 数据库与文件。只在列出条目与文件、修复时持有 filesMutex,
+// 计算 checksum 时不持有锁 (文件可能很多很大)，因此内容不符的条目会在持有锁时重新检查，
+// 以免把检查期间被删除或替换的文件当作问题。调用者不可持有 filesMutex.
+func fsck(repair bool) (*fsckReport, error) {
+	report := &fsckReport{Repair: repair}
+	toHash, err := report.checkFiles(repair)
+	if err != nil {
+		return nil, err
+	}
+	suspects := make(map[string]bool)
+	for i := range toHash {
+		message := &toHash[i]
+		checksum, err := fileChecksum(message)
+		if err != nil || checksum != message.Checksum {
+			suspects[message.ID] = true
+		}
+	}
+	if err := report.recheck(suspects, repair); err != nil {
+		return nil, err
+	}
+
+	report.Summary = fmt.Sprintf(
+		"orphan files: %d, missing files: %d, missing thumbnails: %d, "+
+			"bad checksums: %d, missing checksums: %d, total size: %d (stored: %d), errors: %d",
+		len(report.OrphanFiles), len(report.MissingFiles), len(report.MissingThumbs),
+		len(report.BadChecksums), len(report.MissingChecksums),
+		report.TotalSize, report.StoredTotalSize, len(report.Errors))
+	if repair {
+		report.Summary = "repaired. " + report.Summary
+	}
+	return report, nil
+}
+
+// checkFiles 持有 filesMutex, 对比数据库与文件列表 (repair 为 true 时删除多余的文件与
+// 没有文件的条目)，返回需要计算 checksum 的条目。
+func (report *fsckReport) checkFiles(repair bool) (toHash []Message, err error) {
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	var messages []Message
+	if err := db.DB.All(&messages); err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*Message)
+	for i := range messages {
+		byID[messages[i].ID] = &messages[i]
+	}
+
+	files, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	blobs := make(map[string]bool)
+	for _, info := range files {
+		ext := filepath.Ext(info.Name)
+		if ext != gosendFileExt && ext != thumbFileExt {
+			continue
+		}
+		blobs[info.Name] = true
+		// 书签也可以有缩略图 (网页的 og:image)。
+		message, ok := byID[strings.TrimSuffix(info.Name, ext)]
+		linkThumb := ok && ext == thumbFileExt && message.Link != nil && message.Link.Thumbnail
+		if !ok || (message.Type != model.FileMsg && !linkThumb) {
+			report.OrphanFiles = append(report.OrphanFiles, info.Name)
+		}
+	}
+
+	var missing []Message
+	for i := range messages {
+		message := &messages[i]
+		if message.Type != model.FileMsg {
+			report.TotalSize += message.DiskUsage()
+			continue
+		}
+		if !blobs[originName(message.ID)] {
+			report.MissingFiles = append(report.MissingFiles, message.ID)
+			missing = append(missing, *message)
+			continue
+		}
+		report.TotalSize += message.DiskUsage()
+		if message.IsImage() && !blobs[thumbName(message.ID)] {
+			report.MissingThumbs = append(report.MissingThumbs, message.ID)
+		}
+		toHash = append(toHash, *message)
+	}
+
+	if report.StoredTotalSize, err = db.GetTotalSize(); err != nil {
+		return nil, err
+	}
+	if repair {
+		if err := report.deleteBroken(missing); err != nil {
+			return nil, err
+		}
+	}
+	return toHash, nil
+}
+
+// deleteBroken 删除多余的文件与没有文件的条目，调用者必须持有 filesMutex.
+func (report *fsckReport) deleteBroken(missing []Message) error {
+	if err := store.Delete(report.OrphanFiles...); err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	var thumbs []string
+	for i := range missing {
+		thumbs = append(thumbs, thumbName(missing[i].ID))
+	}
+	if err := store.Delete(thumbs...); err != nil {
+		return err
+	}
+	return db.DeleteMessages(missing)
+}
+
+// recheck 持有 filesMutex, 重新检查 checksum 不符 (或出错) 的条目，已被删除的条目不算问题。
+// repair 为 true 时补上缺少的 checksum 与缩略图，并重新计算总体积。
+func (report *fsckReport) recheck(suspects map[string]bool, repair bool) error {
+	if len(suspects) == 0 && !repair {
+		return nil
+	}
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	for id := range suspects {
+		message, err := db.GetByID(id)
+		if err == storm.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		checksum, err := fileChecksum(message)
+		switch {
+		case err != nil:
+			report.addError(id, err)
+		case message.Checksum == "":
+			report.MissingChecksums = append(report.MissingChecksums, id)
+			if repair {
+				if err := db.SetChecksum(id, checksum); err != nil {
+					report.addError(id, err)
+				}
+			}
+		case checksum != message.Checksum:
+			report.BadChecksums = append(report.BadChecksums, id)
+		}
+	}
+	sort.Strings(report.MissingChecksums)
+	sort.Strings(report.BadChecksums)
+	if !repair {
+		return nil
+	}
+
+	for _, id := range report.MissingThumbs {
+		message, err := db.GetByID(id)
+		if err == storm.ErrNotFound {
+			continue
+		}
+		if err == nil {
+			err = regenerateThumb(message)
+		}
+		if err != nil {
+			report.addError(id, err)
+		}
+	}
+	return db.RecountTotalSize()
+}
+
+func (report *fsckReport) addError(id string, err error) {
+	report.Errors = append(report.Errors, id+": "+err.Error())
+}
+
+// fileChecksum 计算文件原始内容 (解密、解压后) 的 sha256.
+func fileChecksum(message *Message) (string, error) {
+	r, err := openFile(message)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func regenerateThumb(message *Message) error {
+	r, err := openFile(message)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	img, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return putThumb(thumbName(message.ID), img)
+}
+
+// runFsck 用于命令行 (go-send -fsck [-repair]), 应在停止服务后执行。
+func runFsck(repair bool) error {
+	defer db.Close()
+	report, err := fsck(repair)
+	if err != nil {
+		return err
+	}
+	blob, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(blob))
+	return nil
+}
@@ -1,11 +1,14 @@
 module github.com/ahui2016/go-send
 
-go 1.14
+go 1.16
 
 require (
 	github.com/ahui2016/goutil v0.0.0-20201116145217-40cb7ec38fee
 	github.com/asdine/storm/v3 v3.2.1
-	github.com/gofiber/fiber/v2 v2.3.0
-	go.etcd.io/bbolt v1.3.5 // indirect
-	golang.org/x/net v0.0.0-20201016165138-7b1cca2348c0
+	github.com/gofiber/fiber/v2 v2.26.0
+	github.com/klauspost/compress v1.13.4
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/crypto v0.0.0-20210513164829-c07d793c2f9a
+	golang.org/x/net v0.0.0-20210510120150-4163338589ed
+	golang.org/x/text v0.3.6
 )
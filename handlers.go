@@ -1,10 +1,15 @@
 package main
 
 import (
-	"io/ioutil"
+	"fmt"
+	"sort"
+	"strconv"
 
+	"github.com/ahui2016/go-send/database"
 	"github.com/ahui2016/go-send/model"
-	"github.com/ahui2016/goutil"
+	"github.com/ahui2016/go-send/search"
+	"github.com/ahui2016/go-send/storage"
+	"github.com/asdine/storm/v3"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -33,114 +38,366 @@ func loginHandler(c *fiber.Ctx) error {
 	return db.SessionSet(c)
 }
 
+// getAllHandler 的参数见 readListQuery (/api/all-bookmarks 与 /api/all-clips 也一样)。
+// 不分页时，如果有参数 pinned-first, 则把 Pinned 的条目排在前面，其余顺序不变。
 func getAllHandler(c *fiber.Ctx) error {
-	all, err := db.AllByUpdatedAt()
+	return listMessages(c, "")
+}
+
+// listMessages 返回一页消息。fileType 不为空时代替参数 file-type.
+func listMessages(c *fiber.Ctx, fileType string) error {
+	query, paged, err := readListQuery(formValue(c))
+	if err != nil {
+		return err
+	}
+	if fileType != "" {
+		query.FileType = fileType
+	}
+	all, next, err := db.ListMessages(*query)
+	if err == database.ErrBadCursor {
+		return jsonError(c, err.Error(), 400)
+	}
+	if err != nil {
+		return err
+	}
+	if !paged && c.Query("pinned-first") != "" {
+		sort.SliceStable(all, func(i, j int) bool {
+			return all[i].Pinned && !all[j].Pinned
+		})
+	}
+	items, err := withExpiry(all)
 	if err != nil {
 		return err
 	}
-	return c.JSON(all)
+	return listPage(c, items, next, paged)
 }
 
+// checksumHandler 在上传前检查文件是否已存在。如果已存在，就不需要再上传，
+// 只更新已存在文件的日期并返回该文件。
 func checksumHandler(c *fiber.Ctx) error {
-	hashHex := c.FormValue("hashHex")
-	var message Message
-	err := db.DB.One("Checksum", hashHex, &message)
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
 
-	if err != nil && err.Error() != "not found" {
-		return jsonError(c, err.Error(), 500)
-	}
+	hashHex := c.FormValue("hashHex")
+	message, err := db.TouchByChecksum(hashHex)
 
 	// 找不到，表示没有冲突。
-	if err != nil && err.Error() == "not found" {
+	if errorContains(err, "not found") {
 		return jsonMsgOK(c)
 	}
+	if err != nil {
+		return jsonError(c, err.Error(), 500)
+	}
 
-	// err == nil, 正常找到已存在 hashHex, 表示发生文件冲突。
-	return jsonError(c, "Checksum Already Exists", 400)
+	// err == nil, 正常找到已存在 hashHex, 表示文件已存在。
+	return c.JSON(message)
 }
 
+// uploadHandler 以流的方式接收文件 (见 readUploadForm), 接收时不锁定数据库，
+// 图片的检查与缩略图在后台进行 (见 jobs.go)。
 func uploadHandler(c *fiber.Ctx) error {
-	db.Lock()
-	defer db.Unlock()
-
-	fileContents, err := getFileContents(c)
+	form, err := readUploadForm(c)
 	if err != nil {
 		return err
 	}
+	defer form.removeFiles()
 
-	filename := c.FormValue("filename")
-	message, err := db.NewFileMsg(filename)
+	file, err := form.checkedFile()
 	if err != nil {
 		return err
 	}
-	message.Checksum = c.FormValue("checksum")
-	message.FileSize = int64(len(fileContents))
-
-	if err := checkImage(c, message, fileContents); err != nil {
-		return jsonError(c, err.Error(), 400)
+	file.Name = form.value("filename")
+	if file.E2E, err = readE2E(form.value); err != nil {
+		return err
 	}
-
-	// 至此，message 的全部内容都已经填充完毕，可以写入数据库。
-	if err := db.Insert(message); err != nil {
+	if file.ExpiresAt, err = readExpiresAt(form.value); err != nil {
+		return err
+	}
+	if file.Tags, err = readTags(form.value); err != nil {
 		return err
 	}
 
-	// 数据库操作成功，保存文件（如果是图片，则顺便生成缩略图）。
-	// 不可在数据库操作结束之前保存文件，因为数据库操作发生错误时不应保存文件。
-	if err := writeFile(message, fileContents); err != nil {
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	message, existed, err := insertFile(file)
+	if err != nil {
 		return err
 	}
 
 	// 如果前端传来缩略图，就保存下来。如果没有，则忽略不管。
-	if thumbFile, err := getThumbnail(c); err == nil {
-		err = ioutil.WriteFile(thumbFilePath(message.ID), thumbFile, 0600)
-		if err != nil {
+	// 文件已存在时不覆盖已有的缩略图 (可能是后台生成的)。
+	// 端到端加密的文件不保存缩略图，以免泄露内容。
+	if thumb := form.file("thumbnail"); thumb != nil && !existed && !message.Encrypted {
+		if err := storage.PutFile(store, thumbName(message.ID), thumb.TempPath); err != nil {
 			return err
 		}
 	}
 
 	// 自动删除过期条目
-	return deleteExpiredItems()
+	if err := deleteExpiredItems(); err != nil {
+		return err
+	}
+	return c.JSON(message)
 }
 
+// addTextMsg 添加文本消息，如果是网址，则在后台获取网页信息并改为书签 (见 jobs.go)。
 func addTextMsg(c *fiber.Ctx) error {
-	db.Lock()
-	defer db.Unlock()
+	expiresAt, err := readExpiresAt(formValue(c))
+	if err != nil {
+		return err
+	}
+	e2e, err := readE2E(formValue(c))
+	if err != nil {
+		return err
+	}
+	if e2e != nil {
+		return addEncryptedTextMsg(c, e2e, expiresAt)
+	}
 
-	textMsg, ok := createAnchor(c.FormValue("text-msg"))
-	message, err := db.InsertTextMsg(textMsg)
+	tags, err := textTags(formValue(c), c.FormValue("text-msg"))
 	if err != nil {
 		return err
 	}
+	message, err := insertTextMsg(c.FormValue("text-msg"), expiresAt, tags)
+	if err != nil {
+		return err
+	}
+	return c.JSON(message)
+}
 
-	// 如果 ok, 表示 textMsg 是一个 anchor.
-	if ok {
-		message.FileType = model.GosendAnchor
-		if err := db.DB.Save(message); err != nil {
-			return err
-		}
+// addEncryptedTextMsg 添加端到端加密的文本消息，text-msg 是密文，因此不生成 anchor,
+// 也不读取 #标签。注意参数 tags 是明文。
+func addEncryptedTextMsg(c *fiber.Ctx, e2e *e2eParams, expiresAt string) error {
+	tags, err := readTags(formValue(c))
+	if err != nil {
+		return err
+	}
+	message, err := db.NewTextMsg(c.FormValue("text-msg"))
+	if err != nil {
+		return err
+	}
+	message.ExpiresAt = expiresAt
+	message.Tags = tags
+	if err := e2e.apply(message); err != nil {
+		return err
+	}
+	if _, err := db.Insert(message); err != nil {
+		return err
 	}
 	return c.JSON(message)
 }
 
+// deleteHandler 把条目移到回收站，如果有参数 forever, 则永久删除。
 func deleteHandler(c *fiber.Ctx) error {
-	db.Lock()
-	defer db.Unlock()
-
 	id, err := getID(c)
 	if err != nil {
 		return jsonError(c, err.Error(), 400)
 	}
-	if err := goutil.DeleteFiles(getFileAndThumb(id)); err != nil {
+	if c.FormValue("forever") == "" {
+		err := db.Trash(id)
+		if err == storm.ErrNotFound {
+			return jsonError(c, "id not found: "+id, 404)
+		}
+		return err
+	}
+
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	_, err = db.GetByID(id)
+	if err == storm.ErrNotFound {
+		return jsonError(c, "id not found: "+id, 404)
+	}
+	if err != nil {
+		return err
+	}
+	if err := store.Delete(getFileAndThumb(id)); err != nil {
 		return err
 	}
 	return db.Delete(id)
 }
 
-func updateDatetime(c *fiber.Ctx) error {
-	db.Lock()
-	defer db.Unlock()
+// trashHandler 返回回收站里的全部条目，DeleteAt 是永久删除的时间。
+func trashHandler(c *fiber.Ctx) error {
+	all, err := db.TrashedItems()
+	if err != nil {
+		return err
+	}
+	items, err := withExpiry(all)
+	if err != nil {
+		return err
+	}
+	return c.JSON(items)
+}
+
+func restoreHandler(c *fiber.Ctx) error {
+	id, err := getID(c)
+	if err != nil {
+		return jsonError(c, err.Error(), 400)
+	}
+	if _, err := db.GetByID(id); err != nil {
+		return jsonError(c, err.Error(), 404)
+	}
+	if err := db.Restore(id); err != nil {
+		return jsonError(c, err.Error(), 400)
+	}
+	message, err := db.GetByID(id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(message)
+}
+
+func pinHandler(c *fiber.Ctx) error {
+	return setPinned(c, true)
+}
+
+func unpinHandler(c *fiber.Ctx) error {
+	return setPinned(c, false)
+}
+
+func setPinned(c *fiber.Ctx, pinned bool) error {
+	id, err := getID(c)
+	if err != nil {
+		return jsonError(c, err.Error(), 400)
+	}
+	if _, err := db.GetByID(id); err != nil {
+		return jsonError(c, err.Error(), 404)
+	}
+	return db.SetPinned(id, pinned)
+}
+
+// addTagsHandler 的参数是 id 与 tags (以逗号或空格分隔)，返回修改后的条目，下同。
+func addTagsHandler(c *fiber.Ctx) error {
+	return updateTags(c, false, false)
+}
+
+func removeTagsHandler(c *fiber.Ctx) error {
+	return updateTags(c, false, true)
+}
+
+func addClipTagsHandler(c *fiber.Ctx) error {
+	return updateTags(c, true, false)
+}
+
+func removeClipTagsHandler(c *fiber.Ctx) error {
+	return updateTags(c, true, true)
+}
+
+func updateTags(c *fiber.Ctx, isClip, remove bool) error {
+	id, err := getID(c)
+	if err != nil {
+		return jsonError(c, err.Error(), 400)
+	}
+	tags, err := readTags(formValue(c))
+	if err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return jsonError(c, "tags is empty", 400)
+	}
+	update := func(old []string) ([]string, error) {
+		if remove {
+			return model.RemoveTags(old, tags), nil
+		}
+		result, err := model.AddTags(old, tags)
+		if err != nil {
+			return nil, fiber.NewError(400, err.Error())
+		}
+		return result, nil
+	}
+
+	var item interface{}
+	if isClip {
+		item, err = db.UpdateClipTags(id, update)
+	} else {
+		item, err = db.UpdateTags(id, update)
+	}
+	if errorContains(err, "not found") {
+		return jsonError(c, "id: "+id+" not found", 404)
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(item)
+}
+
+// searchResult 是返回给前端的搜索结果，Message 与 Clip 只有一个不为 nil.
+// Snippet 是已转义的 html, 匹配的部分用 <mark> 标记。
+type searchResult struct {
+	Score   float64
+	Snippet string
+	Message *messageItem `json:",omitempty"`
+	Clip    *ClipText    `json:",omitempty"`
+}
+
+// searchHandler 的参数 q 是搜索语句，type (text, file, bookmark 或 clip), from, to (见 archiveFilter)
+// 与 tag 用于筛选，limit 是最多返回多少个结果。
+func searchHandler(c *fiber.Ctx) error {
+	from, to, err := model.TimeRange(c.Query("from"), c.Query("to"))
+	if err != nil {
+		return jsonError(c, err.Error(), 400)
+	}
+	query := database.SearchQuery{
+		Query: c.Query("q"),
+		Type:  c.Query("type"),
+		From:  from,
+		To:    to,
+		Tag:   c.Query("tag"),
+		Limit: defaultSearchLimit,
+	}
+	switch query.Type {
+	case "", database.SearchText, database.SearchFile, database.SearchBookmark, database.SearchClip:
+	default:
+		return jsonError(c, "unknown type: "+query.Type, 400)
+	}
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return jsonError(c, "invalid limit: "+limit, 400)
+		}
+		if query.Limit = n; n > maxSearchLimit {
+			query.Limit = maxSearchLimit
+		}
+	}
+
+	results, err := db.Search(query)
+	if err == database.ErrEmptyQuery {
+		return jsonError(c, err.Error(), 400)
+	}
+	if err != nil {
+		return err
+	}
+	tokens := search.QueryTokens(query.Query)
+	items := []searchResult{}
+	for _, result := range results {
+		item := searchResult{
+			Score:   result.Score,
+			Snippet: search.Snippet(result.Text, tokens, snippetWidth),
+			Clip:    result.Clip,
+		}
+		if result.Message != nil {
+			messages, err := withExpiry([]Message{*result.Message})
+			if err != nil {
+				return err
+			}
+			item.Message = &messages[0]
+		}
+		items = append(items, item)
+	}
+	return c.JSON(items)
+}
 
+// allTagsHandler 返回全部标签及其使用次数。
+func allTagsHandler(c *fiber.Ctx) error {
+	tags, err := db.AllTags()
+	if err != nil {
+		return err
+	}
+	return c.JSON(tags)
+}
+
+func updateDatetime(c *fiber.Ctx) error {
 	id, err := getID(c)
 	if err != nil {
 		return jsonError(c, err.Error(), 400)
@@ -149,10 +406,20 @@ func updateDatetime(c *fiber.Ctx) error {
 }
 
 func executeCommand(c *fiber.Ctx) error {
-	db.Lock()
-	defer db.Unlock()
+	command := c.FormValue("command")
+	// fsck 只在需要时持有 filesMutex (计算 checksum 时不持有)。
+	if command == "fsck" || command == "fsck-repair" {
+		report, err := fsck(command == "fsck-repair")
+		if err != nil {
+			return err
+		}
+		return c.JSON(report)
+	}
+
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
 
-	switch command := c.FormValue("command"); command {
+	switch command {
 	case "zip-all-files":
 		message, err := zipAllFiles()
 		if err != nil {
@@ -171,6 +438,16 @@ func executeCommand(c *fiber.Ctx) error {
 		if err := deleteOldItems(10); err != nil {
 			return err
 		}
+	case "empty-trash":
+		if err := emptyTrash(); err != nil {
+			return err
+		}
+	case "rebuild-search-index":
+		n, err := db.RebuildSearchIndex()
+		if err != nil {
+			return err
+		}
+		return jsonMessage(c, fmt.Sprintf("indexed %d items", n))
 	case "delete-grey-items":
 		err := deleteGreyItems()
 		if errorContains(err, "not found") {
@@ -190,41 +467,48 @@ func getTotalSize(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
+	trashSize, err := db.TrashSize()
+	if err != nil {
+		return err
+	}
+	// totalSize 包括 trashSize, 因为回收站里的文件仍然占用容量。
 	return c.JSON(fiber.Map{
 		"totalSize": size,
-		"capacity":  databaseCapacity,
+		"trashSize": trashSize,
+		"capacity":  capacity(),
 	})
 }
 
 func getAllAnchors(c *fiber.Ctx) error {
-	all, err := db.AllAnchors()
-	if err != nil {
-		return err
-	}
-	return c.JSON(all)
+	return listMessages(c, model.GosendAnchor)
 }
 
 func getAllClips(c *fiber.Ctx) error {
-	all, err := db.AllClips()
+	query, paged, err := readListQuery(formValue(c))
+	if err != nil {
+		return err
+	}
+	all, next, err := db.ListClips(*query)
+	if err == database.ErrBadCursor {
+		return jsonError(c, err.Error(), 400)
+	}
 	if err != nil {
 		return err
 	}
-	return c.JSON(all)
+	return listPage(c, all, next, paged)
 }
 
 func addClipMsg(c *fiber.Ctx) error {
-	db.Lock()
-	defer db.Unlock()
-
 	textMsg := c.FormValue("text-msg")
-	_, err := db.InsertClip(textMsg, config.ClipsLimit)
+	tags, err := textTags(formValue(c), textMsg)
+	if err != nil {
+		return err
+	}
+	_, err = db.InsertClip(textMsg, tags, config.ClipsLimit)
 	return err
 }
 
 func deleteClip(c *fiber.Ctx) error {
-	db.Lock()
-	defer db.Unlock()
-
 	id, err := getID(c)
 	if err != nil {
 		return jsonError(c, err.Error(), 400)
@@ -233,15 +517,10 @@ func deleteClip(c *fiber.Ctx) error {
 }
 
 func deleteAllClips(c *fiber.Ctx) error {
-	db.Lock()
-	defer db.Unlock()
 	return db.DeleteAllClips()
 }
 
 func updateClipDatetime(c *fiber.Ctx) error {
-	db.Lock()
-	defer db.Unlock()
-
 	id, err := getID(c)
 	if err != nil {
 		return jsonError(c, err.Error(), 400)
@@ -258,32 +537,26 @@ func getLastText(c *fiber.Ctx) error {
 }
 
 func simpleUploadHandler(c *fiber.Ctx) error {
-	db.Lock()
-	defer db.Unlock()
-
-	header, contents, err := getFileHeaderContents(c, "file")
+	file, err := receiveFile(c, "file")
 	if err != nil {
 		return err
 	}
+	defer func() { _ = file.remove() }()
 
-	message, err := db.NewFileMsg(header.Filename)
-	if err != nil {
+	if file.ExpiresAt, err = readExpiresAt(formValue(c)); err != nil {
 		return err
 	}
-	if err := checkImage(c, message, contents); err != nil {
-		return jsonError(c, err.Error(), 400)
+	if file.Tags, err = readTags(formValue(c)); err != nil {
+		return err
 	}
 
-	message.FileSize = header.Size
-
-	// 至此，message 的全部内容都已经填充完毕，可以写入数据库。
-	if err := db.Insert(message); err != nil {
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+	message, _, err := insertFile(file)
+	if err != nil {
 		return err
 	}
-
-	// 数据库操作成功，保存文件（如果是图片，则顺便生成缩略图）。
-	// 不可在数据库操作结束之前保存文件，因为数据库操作发生错误时不应保存文件。
-	return writeFile(message, contents)
+	return c.JSON(message)
 }
 
 func errorHandler(c *fiber.Ctx, err error) error {
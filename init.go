@@ -2,48 +2,109 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/ahui2016/go-send/database"
+	"github.com/ahui2016/go-send/fetcher"
+	"github.com/ahui2016/go-send/storage"
 	"github.com/ahui2016/goutil"
 	"golang.org/x/net/webdav"
 )
 
 const (
-	dataFolderName   = "gosend_data_folder"
-	filesFolderName  = "files"
-	databaseFileName = "gosend.db"
-	configFileName   = "config"
-	gosendFileExt    = ".send"
-	thumbFileExt     = ".small"
-	passwordMaxTry   = 5
-	defaultPassword  = "abc"
-	defaultAddress   = "127.0.0.1:80"
-	webdavFolderName = "webdav"
+	dataFolderName    = "gosend_data_folder"
+	filesFolderName   = "files"
+	databaseFileName  = "gosend.db"
+	configFileName    = "config"
+	gosendFileExt     = ".send"
+	thumbFileExt      = ".small"
+	tempFileExt       = ".tmp"
+	passwordMaxTry    = 5
+	defaultPassword   = "abc"
+	defaultAddress    = "127.0.0.1:80"
+	webdavFolderName  = "webdav"
+	uploadsFolderName = "uploads"
+	keyringFileName   = "keyring"
+
+	localStorage = "local"
+	s3Storage    = "s3"
 
 	// 剪贴板文本消息上限
 	defaultClipsLimit = 100
 
+	// 文件的默认保存时间 (天)
+	defaultKeepAliveDays = 30
+
+	// 文件变灰时间 (天)，应小于 KeepAliveDays, 预警该文件即将被自动删除。
+	defaultTurnGreyDays = 15
+
+	// 数据库总容量 (MB)
+	defaultCapacityMB = 1024
+
+	// 回收站里的条目在多少天后永久删除
+	defaultTrashDays = 7
+
+	// 每隔多少分钟在后台清理一次过期条目等 (见 janitor.go)
+	defaultJanitorMinutes = 60
+
+	// 定期快照 (见 snapshot.go): 每隔多少分钟快照一次，保留最新的几个快照，
+	// 以及最近几天里每天最后一个快照。
+	defaultSnapshotMinutes   = 360
+	defaultSnapshotKeep      = 4
+	defaultSnapshotKeepDaily = 7
+
+	// 全文检索 (见 searchHandler): 默认与最多返回多少个结果，以及摘要的长度 (字数)。
+	defaultSearchLimit = 50
+	maxSearchLimit     = 200
+	snippetWidth       = 80
+
+	// 后台任务 (见 jobs.go): 默认的 worker 数量，最多执行几次，第一次重试前等待多久
+	// (之后每次加倍), 以及每隔多久检查一次到期的任务。
+	defaultJobWorkers = 2
+	maxJobAttempts    = 5
+	jobRetryDelay     = time.Minute
+	jobPollInterval   = 30 * time.Second
+
+	// 分页列表 (见 readListQuery): 只有 cursor 没有 limit 时每页的条目数量，以及 limit 的上限。
+	defaultListLimit = 50
+	maxListLimit     = 500
+
 	// 99 days, for session
 	maxAge = 99 * time.Hour * 24
 
-	// databaseCapacity 控制数据库总容量，
-	databaseCapacity = 1 << 30 // 1GB
+	// memoryBodySize: 请求体不超过 1 MB 时整个读入内存，更大的请求体以流的方式读取，
+	// 由 handler 决定读入内存还是写入文件 (见 checkBodySize)。
+	memoryBodySize = 1024 * 1024
 
-	// maxBodySize 控制单个文件的体积, 100 MB.
-	// 注意在 Nginx 的设置里进行相应的设置，例如 client_max_body_size 100m
+	// maxBodySize 控制普通请求的体积, 100 MB, 这些请求体会整个读入内存。
+	// 断点续传 (tus) 的每个请求只是其中一块，也受此限制。
+	// 普通上传 (/api/upload-file) 以流的方式写入临时文件，上限是 capacity().
+	// 注意在 Nginx 的设置里进行相应的设置，例如 client_max_body_size 设为与 CapacityMB 相同。
 	maxBodySize = 1024 * 1024 * 100
 
-	// 512 KB, 普通请求（没有文件的请求）需要限制更严格。
+	// maxFormValuesSize 限制普通上传的表单里除文件以外的字段的总体积 (见 readUploadForm)。
+	maxFormValuesSize = 1024 * 1024
+
 	// defaultBodySize int64 = 1 << 19
 )
 
 var (
 	config Config
+	store  storage.Storage
+
+	// filesMutex 用于同时修改数据库与文件的操作 (上传、永久删除、清理、快照、fsck 等),
+	// 以免例如 janitor 删除文件时，另一个请求刚好把同一个文件当作已存在的条目。
+	// 只修改数据库的操作不需要锁，每个操作都在 package database 的一个事务里完成。
+	filesMutex sync.Mutex
+
+	// linkFetcher 用来获取书签的网页信息与 og:image.
+	linkFetcher *fetcher.Fetcher
 )
 
 var (
@@ -52,6 +113,8 @@ var (
 	dbPath      = filepath.Join(dataDir, databaseFileName)
 	configPath  = filepath.Join(dataDir, configFileName)
 	webdavDir   = filepath.Join(dataDir, webdavFolderName)
+	uploadsDir  = filepath.Join(dataDir, uploadsFolderName)
+	keyringPath = filepath.Join(dataDir, keyringFileName)
 	passwordTry = 0
 	db          = new(database.DB)
 	dav         = newDav(webdavDir)
@@ -62,17 +125,80 @@ type Config struct {
 	Password   string
 	Address    string
 	ClipsLimit int
+	Storage    StorageConfig
+
+	// KeepAliveDays 是文件的默认保存时间，超过时间会被自动删除，
+	// TurnGreyDays 是变灰时间，应小于 KeepAliveDays. 上传时可以为单个消息另外设置过期时间。
+	KeepAliveDays int
+	TurnGreyDays  int
+
+	// CapacityMB 控制数据库总容量 (MB)，包括全部文件。
+	CapacityMB int64
+
+	// TrashDays 是回收站里的条目的保存时间，超过时间会被永久删除。
+	// 回收站里的文件仍然占用容量，永久删除后才会释放。
+	TrashDays int
+
+	// JanitorMinutes 每隔多少分钟在后台清理一次过期条目、孤立的缩略图等。
+	JanitorMinutes int
+
+	// SnapshotDir 不为空时，每隔 SnapshotMinutes 分钟把数据库与全部文件快照到该文件夹，
+	// 保留最新的 SnapshotKeep 个快照，以及最近 SnapshotKeepDaily 天里每天最后一个快照。
+	// SnapshotDir 最好与数据文件夹在同一个分区，这样才能使用硬链接。
+	SnapshotDir       string
+	SnapshotMinutes   int
+	SnapshotKeep      int
+	SnapshotKeepDaily int
+
+	// Compress 为 true 时，文本类的文件会以 zstd 格式压缩保存，下载时自动解压。
+	Compress bool
+
+	// Encrypt 为 true 时，文件、缩略图和数据库里的记录都会加密保存 (AES-256-GCM)。
+	// 数据库的索引不加密：checksum 与搜索关键词只保存 HMAC, 日期等字段仍是明文。
+	// 密钥来自 KeyFile (64 个十六进制字符), 如果 KeyFile 为空，
+	// 则使用环境变量 GOSEND_PASSPHRASE 或启动时输入的密码。
+	Encrypt bool
+	KeyFile string
+
+	// 获取书签的网页信息时不访问本机与内网地址 (防止 SSRF), FetchAllowlist 里的地址除外，
+	// 可以是 IP 或 CIDR, 例如 "192.168.1.10" 或 "10.0.0.0/8".
+	FetchAllowlist []string
+
+	// JobWorkers 是同时执行后台任务 (缩略图、书签的网页信息) 的 worker 数量。
+	JobWorkers int
 }
 
-func init() {
+// StorageConfig 设置文件与缩略图保存在哪里，数据库总是保存在本地。
+// Type 为空或 "local" 时保存在 filesDir, 为 "s3" 时保存在 S3 兼容的对象存储 (例如 MinIO)。
+type StorageConfig struct {
+	Type      string
+	Endpoint  string // 例如 http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string
+}
+
+// openData 创建数据文件夹，读取 config, 设置文件存储与加密，然后打开数据库 (由 main 关闭)。
+// 应在解析命令行参数之后调用，skipMigrations 为 true 时不执行数据库迁移 (见 main).
+// 这些操作不放在 init 里，以免 go test 时修改用户的数据文件夹。
+func openData(skipMigrations bool) {
 	goutil.MustMkdir(dataDir)
 	goutil.MustMkdir(filesDir)
 	goutil.MustMkdir(webdavDir)
-
+	goutil.MustMkdir(uploadsDir)
 	setConfig()
 
-	// open the db here, close the db in main().
-	err := db.Open(maxAge, databaseCapacity, dbPath)
+	var err error
+	store, err = newStorage(config.Storage)
+	goutil.CheckErrorPanic(err)
+	goutil.CheckErrorFatal(setEncryption())
+	linkFetcher, err = fetcher.New(fetcher.Options{Allow: config.FetchAllowlist})
+	goutil.CheckErrorFatal(err)
+
+	db.SkipMigrations = skipMigrations
+	err = db.Open(maxAge, capacity(), days(config.KeepAliveDays), days(config.TurnGreyDays), dbPath)
 	goutil.CheckErrorPanic(err)
 	log.Print(dbPath)
 }
@@ -83,9 +209,20 @@ func setConfig() {
 	// configPath 没有文件或内容为空
 	if err != nil || len(configJSON) == 0 {
 		config = Config{
-			defaultPassword,
-			defaultAddress,
-			defaultClipsLimit,
+			Password:       defaultPassword,
+			Address:        defaultAddress,
+			ClipsLimit:     defaultClipsLimit,
+			Storage:        StorageConfig{Type: localStorage},
+			KeepAliveDays:  defaultKeepAliveDays,
+			TurnGreyDays:   defaultTurnGreyDays,
+			CapacityMB:     defaultCapacityMB,
+			TrashDays:      defaultTrashDays,
+			JanitorMinutes: defaultJanitorMinutes,
+			JobWorkers:     defaultJobWorkers,
+
+			SnapshotMinutes:   defaultSnapshotMinutes,
+			SnapshotKeep:      defaultSnapshotKeep,
+			SnapshotKeepDaily: defaultSnapshotKeepDaily,
 		}
 		configJSON, err := json.MarshalIndent(config, "", "    ")
 		goutil.CheckErrorFatal(err)
@@ -96,18 +233,78 @@ func setConfig() {
 
 	// configPath 有内容
 	goutil.CheckErrorFatal(json.Unmarshal(configJSON, &config))
+
+	// 旧的 config 没有以下设置，使用默认值。
+	if config.KeepAliveDays <= 0 {
+		config.KeepAliveDays = defaultKeepAliveDays
+	}
+	if config.TurnGreyDays <= 0 {
+		config.TurnGreyDays = defaultTurnGreyDays
+	}
+	if config.CapacityMB <= 0 {
+		config.CapacityMB = defaultCapacityMB
+	}
+	if config.TrashDays <= 0 {
+		config.TrashDays = defaultTrashDays
+	}
+	if config.JanitorMinutes <= 0 {
+		config.JanitorMinutes = defaultJanitorMinutes
+	}
+	if config.JobWorkers <= 0 {
+		config.JobWorkers = defaultJobWorkers
+	}
+	if config.SnapshotMinutes <= 0 {
+		config.SnapshotMinutes = defaultSnapshotMinutes
+	}
+	if config.SnapshotKeep <= 0 {
+		config.SnapshotKeep = defaultSnapshotKeep
+	}
+	if config.SnapshotKeepDaily <= 0 {
+		config.SnapshotKeepDaily = defaultSnapshotKeepDaily
+	}
+}
+
+// capacity 返回数据库总容量 (bytes).
+func capacity() int64 {
+	return config.CapacityMB << 20
+}
+
+func janitorInterval() time.Duration {
+	return time.Minute * time.Duration(config.JanitorMinutes)
+}
+
+func snapshotInterval() time.Duration {
+	return time.Minute * time.Duration(config.SnapshotMinutes)
+}
+
+func days(n int) time.Duration {
+	return time.Hour * 24 * time.Duration(n)
+}
+
+func newStorage(cfg StorageConfig) (storage.Storage, error) {
+	switch cfg.Type {
+	case "", localStorage:
+		return storage.NewLocal(filesDir), nil
+	case s3Storage:
+		return storage.NewS3(cfg.Endpoint, cfg.Region, cfg.Bucket,
+			cfg.AccessKey, cfg.SecretKey, cfg.Prefix)
+	default:
+		return nil, errors.New("unknown storage type: " + cfg.Type)
+	}
 }
 
-func localFilePath(id string) string {
-	return filepath.Join(filesDir, id+gosendFileExt)
+// originName 是文件在 store 里的名称。
+func originName(id string) string {
+	return id + gosendFileExt
 }
 
-func thumbFilePath(id string) string {
-	return filepath.Join(filesDir, id+thumbFileExt)
+// thumbName 是缩略图在 store 里的名称。
+func thumbName(id string) string {
+	return id + thumbFileExt
 }
 
 func getFileAndThumb(id string) (originFile, thumb string) {
-	return localFilePath(id), thumbFilePath(id)
+	return originName(id), thumbName(id)
 }
 
 func newDav(dirPath string) *webdav.Handler {
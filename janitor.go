@@ -0,0 +1,169 @@
+package main
+
+// janitor 在后台定期清理：删除过期条目、回收站里超过保存时间的条目、孤立的缩略图
+// 与过期的未完成上传，并校正数据库总体积。
+// 原来只在上传文件时删除过期条目，如果很久没有上传，过期的文件就会一直留着。
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ahui2016/go-send/model"
+	"github.com/asdine/storm/v3"
+	"github.com/gofiber/fiber/v2"
+)
+
+// janitorReport 是一次清理的结果。
+type janitorReport struct {
+	StartedAt      string // ISO8601
+	Duration       string
+	ExpiredItems   []string // 被删除的过期条目的 ID
+	PurgedItems    []string // 从回收站永久删除的条目的 ID
+	OrphanThumbs   []string // 被删除的孤立缩略图 (没有对应的条目)
+	ExpiredUploads []string // 被删除的过期的未完成上传的 ID
+	TotalSize      int64    // 校正后的数据库总体积
+	Error          string
+}
+
+var (
+	janitorMutex      sync.Mutex
+	lastJanitorReport *janitorReport
+)
+
+// startJanitor 先清理一次，然后每隔 interval 清理一次。
+// 返回的函数用来停止 janitor, 它会等待正在进行的清理完成。
+func startJanitor(interval time.Duration) (stop func()) {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			runJanitor()
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// runJanitor 清理一次，并把结果写入日志和 lastJanitorReport.
+func runJanitor() *janitorReport {
+	report := &janitorReport{StartedAt: model.TimeNow()}
+	start := time.Now()
+	if err := cleanUp(report); err != nil {
+		report.Error = err.Error()
+	}
+	report.Duration = time.Since(start).String()
+
+	log.Printf("janitor: removed %d expired items, %d items from trash, %d orphan thumbnails, %d expired uploads; total size %d",
+		len(report.ExpiredItems), len(report.PurgedItems), len(report.OrphanThumbs),
+		len(report.ExpiredUploads), report.TotalSize)
+	if report.Error != "" {
+		log.Print("janitor: ", report.Error)
+	}
+
+	janitorMutex.Lock()
+	lastJanitorReport = report
+	janitorMutex.Unlock()
+	return report
+}
+
+func cleanUp(report *janitorReport) error {
+	// tus 有自己的锁，不需要 filesMutex.
+	removed, err := cleanExpiredUploads()
+	report.ExpiredUploads = removed
+	if err != nil {
+		return err
+	}
+
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	items, err := db.ExpiredItems()
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	if len(items) > 0 {
+		if err := deleteItems(items); err != nil {
+			return err
+		}
+		report.ExpiredItems = itemIDs(items)
+	}
+
+	deadline := model.FormatTime(time.Now().Add(-days(config.TrashDays)))
+	items, err = db.TrashedBefore(deadline)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	if len(items) > 0 {
+		if err := deleteItems(items); err != nil {
+			return err
+		}
+		report.PurgedItems = itemIDs(items)
+	}
+
+	if report.OrphanThumbs, err = deleteOrphanThumbs(); err != nil {
+		return err
+	}
+
+	if err := db.RecountTotalSize(); err != nil {
+		return err
+	}
+	report.TotalSize, err = db.GetTotalSize()
+	return err
+}
+
+// deleteOrphanThumbs 删除没有对应条目的缩略图，调用者必须持有 filesMutex,
+// 因为上传文件时先写入数据库再保存缩略图。
+func deleteOrphanThumbs() (removed []string, err error) {
+	all, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range all {
+		id := strings.TrimSuffix(info.Name, thumbFileExt)
+		if id == info.Name {
+			continue
+		}
+		_, err := db.GetByID(id)
+		if err == storm.ErrNotFound {
+			removed = append(removed, info.Name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	return removed, store.Delete(removed...)
+}
+
+func itemIDs(items []Message) (IDs []string) {
+	for i := range items {
+		IDs = append(IDs, items[i].ID)
+	}
+	return
+}
+
+// janitorHandler 返回最近一次清理的结果。
+func janitorHandler(c *fiber.Ctx) error {
+	janitorMutex.Lock()
+	report := lastJanitorReport
+	janitorMutex.Unlock()
+	return c.JSON(fiber.Map{
+		"interval":   janitorInterval().String(),
+		"lastReport": report,
+	})
+}
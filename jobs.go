@@ -0,0 +1,234 @@
+package main
+
+// jobs 是保存在数据库里的后台任务队列：生成缩略图 (同时检查图片) 与获取书签的网页信息。
+// 原来这些工作在请求里进行，并且一直锁定数据库，一个很慢的网站或很大的图片会卡住全部请求。
+// 现在请求只添加任务 (条目的 Processing 为 pending) 就立即返回，由 worker 在后台处理，
+// 程序重启后，未完成的任务会继续执行。
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ahui2016/go-send/fetcher"
+	"github.com/ahui2016/go-send/model"
+	"github.com/ahui2016/go-send/preview"
+	"github.com/ahui2016/goutil/graphics"
+	"github.com/asdine/storm/v3"
+	"github.com/gofiber/fiber/v2"
+)
+
+// jobWake 通知 worker 有新任务，容量为 1, 多次通知只需保留一次。
+var jobWake = make(chan struct{}, 1)
+
+// permanentError 表示重试也不会成功的错误，例如图片有问题。
+type permanentError struct{ error }
+
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// addJob 添加后台任务并通知 worker.
+func addJob(kind model.JobKind, message *Message) error {
+	if err := db.AddJob(kind, message); err != nil {
+		return err
+	}
+	wakeJobWorkers()
+	return nil
+}
+
+func wakeJobWorkers() {
+	select {
+	case jobWake <- struct{}{}:
+	default:
+	}
+}
+
+// startJobWorkers 先把上次未完成的任务放回队列，然后启动 n 个 worker.
+// 返回的函数用来停止 worker, 它会等待正在执行的任务完成。
+func startJobWorkers(n int) (stop func()) {
+	err := db.ResetRunningJobs()
+	if err != nil {
+		log.Print("jobs: ", err)
+	}
+
+	quit := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jobWorker(quit)
+		}()
+	}
+	return func() {
+		close(quit)
+		wg.Wait()
+	}
+}
+
+// jobWorker 执行任务直到队列为空，然后等待新任务的通知，
+// 或者每隔 jobPollInterval 检查一次 (推迟重试的任务到时间了)。
+func jobWorker(quit chan struct{}) {
+	for {
+		for runNextJob() {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+		}
+		select {
+		case <-quit:
+			return
+		case <-jobWake:
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// runNextJob 执行一个任务，没有任务 (或出错) 时返回 false.
+func runNextJob() bool {
+	job, err := db.ClaimJob()
+	if err != nil {
+		log.Print("jobs: ", err)
+		return false
+	}
+	if job == nil {
+		return false
+	}
+	// 可能还有其它任务，让另一个 worker 也去看看。
+	wakeJobWorkers()
+
+	jobErr := doJob(job)
+
+	if err := finishJob(job, jobErr); err != nil {
+		log.Printf("jobs: %s: %v", job.ID, err)
+	}
+	return true
+}
+
+// finishJob 根据 jobErr 删除任务、推迟重试或标记为失败。
+func finishJob(job *model.Job, jobErr error) error {
+	if jobErr == nil {
+		return db.CompleteJob(job)
+	}
+	log.Printf("jobs: %s %s of %s (attempt %d): %v", job.Kind, job.ID, job.MessageID, job.Attempts, jobErr)
+	var perm permanentError
+	if errors.As(jobErr, &perm) || job.Attempts >= maxJobAttempts {
+		return db.FailJob(job, jobErr.Error())
+	}
+	// 每次重试的间隔加倍：1, 2, 4, 8 分钟。
+	delay := jobRetryDelay * time.Duration(math.Pow(2, float64(job.Attempts-1)))
+	runAt := model.FormatTime(time.Now().Add(delay))
+	return db.RetryJobLater(job, jobErr.Error(), runAt)
+}
+
+// doJob 执行任务，条目已被删除时直接完成。
+func doJob(job *model.Job) error {
+	message, err := db.GetByID(job.MessageID)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch job.Kind {
+	case model.ThumbnailJob:
+		return makeThumbnail(message)
+	case model.LinkPreviewJob:
+		return fetchLinkPreview(message)
+	default:
+		return permanent(errors.New("unknown job: " + string(job.Kind)))
+	}
+}
+
+// makeThumbnail 检查图片并生成缩略图。如果上传时前端已经传来缩略图，则只检查图片。
+func makeThumbnail(message *Message) error {
+	r, err := openFile(message)
+	if err != nil {
+		return err
+	}
+	img, err := ioutil.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return err
+	}
+	buf, err := graphics.Thumbnail(img, 0, 0)
+	if err != nil {
+		return permanent(errors.New("该图片有问题: " + err.Error()))
+	}
+	thumb := thumbName(message.ID)
+	if _, err := store.Stat(thumb); err == nil {
+		return nil
+	}
+	return store.Put(thumb, buf, int64(buf.Len()))
+}
+
+// fetchLinkPreview 获取网页信息，能获取标题时把该条目改为书签，并尽量保存 og:image 缩略图
+// (缩略图是可有可无的，出错时只写入日志)。网址不是网页、没有标题或者是不允许访问的地址时，
+// 该条目保持为普通文本，任务也算完成；网络错误则稍后重试。
+func fetchLinkPreview(message *Message) error {
+	if message.Encrypted || message.Link != nil {
+		return nil
+	}
+	addr, ok := isHttpURL(message.TextMsg)
+	if !ok {
+		return nil
+	}
+	link, err := preview.Fetch(linkFetcher, addr)
+	if errors.Is(err, preview.ErrNotHTML) || errors.Is(err, fetcher.ErrBlocked) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if link.Title == "" {
+		return nil
+	}
+	if link.Image != "" {
+		img, err := preview.FetchImage(linkFetcher, link.Image)
+		if err == nil {
+			err = putThumb(thumbName(message.ID), img)
+		}
+		if err != nil {
+			log.Printf("link thumbnail of %s: %v", message.ID, err)
+		} else {
+			link.Thumbnail = true
+		}
+	}
+	return db.SetLink(message.ID, link)
+}
+
+// jobsHandler 返回各种状态的任务数量以及全部任务 (包括失败的任务与最后一次错误)。
+func jobsHandler(c *fiber.Ctx) error {
+	jobs, err := db.AllJobs()
+	if err != nil {
+		return err
+	}
+	counts := map[string]int{model.JobPending: 0, model.JobRunning: 0, model.JobFailed: 0}
+	for i := range jobs {
+		counts[jobs[i].Status]++
+	}
+	return c.JSON(fiber.Map{
+		"workers": config.JobWorkers,
+		"counts":  counts,
+		"jobs":    jobs,
+	})
+}
+
+// retryJobHandler 立即重试一个失败的任务。
+func retryJobHandler(c *fiber.Ctx) error {
+	id, err := getID(c)
+	if err != nil {
+		return err
+	}
+	if err := db.RetryJob(id); err != nil {
+		return err
+	}
+	wakeJobWorkers()
+	return nil
+}
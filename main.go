@@ -1,23 +1,74 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/ahui2016/go-send/encryption"
+	"github.com/ahui2016/goutil"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/favicon"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
 )
 
+var (
+	encryptStoreFlag = flag.Bool("encrypt-store", false, "encrypt all existing files and the database, then exit")
+	genKeyFlag       = flag.String("gen-key", "", "generate a new random key file at the given path, then exit")
+	fsckFlag         = flag.Bool("fsck", false, "check the database against the stored files, print the report, then exit")
+	repairFlag       = flag.Bool("repair", false, "used with -fsck, repair the problems found")
+	exportFlag       = flag.String("export", "", "write a full backup to the given path, then exit")
+	importFlag       = flag.String("import", "", "restore a backup into an empty data folder, then exit")
+	mergeFlag        = flag.Bool("merge", false, "used with -import, merge the backup into the existing data")
+	migrationsFlag   = flag.Bool("migrations", false, "list the database migrations and dry-run the pending ones, then exit")
+)
+
 func main() {
+	flag.Parse()
+	if *genKeyFlag != "" {
+		goutil.CheckErrorFatal(encryption.GenerateKeyFile(*genKeyFlag))
+		return
+	}
+
+	// 数据库迁移 (以及迁移前的备份) 只在启动服务器时执行，
+	// 其它命令行功能使用现有的数据库，不修改其版本。
+	openData(isCommand())
+
+	if *fsckFlag {
+		goutil.CheckErrorFatal(runFsck(*repairFlag))
+		return
+	}
+	if *migrationsFlag {
+		goutil.CheckErrorFatal(printMigrations())
+		return
+	}
+	if *exportFlag != "" {
+		goutil.CheckErrorFatal(exportBackupFile(*exportFlag))
+		return
+	}
+	if *importFlag != "" {
+		goutil.CheckErrorFatal(importBackup(*importFlag, *mergeFlag))
+		return
+	}
+	if *encryptStoreFlag {
+		goutil.CheckErrorFatal(encryptStore())
+		return
+	}
 	defer func() { _ = db.Close() }()
 
+	// 超过 BodyLimit 的请求体不会被拒绝，而是以流的方式读取，体积由 checkBodySize 检查。
 	app := fiber.New(fiber.Config{
-		BodyLimit:    maxBodySize,
-		Concurrency:  5,
-		ErrorHandler: errorHandler,
+		BodyLimit:                    memoryBodySize,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
+		Concurrency:                  5,
+		ErrorHandler:                 errorHandler,
 	})
 
 	// app.Use(maxBodyLimit)
+	app.Use(checkBodySize)
 	app.Use(responseNoCache)
 	app.Use(limiter.New(limiter.Config{
 		Max: 300,
@@ -30,7 +81,7 @@ func main() {
 	app.Use("/static", checkLoginHTML)
 	app.Static("/static", "./static")
 	app.Use("/files", checkLoginHTML)
-	app.Static("/files", filesDir)
+	app.Get("/files/:name", filesHandler)
 
 	app.Get("/", redirectToHome)
 	app.Use("/home", checkLoginHTML)
@@ -42,21 +93,75 @@ func main() {
 	api.Get("/total-size", getTotalSize)
 	api.Get("/all-bookmarks", getAllAnchors)
 	api.Get("/all-clips", getAllClips)
+	api.Get("/download/:id", downloadHandler)
+	api.Get("/archive", archiveHandler)
+	api.Post("/archive", archiveHandler)
 	api.Get("/delete-all-clips", deleteAllClips)
 	api.Post("/checksum", checksumHandler)
 	api.Post("/upload-file", uploadHandler)
 	api.Post("/add-text-msg", addTextMsg)
 	api.Post("/delete", deleteHandler)
+	api.Get("/trash", trashHandler)
+	api.Post("/restore", restoreHandler)
 	api.Post("/update-datetime", updateDatetime)
+	api.Get("/janitor", janitorHandler)
+	api.Get("/jobs", jobsHandler)
+	api.Post("/retry-job", retryJobHandler)
+	api.Get("/backup", backupHandler)
+	api.Get("/snapshots", snapshotsHandler)
+	api.Post("/snapshots", takeSnapshotHandler)
+	api.Post("/pin", pinHandler)
+	api.Post("/unpin", unpinHandler)
+	api.Get("/tags", allTagsHandler)
+	api.Get("/search", searchHandler)
+	api.Post("/add-tags", addTagsHandler)
+	api.Post("/remove-tags", removeTagsHandler)
 	api.Post("/execute-command", executeCommand)
 	api.Post("/delete-clip", deleteClip)
 	api.Post("/update-clip-datetime", updateClipDatetime)
+	api.Post("/add-clip-tags", addClipTagsHandler)
+	api.Post("/remove-clip-tags", removeClipTagsHandler)
+
+	// 断点续传 (tus 1.0)
+	tus := api.Group("/tus", checkTusResumable)
+	tus.Options("/", tusOptions)
+	tus.Post("/", tusCreate)
+	tus.Head("/:id", tusHead)
+	tus.Patch("/:id", tusPatch)
+	tus.Delete("/:id", tusDelete)
 
 	cli := app.Group("/cli", checkPassword)
 	cli.Post("/last-text", getLastText)
 	cli.Post("/add-clip", addClipMsg)
 	cli.Post("/add-text", addTextMsg)
 	cli.Post("/add-photo", simpleUploadHandler)
+	cli.Post("/backup", backupHandler)
+
+	// 后台任务、定期清理与快照，收到 SIGINT 或 SIGTERM 时先停止它们，再关闭服务器与数据库。
+	stopJobWorkers := startJobWorkers(config.JobWorkers)
+	stopJanitor := startJanitor(janitorInterval())
+	stopSnapshots := startSnapshots()
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+		<-quit
+		log.Print("shutting down...")
+		if err := app.Shutdown(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	err := app.Listen(config.Address)
+	stopJobWorkers()
+	stopJanitor()
+	stopSnapshots()
+	if err != nil {
+		_ = db.Close()
+		log.Fatal(err)
+	}
+}
 
-	log.Fatal(app.Listen(config.Address))
+// isCommand 判断是否执行命令行功能 (-fsck, -export 等) 而不是启动服务器。
+func isCommand() bool {
+	return *fsckFlag || *migrationsFlag || *exportFlag != "" || *importFlag != "" || *encryptStoreFlag
 }
@@ -22,6 +22,29 @@ func checkContentLength(c *fiber.Ctx, length int) error {
 }
 */
 
+// checkBodySize 在读取请求体之前根据 Content-Length 检查请求的体积。
+// 普通请求的请求体会整个读入内存，上限是 maxBodySize; 普通上传以流的方式写入临时文件
+// (见 readUploadForm), 上限是 capacity(). 不接受没有 Content-Length 的请求体 (chunked).
+func checkBodySize(c *fiber.Ctx) error {
+	length := c.Request().Header.ContentLength()
+	if length > memoryBodySize || length < 0 {
+		// 这时请求体还在连接里没有读完，如果 handler 不读或只读一部分，
+		// 剩下的数据会被当作下一个请求，因此响应后关闭连接。
+		c.Context().SetConnectionClose()
+	}
+	if length < 0 {
+		return jsonError(c, "Content-Length is required", fiber.StatusLengthRequired)
+	}
+	limit := int64(maxBodySize)
+	if c.Method() == fiber.MethodPost && c.Path() == "/api/upload-file" {
+		limit = capacity()
+	}
+	if int64(length) > limit {
+		return jsonError(c, "Request Entity Too Large", fiber.StatusRequestEntityTooLarge)
+	}
+	return c.Next()
+}
+
 func responseNoCache(c *fiber.Ctx) error {
 	c.Response().Header.Set(
 		fiber.HeaderCacheControl,
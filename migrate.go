@@ -0,0 +1,22 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// printMigrations 用于命令行 (go-send -migrations), 列出数据库迁移并试运行待执行的迁移
+// (不修改数据库), 应在停止服务后执行。
+func printMigrations() error {
+	defer db.Close()
+	report, err := db.DryRunMigrations()
+	if err != nil {
+		return err
+	}
+	blob, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(blob))
+	return nil
+}
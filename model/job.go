@@ -0,0 +1,32 @@
+package model
+
+// JobKind 是后台任务的类型。
+type JobKind string
+
+const (
+	// ThumbnailJob 检查上传的图片并生成缩略图 (已有缩略图时只检查图片)。
+	ThumbnailJob JobKind = "thumbnail"
+
+	// LinkPreviewJob 获取网址的网页信息，成功时把文本消息改为书签，并保存 og:image 缩略图。
+	LinkPreviewJob JobKind = "link-preview"
+)
+
+// 后台任务的状态，也用于 Message.Processing.
+const (
+	JobPending = "pending"
+	JobRunning = "running" // 只用于 Job, 正在处理的条目仍然是 JobPending
+	JobFailed  = "failed"  // 重试次数已用完，或者是无法重试的错误
+)
+
+// Job 是保存在数据库里的后台任务，完成后即删除，失败的任务会保留下来以便查看与重试。
+type Job struct {
+	ID        string // primary key
+	Kind      JobKind
+	MessageID string `storm:"index"`
+	Status    string `storm:"index"`
+	Attempts  int    // 已执行的次数
+	LastError string
+	RunAt     string `storm:"index"` // ISO8601, 不早于此时执行 (重试时推迟)
+	CreatedAt string
+	UpdatedAt string
+}
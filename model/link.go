@@ -0,0 +1,40 @@
+package model
+
+import (
+	"html"
+	"regexp"
+)
+
+// LinkPreview 是书签 (FileType 为 GosendAnchor 的 TextMsg) 的网页信息。
+// 全部是纯文本 (已经过 html 解码)，显示时不可当作 html 插入。
+type LinkPreview struct {
+	URL         string
+	Title       string
+	Description string
+	SiteName    string
+	Favicon     string // 图标的网址
+	Image       string // og:image 的网址
+	Thumbnail   bool   // Image 已保存为缩略图，与图片文件的缩略图一样是 <ID>.small
+}
+
+// reLegacyAnchor 匹配旧版本保存在 TextMsg 里的 html, 见 UpgradeAnchor.
+var reLegacyAnchor = regexp.MustCompile(`^<a href="([^"]*)">(.*)</a>$`)
+
+// UpgradeAnchor 把旧版本的书签 (TextMsg 是 <a href="网址">标题</a>) 转换为
+// TextMsg 只保存网址、其余信息保存在 Link 里的形式。
+// 不是旧版本的书签时不做任何修改并返回 false.
+func UpgradeAnchor(message *Message) bool {
+	if message.FileType != GosendAnchor || message.Link != nil {
+		return false
+	}
+	matches := reLegacyAnchor.FindStringSubmatch(message.TextMsg)
+	if matches == nil {
+		return false
+	}
+	link := &LinkPreview{URL: matches[1], Title: html.UnescapeString(matches[2])}
+	if err := message.SetTextMsg(link.URL); err != nil {
+		return false
+	}
+	message.Link = link
+	return true
+}
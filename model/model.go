@@ -7,12 +7,16 @@ import (
 	"strings"
 	"time"
 
-	"github.com/ahui2016/goutil"
 	"github.com/gofiber/fiber/v2/utils"
 )
 
-// ISO8601 需要根据服务器的具体时区来设定正确的时区
-const ISO8601 = "2006-01-02T15:04:05.999+00:00"
+// ISO8601 是保存时间的格式：UTC 的 RFC 3339, 毫秒固定为三位 (例如 2020-12-01T08:00:00.000Z),
+// 因此时间可以直接按字符串比较先后 (包括 storm 的索引与查询)。
+const ISO8601 = "2006-01-02T15:04:05.000Z07:00"
+
+// legacyISO8601 是旧版本的格式：实际上是服务器的本地时间，却写死了 "+00:00",
+// 并且会省略末尾的零 (长度不固定)。注意这里的 "+00:00" 是普通文字而不是时区。
+const legacyISO8601 = "2006-01-02T15:04:05.999+00:00"
 
 const (
 	// FileNameMinLength 规定包括后缀名在内文件名长度不可小于 5.
@@ -35,29 +39,68 @@ const (
 	GosendZip = "gosend/zip"
 
 	// GosendAnchor 是自定义的文件类型，但不用于文件，而是用于 TextMsg,
-	// 表示该文本内容是网址 (html 的 a 标签)
+	// 表示该文本内容是网址 (书签), 网页信息在 Message.Link 里。
 	GosendAnchor = "gosend/anchor"
 )
 
+// Zstd 表示文件以 zstd 格式压缩保存，读取时需要解压。
+const Zstd = "zstd"
+
 // Message 表示一个数据表。
 // 本来想过用 Note 来命名，但考虑到不管是熟人间互传还是个人设备间互传，
 // 也不管互传文件还是互传文本信息，都更适合用 “消息、信息” 而不是 “笔记”。
 type Message struct {
-	ID        string // primary key
-	Type      MsgType
-	TextMsg   string
-	FileName  string `storm:"index"`
-	FileSize  int64
-	FileType  string // MIME
-	Checksum  string `storm:"unique"` // hex(sha256)
-	CreatedAt string `storm:"index"`  // ISO8601
+	ID          string // primary key
+	Type        MsgType
+	TextMsg     string
+	FileName    string // 不建立索引，因为 storm 的索引是明文 (见 encryption.Codec)
+	FileSize    int64  // 原文件的体积
+	StoredSize  int64  // 实际保存的体积 (压缩后的体积)
+	Compression string // 为空表示没有压缩，否则是压缩格式，例如 Zstd
+	FileType    string // MIME
+	Checksum    string // hex(sha256), 根据原文件计算
+
+	// ChecksumKey 用于按 Checksum 查找条目：数据库加密时是 Checksum 的 HMAC, 否则就是 Checksum
+	// (由 database 包设置)。索引是明文，因此不直接索引 Checksum.
+	ChecksumKey string `storm:"unique"`
+
+	CreatedAt string `storm:"index"` // ISO8601
 	UpdatedAt string `storm:"index"`
 	DeletedAt string `storm:"index"`
+	ExpiresAt string `storm:"index"` // ISO8601, 为空表示使用默认的保存时间
+
+	// Tags 已经过 NormalizeTags 处理。不建立索引，因为 storm 会把整个 slice 当作一个索引值
+	// (经过 codec, 与 Pinned 的问题一样), 不能按单个标签查找，因此用 matcher 逐条筛选。
+	Tags []string
+
+	// Link 是书签的网页信息，只用于 FileType 为 GosendAnchor 的条目。
+	Link *LinkPreview
+
+	// Processing 是后台任务 (缩略图、网页信息等) 的状态：为空表示已完成或不需要处理，
+	// 否则是 JobPending 或 JobFailed. 见 Job.
+	Processing string
+
+	// Pinned 为 true 时永不过期，也不会被批量删除 (包括因容量不足而删除旧文件)。
+	// 不建立索引，因为 bool 类型的索引值会经过 codec, 而加密 codec 的结果每次都不同。
+	Pinned bool
+
+	// 以下是端到端加密的参数，由客户端加密，服务器只保存密文，无法解读。
+	// Encrypted 为 true 时，TextMsg 与文件内容都是密文，Checksum 根据密文计算。
+	Encrypted   bool
+	Cipher      string       // 客户端使用的算法，例如 "AES-256-GCM"
+	Nonce       string       // base64
+	WrappedKeys []WrappedKey // 为空表示密钥只在分享链接的 fragment 里 (不会发给服务器)
+}
+
+// WrappedKey 是用某个配对设备的密钥加密 (包装) 过的内容密钥。
+type WrappedKey struct {
+	Device string // 配对设备的名称或公钥指纹，由客户端决定
+	Key    string // base64
 }
 
 // NewMessage .
 func NewMessage(id string, msgType MsgType) *Message {
-	now := goutil.TimeNow(ISO8601)
+	now := TimeNow()
 	return &Message{
 		ID:        id,
 		Type:      msgType,
@@ -90,9 +133,52 @@ func (message *Message) SetFileNameType(filename string) error {
 	return nil
 }
 
+// SetEncrypted 把 message 标记为端到端加密。文件的 FileType 一律改为 octet-stream,
+// 因为服务器看不到文件内容，不能当作图片等类型处理。
+func (message *Message) SetEncrypted(cipher, nonce string, wrappedKeys []WrappedKey) error {
+	if cipher == "" || nonce == "" {
+		return errors.New("cipher and nonce are required for an encrypted message")
+	}
+	message.Encrypted = true
+	message.Cipher = cipher
+	message.Nonce = nonce
+	message.WrappedKeys = wrappedKeys
+	if message.Type == FileMsg {
+		message.FileType = "application/octet-stream"
+	}
+	return nil
+}
+
 // IsImage .
 func (message *Message) IsImage() bool {
-	return strings.HasPrefix(message.FileType, "image")
+	return !message.Encrypted && strings.HasPrefix(message.FileType, "image")
+}
+
+// DiskUsage 返回用于计算数据库总容量的体积。
+// TextMsg 与旧数据没有 StoredSize, 则使用 FileSize.
+func (message *Message) DiskUsage() int64 {
+	if message.StoredSize > 0 {
+		return message.StoredSize
+	}
+	return message.FileSize
+}
+
+// IsCompressible 判断是否值得压缩。已经是压缩格式的文件 (例如 compressed/*, 图片, 视频)
+// 再压缩也不会变小，因此只压缩文本类的文件。
+func (message *Message) IsCompressible() bool {
+	if message.Type != FileMsg || message.FileType == GosendZip || message.Encrypted {
+		return false
+	}
+	if strings.HasPrefix(message.FileType, "text/") {
+		return true
+	}
+	switch message.FileType {
+	case "application/json", "application/xml", "application/javascript",
+		"application/atom+xml", "application/rss+xml", "application/x-perl",
+		"application/msword", "application/vnd.ms-excel", "application/rtf":
+		return true
+	}
+	return false
 }
 
 // ClipText 表示剪贴板文本消息，创建新的类型只是为了方便在数据库里创建一个独立的 bucket,
@@ -101,18 +187,19 @@ type ClipText struct {
 	ID        string // primary key
 	Type      MsgType
 	TextMsg   string
-	FileName  string `storm:"index"`
+	FileName  string
 	FileSize  int64
-	FileType  string // MIME
-	Checksum  string `storm:"unique"` // hex(sha256)
-	CreatedAt string `storm:"index"`  // ISO8601
-	UpdatedAt string `storm:"index"`
-	DeletedAt string `storm:"index"`
+	FileType  string   // MIME
+	Checksum  string   // hex(sha256)
+	CreatedAt string   `storm:"index"` // ISO8601
+	UpdatedAt string   `storm:"index"`
+	DeletedAt string   `storm:"index"`
+	Tags      []string // 与 Message.Tags 相同
 }
 
 // NewClipText .
 func NewClipText(id string, msgType MsgType) *ClipText {
-	now := goutil.TimeNow(ISO8601)
+	now := TimeNow()
 	return &ClipText{
 		ID:        id,
 		Type:      msgType,
@@ -139,8 +226,12 @@ func typeByFilename(filename string) (filetype string) {
 	switch ext {
 	case "zip", "rar", "7z", "gz", "tar", "bz", "bz2", "xz":
 		filetype = "compressed/" + ext
-	case "md", "xml", "html", "xhtml", "htm":
+	case "md", "xml", "html", "xhtml", "htm", "csv":
 		filetype = "text/" + ext
+	case "log":
+		filetype = "text/plain"
+	case "tsv":
+		filetype = "text/tab-separated-values"
 	case "doc", "docx", "ppt", "pptx", "rtf", "xls", "xlsx":
 		filetype = "office/" + ext
 	case "epub", "pdf", "mobi", "azw", "azw3", "djvu":
@@ -200,22 +291,9 @@ func (id IncreaseID) String() string {
 
 // CompareTo 让 id 与 another 对比，如果两者相等就返回 0,
 // 如果 id 更大则返回正数，如果 id 更小则返回负数。
-/*
 func (id IncreaseID) CompareTo(another IncreaseID) int {
-	if id.Year > another.Year {
-		return 1
-	}
-	if id.Year < another.Year {
-		return -1
-	}
-	if id.Year == another.Year {
-		if id.Count > another.Count {
-			return 1
-		}
-		if id.Count < another.Count {
-			return -1
-		}
+	if id.Year != another.Year {
+		return id.Year - another.Year
 	}
-	return 0
+	return id.Count - another.Count
 }
-*/
@@ -0,0 +1,94 @@
+package model
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// MaxTags 是每个条目最多可以有的标签数量。
+	MaxTags = 20
+
+	// MaxTagLength 是每个标签的最大长度 (字符数)。
+	MaxTagLength = 32
+)
+
+var (
+	// 标签只能由文字、数字、下划线、连字符与斜杠组成 (斜杠可用于分层，例如 work/report)。
+	reTag = regexp.MustCompile(`^[\p{L}\p{N}_/-]+$`)
+
+	// #标签 的前面必须是开头或空白，以免把网址里的 # 当作标签。
+	reHashTag = regexp.MustCompile(`(?:^|\s)#([\p{L}\p{N}_/-]+)`)
+)
+
+// ParseTags 把以逗号或空白分隔的 s 拆分为标签，见 NormalizeTags.
+func ParseTags(s string) ([]string, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '，' || r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '　'
+	})
+	return NormalizeTags(fields)
+}
+
+// NormalizeTags 去除开头的 "#", 统一为小写，去除重复并排序。
+func NormalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimLeft(strings.TrimSpace(tag), "#"))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > MaxTagLength {
+			return nil, errors.New("tag is too long: " + tag)
+		}
+		if !reTag.MatchString(tag) {
+			return nil, errors.New("invalid tag: " + tag)
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+	if len(result) > MaxTags {
+		return nil, errors.New("too many tags")
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// HashTags 返回 text 里的全部 #标签 (未经 NormalizeTags 处理)。
+func HashTags(text string) (tags []string) {
+	for _, match := range reHashTag.FindAllStringSubmatch(text, -1) {
+		tags = append(tags, match[1])
+	}
+	return
+}
+
+// AddTags 返回 tags 与 more 的并集，不修改 tags.
+func AddTags(tags, more []string) ([]string, error) {
+	all := append(append([]string{}, tags...), more...)
+	return NormalizeTags(all)
+}
+
+// RemoveTags 返回 tags 去除 remove 之后的结果，不修改 tags.
+func RemoveTags(tags, remove []string) []string {
+	result := []string{}
+	for _, tag := range tags {
+		if !HasTag(remove, tag) {
+			result = append(result, tag)
+		}
+	}
+	return result
+}
+
+// HasTag 判断 tags 里是否有 tag. tags 应该已经过 NormalizeTags 处理。
+func HasTag(tags []string, tag string) bool {
+	tag = strings.ToLower(strings.TrimLeft(tag, "#"))
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
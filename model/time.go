@@ -0,0 +1,129 @@
+package model
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// TimeNow 返回当前时间 (ISO8601).
+func TimeNow() string {
+	return FormatTime(time.Now())
+}
+
+// FormatTime 把 t 转换为 UTC 并按 ISO8601 格式化。
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(ISO8601)
+}
+
+// ParseTime 解析 ISO8601 或其它 RFC 3339 时间。
+// 旧版本的时间 (见 legacyISO8601) 按服务器的本地时间解析。
+func ParseTime(s string) (time.Time, error) {
+	if IsLegacyTime(s) {
+		return time.ParseInLocation(legacyISO8601, s, time.Local)
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// IsLegacyTime 判断 s 是否旧版本的时间格式。现在的时间总是以 "Z" 结尾。
+func IsLegacyTime(s string) bool {
+	return strings.HasSuffix(s, "+00:00")
+}
+
+// UpgradeTime 把旧版本的时间转换为 ISO8601, 返回值 ok 表示是否有改变。空字符串保持不变。
+func UpgradeTime(s string) (upgraded string, ok bool, err error) {
+	if !IsLegacyTime(s) {
+		return s, false, nil
+	}
+	t, err := ParseTime(s)
+	if err != nil {
+		return s, false, err
+	}
+	return FormatTime(t), true, nil
+}
+
+// 日期按服务器的本地时间解析，next 返回下一个日期 (或月、年) 的开始时间。
+var dateLayouts = []struct {
+	layout string
+	next   func(t time.Time) time.Time
+}{
+	{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+}
+
+// TimeRange 把筛选条件 from, to 转换为 ISO8601 的区间 [start, end), 空字符串表示不限。
+// from, to 可以是日期 (例如 2020-12-01, 也可以是 2020-12 或 2020, 按服务器的时区)
+// 或 RFC 3339 时间，to 包括当天 (或当月、当年、当时)。
+func TimeRange(from, to string) (start, end string, err error) {
+	if from != "" {
+		t, _, err := parseDateOrTime(from)
+		if err != nil {
+			return "", "", err
+		}
+		start = FormatTime(t)
+	}
+	if to != "" {
+		_, next, err := parseDateOrTime(to)
+		if err != nil {
+			return "", "", err
+		}
+		end = FormatTime(next)
+	}
+	return start, end, nil
+}
+
+// parseDateOrTime 返回 s 表示的时间段的开始时间与结束时间 (不包括在内)。
+// 时间只精确到毫秒，因此 RFC 3339 时间的结束时间是 1 毫秒之后。
+func parseDateOrTime(s string) (t, next time.Time, err error) {
+	for _, date := range dateLayouts {
+		if t, err := time.ParseInLocation(date.layout, s, time.Local); err == nil {
+			return t, date.next(t), nil
+		}
+	}
+	if t, err = time.Parse(time.RFC3339, s); err != nil {
+		return t, t, errors.New("invalid date or time: " + s)
+	}
+	t = t.Truncate(time.Millisecond)
+	return t, t.Add(time.Millisecond), nil
+}
+
+// InTimeRange 判断 ISO8601 时间 t 是否在 TimeRange 返回的区间 [start, end) 之内。
+func InTimeRange(t, start, end string) bool {
+	if start != "" && t < start {
+		return false
+	}
+	if end != "" && t >= end {
+		return false
+	}
+	return true
+}
+
+// upgradeTimes 把 times 里旧版本的时间转换为 ISO8601, 返回值表示是否有改变。
+func upgradeTimes(times ...*string) (changed bool, err error) {
+	for _, t := range times {
+		upgraded, ok, err := UpgradeTime(*t)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			*t, changed = upgraded, true
+		}
+	}
+	return changed, nil
+}
+
+// UpgradeTimes 把旧版本的时间转换为 ISO8601, 返回值表示是否有改变。
+func (message *Message) UpgradeTimes() (bool, error) {
+	return upgradeTimes(&message.CreatedAt, &message.UpdatedAt, &message.DeletedAt, &message.ExpiresAt)
+}
+
+// UpgradeTimes 把旧版本的时间转换为 ISO8601, 返回值表示是否有改变。
+func (clip *ClipText) UpgradeTimes() (bool, error) {
+	return upgradeTimes(&clip.CreatedAt, &clip.UpdatedAt, &clip.DeletedAt)
+}
+
+// UpgradeTimes 把旧版本的时间转换为 ISO8601, 返回值表示是否有改变。
+func (job *Job) UpgradeTimes() (bool, error) {
+	return upgradeTimes(&job.RunAt, &job.CreatedAt, &job.UpdatedAt)
+}
@@ -0,0 +1,185 @@
+// Package preview 读取网页的标题、描述、站点名称、图标与 Open Graph 图片，用于书签。
+// 只解析 html 的 head 部分，结果都是纯文本。网页由 package fetcher 获取。
+package preview // import "github.com/ahui2016/go-send/preview"
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/url"
+	"strings"
+
+	"github.com/ahui2016/go-send/fetcher"
+	"github.com/ahui2016/go-send/model"
+	"golang.org/x/net/html"
+)
+
+const (
+	// maxPageSize 是最多读取的网页体积，head 一般都在开头部分。
+	maxPageSize = 512 * 1024
+
+	// MaxImageSize 是 og:image 的最大体积。
+	MaxImageSize = 5 * 1024 * 1024
+
+	// 各个字段的最大长度 (字数)，更长的部分被截断。
+	maxTitleLength       = 300
+	maxDescriptionLength = 1000
+	maxSiteNameLength    = 100
+)
+
+// ErrNotHTML 表示网址的内容不是网页，例如图片或 pdf.
+var ErrNotHTML = errors.New("the url is not an html page")
+
+// Fetch 用 f 获取网页 addr 并解析其 head. 网页没有标题时 Title 为空。
+func Fetch(f *fetcher.Fetcher, addr string) (*model.LinkPreview, error) {
+	res, err := f.Get(addr, "text/html,application/xhtml+xml", maxPageSize)
+	if err != nil {
+		return nil, err
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.ContentType)
+	if mediaType != "" && mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, ErrNotHTML
+	}
+	page, err := res.UTF8()
+	if err != nil {
+		return nil, err
+	}
+	link := Parse(bytes.NewReader(page), res.URL)
+	link.URL = addr
+	return link, nil
+}
+
+// FetchImage 用 f 下载图片 addr (例如 og:image), 超过 MaxImageSize 时返回错误。
+func FetchImage(f *fetcher.Fetcher, addr string) ([]byte, error) {
+	res, err := f.Get(addr, "image/*", MaxImageSize)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(res.ContentType, "image/") {
+		return nil, errors.New("not an image: " + addr)
+	}
+	if res.Truncated {
+		return nil, errors.New("the image is too large: " + addr)
+	}
+	return res.Body, nil
+}
+
+// Parse 解析网页的 head 部分，遇到 body 或 </head> 时停止。
+// base 是网页的网址，用来把图标与图片的相对网址转换为绝对网址。
+// 标题优先使用 <title>, 描述优先使用 <meta name="description">, 没有时使用 Open Graph 的值。
+func Parse(r io.Reader, base *url.URL) *model.LinkPreview {
+	var title, ogTitle, description, ogDescription string
+	link := new(model.LinkPreview)
+	z := html.NewTokenizer(r)
+loop:
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		token := z.Token()
+		if tt == html.EndTagToken && token.Data == "head" {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		switch token.Data {
+		case "body":
+			break loop
+		case "title":
+			if title == "" && z.Next() == html.TextToken {
+				title = string(z.Text())
+			}
+		case "meta":
+			key := strings.ToLower(attr(token, "property"))
+			if key == "" {
+				key = strings.ToLower(attr(token, "name"))
+			}
+			content := attr(token, "content")
+			switch key {
+			case "og:title":
+				ogTitle = content
+			case "description":
+				description = content
+			case "og:description":
+				ogDescription = content
+			case "og:site_name":
+				link.SiteName = content
+			case "og:image", "og:image:url", "og:image:secure_url":
+				if link.Image == "" {
+					link.Image = resolve(base, content)
+				}
+			}
+		case "link":
+			if link.Favicon == "" && isIconRel(attr(token, "rel")) {
+				link.Favicon = resolve(base, attr(token, "href"))
+			}
+		}
+	}
+
+	link.Title = clean(firstNonEmpty(title, ogTitle), maxTitleLength)
+	link.Description = clean(firstNonEmpty(description, ogDescription), maxDescriptionLength)
+	link.SiteName = clean(link.SiteName, maxSiteNameLength)
+	if link.Favicon == "" && base != nil {
+		link.Favicon = resolve(base, "/favicon.ico")
+	}
+	return link
+}
+
+func attr(token html.Token, key string) string {
+	for _, a := range token.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// isIconRel 判断 <link> 的 rel 是否为图标，例如 "icon" 或 "shortcut icon".
+func isIconRel(rel string) bool {
+	for _, v := range strings.Fields(strings.ToLower(rel)) {
+		if v == "icon" {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve 返回 ref 相对于 base 的绝对网址，只接受 http 与 https, 否则返回空字符串。
+func resolve(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ""
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return u.String()
+}
+
+// clean 合并连续的空白 (有的网站在标题里加换行符), 去除无效的字符，并截断为最多 n 个字。
+func clean(s string, n int) string {
+	s = strings.Join(strings.Fields(strings.ToValidUTF8(s, "")), " ")
+	if runes := []rune(s); len(runes) > n {
+		s = string(runes[:n]) + "…"
+	}
+	return s
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
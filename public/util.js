@@ -1,8 +1,5 @@
 const thumbWidth = 128, thumbHeight = 128;
 
-// 文件保质期 (变灰时间), 该值应等于后端的 database.turnGrey
-const TurnGrey = { n: 15, unit: 'days' };
-
 // 向服务器提交表单，在等待过程中 btn 会失效，避免重复提交。
 function ajaxPost(form, url, btn, onload, onloadend) {
   if (btn) {
@@ -137,6 +134,11 @@ function fileURL(id) {
   return '/files/' + id + '.send';
 }
 
+// 下载文件的url, 下载时使用原文件名。
+function downloadURL(id) {
+  return '/api/download/' + id;
+}
+
 // 带时间的url, 用于刷新文件。
 function urlWithDate(originURL) {
   let d = new Date();
@@ -0,0 +1,156 @@
+// Package search 把文本拆分为全文检索用的词 (token), 并生成带高亮的摘要。
+//
+// 拉丁字母、数字等按单词拆分，统一为小写。中日韩文字没有空格分词，因此拆分为
+// 重叠的两字词 (bigram), 例如 “会议记录” 拆分为 “会议”, “议记”, “记录”,
+// 索引时另外保留单字，以便搜索单个字。
+package search // import "github.com/ahui2016/go-send/search"
+
+import (
+	"html"
+	"strings"
+	"unicode"
+)
+
+// MaxTokenLength 是单词的最大长度 (字节)，更长的单词 (例如 base64) 被截断。
+const MaxTokenLength = 64
+
+// Tokens 返回 text 里的全部词 (包括重复的词)，用于建立索引。
+func Tokens(text string) []string {
+	return split(text, true)
+}
+
+// QueryTokens 返回搜索语句里的词 (不重复)。中日韩文字只在单独一个字时才使用单字。
+func QueryTokens(query string) (tokens []string) {
+	seen := make(map[string]bool)
+	for _, token := range split(query, false) {
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	return
+}
+
+// IsCJK 判断 r 是否为中日韩文字。
+func IsCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+func isWordRune(r rune) bool {
+	return (unicode.IsLetter(r) || unicode.IsDigit(r)) && !IsCJK(r)
+}
+
+// split 拆分 text. unigrams 为 true 时，中日韩文字除了两字词以外还保留每一个单字。
+func split(text string, unigrams bool) (tokens []string) {
+	var word []rune
+	var cjk []rune
+	flushWord := func() {
+		if len(word) > 0 {
+			token := string(word)
+			if len(token) > MaxTokenLength {
+				token = strings.ToValidUTF8(token[:MaxTokenLength], "")
+			}
+			tokens = append(tokens, token)
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		for i := range cjk {
+			if unigrams || len(cjk) == 1 {
+				tokens = append(tokens, string(cjk[i]))
+			}
+			if i+1 < len(cjk) {
+				tokens = append(tokens, string(cjk[i:i+2]))
+			}
+		}
+		cjk = cjk[:0]
+	}
+	for _, r := range text {
+		r = unicode.ToLower(r)
+		switch {
+		case IsCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case isWordRune(r):
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return
+}
+
+// Snippet 从 text 里截取包含 tokens 的一段 (最多 width 个字)，转义为 html,
+// 并用 <mark> 标记匹配的部分 (不区分大小写)。找不到匹配时返回开头的一段。
+func Snippet(text string, tokens []string, width int) string {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	marked := make([]bool, len(runes))
+	first := -1
+	for _, token := range tokens {
+		t := []rune(token)
+		for i := 0; i+len(t) <= len(lower); i++ {
+			if !hasRunes(lower[i:], t) {
+				continue
+			}
+			for j := i; j < i+len(t); j++ {
+				marked[j] = true
+			}
+			if first < 0 || i < first {
+				first = i
+			}
+		}
+	}
+
+	start := 0
+	if first > width/3 {
+		start = first - width/3
+	}
+	end := start + width
+	if end > len(runes) {
+		end = len(runes)
+		if start = end - width; start < 0 {
+			start = 0
+		}
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := start; i < end; {
+		j := i
+		for j < end && marked[j] == marked[i] {
+			j++
+		}
+		part := html.EscapeString(string(runes[i:j]))
+		if marked[i] {
+			part = "<mark>" + part + "</mark>"
+		}
+		b.WriteString(part)
+		i = j
+	}
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+func hasRunes(s, prefix []rune) bool {
+	if len(s) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if s[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,425 @@
+package main
+
+// 定期快照。与 -export 不同，快照不打包，而是在 SnapshotDir 里为每次快照建立一个文件夹：
+//   gosend.db       数据库快照 (在一个只读事务里复制，不需要停止服务)
+//   config, keyring 与备份 (backup.go) 相同
+//   files/<name>    文件与缩略图，尽量使用硬链接 (增量)，不占用额外空间
+//   snapshot.json   本次快照的结果
+// 文件写入后不会被修改 (只会被整个替换或删除)，因此硬链接的内容不会改变。
+// 快照先写入 <name>.tmp, 完成后才改名，因此不完整的快照不会被当作最新快照。
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ahui2016/go-send/model"
+	"github.com/ahui2016/go-send/storage"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	snapshotNameLayout = "20060102-150405"
+	snapshotReportName = "snapshot.json"
+)
+
+// snapshotReport 是一次快照的结果。
+type snapshotReport struct {
+	Name      string // 快照文件夹的名称，同时也是快照的时间
+	StartedAt string // ISO8601
+	Duration  string
+	Encrypted bool
+	Files     int      // 文件与缩略图的数量
+	Linked    int      // 其中使用硬链接的数量
+	Copied    int      // 其中复制的数量
+	Missing   []string // 列出之后、复制之前被删除的文件
+
+	// MissingIDs 是 Missing 对应的条目的 ID. 这些条目在快照期间被删除，快照的数据库里仍有记录，
+	// 恢复快照后应执行 fsck -repair 删除它们 (或重新生成缩略图)。
+	MissingIDs []string `json:",omitempty"`
+
+	Removed []string // 轮换时删除的旧快照
+	Error   string
+
+	start time.Time
+}
+
+var (
+	// snapshotMutex 保证同一时间只有一个快照在进行。
+	snapshotMutex sync.Mutex
+
+	snapshotReportMutex sync.Mutex
+	lastSnapshotReport  *snapshotReport
+)
+
+// startSnapshots 在 SnapshotDir 不为空时启动定期快照。如果最新快照已超过一个间隔 (或者没有快照),
+// 就立即快照一次，因此重启服务不会产生多余的快照。返回的函数用来停止，它会等待正在进行的快照完成。
+func startSnapshots() (stop func()) {
+	if config.SnapshotDir == "" {
+		return func() {}
+	}
+	interval := snapshotInterval()
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		wait := time.Duration(0)
+		if names, _ := listSnapshots(); len(names) > 0 {
+			if age := snapshotAge(names[0]); age < interval {
+				wait = interval - age
+			}
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-timer.C:
+			}
+			runSnapshot()
+			timer.Reset(interval)
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// runSnapshot 快照一次并轮换旧快照，把结果写入日志和 lastSnapshotReport.
+func runSnapshot() *snapshotReport {
+	snapshotMutex.Lock()
+	defer snapshotMutex.Unlock()
+
+	start := time.Now()
+	report := &snapshotReport{
+		Name:      start.Format(snapshotNameLayout),
+		StartedAt: model.TimeNow(),
+		Encrypted: config.Encrypt,
+		start:     start,
+	}
+	err := takeSnapshot(report)
+	if err == nil {
+		report.Removed, err = rotateSnapshots(config.SnapshotKeep, config.SnapshotKeepDaily)
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	report.Duration = time.Since(start).String()
+	log.Printf("snapshot %s: %d files (%d linked, %d copied), %d missing, removed %d old snapshots",
+		report.Name, report.Files, report.Linked, report.Copied, len(report.Missing), len(report.Removed))
+	if len(report.MissingIDs) > 0 {
+		log.Printf("snapshot %s: items %s were deleted during the snapshot, "+
+			"run -fsck -repair after restoring it", report.Name, strings.Join(report.MissingIDs, ", "))
+	}
+	if report.Error != "" {
+		log.Print("snapshot: ", report.Error)
+	}
+	snapshotReportMutex.Lock()
+	lastSnapshotReport = report
+	snapshotReportMutex.Unlock()
+	return report
+}
+
+// takeSnapshot 只在复制数据库快照、列出文件以及为本地文件建立硬链接时持有 filesMutex，
+// 以保证三者一致。其余的文件 (例如 S3 或不在同一个分区) 在释放锁之后复制，期间被删除的文件
+// 记录在 Missing 与 MissingIDs 里。
+func takeSnapshot(report *snapshotReport) error {
+	if err := os.MkdirAll(config.SnapshotDir, 0700); err != nil {
+		return err
+	}
+	removeIncompleteSnapshots()
+
+	target := filepath.Join(config.SnapshotDir, report.Name)
+	if _, err := os.Stat(target); err == nil {
+		return errors.New("snapshot " + report.Name + " already exists")
+	}
+	tempDir := target + tempFileExt
+	if err := os.MkdirAll(filepath.Join(tempDir, filesFolderName), 0700); err != nil {
+		return err
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			_ = os.RemoveAll(tempDir)
+		}
+	}()
+
+	files, err := snapshotDatabase(tempDir, report)
+	if err != nil {
+		return err
+	}
+	configJSON, err := backupConfig()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tempDir, configFileName), configJSON, 0600); err != nil {
+		return err
+	}
+	if config.Encrypt {
+		if err := copyFile(filepath.Join(tempDir, keyringFileName), keyringPath); err != nil {
+			return err
+		}
+	}
+
+	previous := ""
+	if names, err := listSnapshots(); err == nil && len(names) > 0 {
+		previous = filepath.Join(config.SnapshotDir, names[0], filesFolderName)
+	}
+	for _, info := range files {
+		linked, err := snapshotFile(filepath.Join(tempDir, filesFolderName), previous, info)
+		if err == storage.ErrNotFound {
+			report.addMissing(info.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		report.addFile(linked)
+	}
+
+	report.Duration = time.Since(report.start).String()
+	reportJSON, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tempDir, snapshotReportName), reportJSON, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tempDir, target); err != nil {
+		return err
+	}
+	ok = true
+	return nil
+}
+
+// snapshotDatabase 把数据库快照写入 tempDir, 同时列出全部文件与缩略图，并为本地存储的文件
+// 建立硬链接 (很快，因此在持有 filesMutex 时完成)，返回其余需要复制的文件。
+func snapshotDatabase(tempDir string, report *snapshotReport) (rest []storage.Info, err error) {
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(tempDir, databaseFileName), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Snapshot(file)
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return nil, err
+	}
+	all, err := rawStore().List()
+	if err != nil {
+		return nil, err
+	}
+	local, isLocal := rawStore().(*storage.Local)
+	for _, info := range all {
+		if !isBlobName(info.Name) {
+			continue
+		}
+		if isLocal {
+			err := os.Link(filepath.Join(local.Dir, info.Name), filepath.Join(tempDir, filesFolderName, info.Name))
+			if err == nil {
+				report.addFile(true)
+				continue
+			}
+		}
+		rest = append(rest, info)
+	}
+	return rest, nil
+}
+
+// snapshotFile 把 info 复制到 dir. 如果上一个快照 (previous) 里有大小与时间都相同的文件，
+// 就使用硬链接，否则才真正复制。
+func snapshotFile(dir, previous string, info storage.Info) (linked bool, err error) {
+	target := filepath.Join(dir, info.Name)
+	if previous != "" {
+		old := filepath.Join(previous, info.Name)
+		if stat, err := os.Stat(old); err == nil &&
+			stat.Size() == info.Size && stat.ModTime().Equal(info.ModTime) {
+			if err := os.Link(old, target); err == nil {
+				return true, nil
+			}
+		}
+	}
+
+	r, err := rawStore().Get(info.Name, 0, -1)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(file, r)
+	if err2 := file.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return false, err
+	}
+	// 保留原文件的时间，下一次快照才能判断能否使用硬链接。
+	return false, os.Chtimes(target, info.ModTime, info.ModTime)
+}
+
+func (report *snapshotReport) addFile(linked bool) {
+	report.Files++
+	if linked {
+		report.Linked++
+	} else {
+		report.Copied++
+	}
+}
+
+// addMissing 记录复制之前被删除的文件及其条目的 ID.
+func (report *snapshotReport) addMissing(name string) {
+	report.Missing = append(report.Missing, name)
+	id := strings.TrimSuffix(name, filepath.Ext(name))
+	for _, v := range report.MissingIDs {
+		if v == id {
+			return
+		}
+	}
+	report.MissingIDs = append(report.MissingIDs, id)
+}
+
+func copyFile(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// listSnapshots 返回全部完整的快照的名称，最新的排在最前。
+func listSnapshots() (names []string, err error) {
+	entries, err := ioutil.ReadDir(config.SnapshotDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := time.ParseInLocation(snapshotNameLayout, entry.Name(), time.Local); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names, nil
+}
+
+// removeIncompleteSnapshots 删除上次中断而留下的 .tmp 文件夹。
+func removeIncompleteSnapshots() {
+	entries, err := ioutil.ReadDir(config.SnapshotDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasSuffix(entry.Name(), tempFileExt) {
+			_ = os.RemoveAll(filepath.Join(config.SnapshotDir, entry.Name()))
+		}
+	}
+}
+
+// rotateSnapshots 保留最新的 keep 个快照，以及最近 keepDaily 个有快照的日子里每天最后一个快照，
+// 删除其余的快照。硬链接的文件在全部引用它的快照都被删除后才会真正删除。
+func rotateSnapshots(keep, keepDaily int) (removed []string, err error) {
+	names, err := listSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	days := make(map[string]bool)
+	for i, name := range names {
+		day := name[:8] // 20060102
+		if i < keep {
+			days[day] = true
+			continue
+		}
+		if !days[day] && len(days) < keepDaily {
+			days[day] = true
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(config.SnapshotDir, name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
+
+func snapshotAge(name string) time.Duration {
+	t, err := time.ParseInLocation(snapshotNameLayout, name, time.Local)
+	if err != nil {
+		return 0
+	}
+	return time.Since(t)
+}
+
+// snapshotsHandler 返回快照的状态。stale 为 true 表示最新快照已超过两个间隔，定期快照可能已停止。
+func snapshotsHandler(c *fiber.Ctx) error {
+	if config.SnapshotDir == "" {
+		return c.JSON(fiber.Map{"enabled": false})
+	}
+	names, err := listSnapshots()
+	if err != nil {
+		return err
+	}
+	snapshotReportMutex.Lock()
+	report := lastSnapshotReport
+	snapshotReportMutex.Unlock()
+
+	result := fiber.Map{
+		"enabled":    true,
+		"dir":        config.SnapshotDir,
+		"interval":   snapshotInterval().String(),
+		"keep":       config.SnapshotKeep,
+		"keepDaily":  config.SnapshotKeepDaily,
+		"snapshots":  names,
+		"stale":      true,
+		"lastReport": report,
+	}
+	if len(names) > 0 {
+		age := snapshotAge(names[0])
+		result["latest"] = names[0]
+		result["latestAge"] = age.Round(time.Second).String()
+		result["stale"] = age > 2*snapshotInterval()
+	}
+	return c.JSON(result)
+}
+
+// takeSnapshotHandler 立即快照一次。
+func takeSnapshotHandler(c *fiber.Ctx) error {
+	if config.SnapshotDir == "" {
+		return jsonError(c, "SnapshotDir is not set in the config", 400)
+	}
+	report := runSnapshot()
+	if report.Error != "" {
+		return jsonError(c, report.Error, 500)
+	}
+	return c.JSON(report)
+}
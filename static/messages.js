@@ -8,40 +8,88 @@ const page = $('#page-name').text();
 
 initData();
 
+// 分页加载时每页的条目数量。
+const pageSize = 100;
+
 function initData() {
   let url;
   if (page == 'Messages') url = '/api/all';
   if (page == 'Clips') url = '/api/all-clips';
   if (page == 'Bookmarks') url = '/api/all-bookmarks';
+  if (page == 'Trash') url = '/api/trash';
+
+  // 参数 tag 表示只显示带有该标签的条目。
+  const params = new URLSearchParams();
+  const tag = new URLSearchParams(window.location.search).get('tag');
+  if (tag && page != 'Trash') {
+    params.set('tag', tag);
+    $('#page-name').text(page + ' #' + tag);
+  }
 
   // 初始化本页面的说明。
   $('#about-page-icon').tooltip().click(() => {
     $('#about-page-alert').toggle();
   });
 
-  ajaxGet(url, null, function () {
+  if (page == 'Search') {
+    initSearch();
+    return;
+  }
+
+  if (page == 'Trash') {
+    ajaxGet(url, null, function () {
+          if (this.status == 200) {
+            insertMessages(this.response);
+          } else {
+            insertErrorAlert(!this.response ? this.status : this.response.message);
+          }
+        },
+        function () {
+          $('#loading-spinner').hide();
+        });
+    return;
+  }
+
+  // 剪贴板文本没有固定功能。其它页面先加载全部固定的条目 (排在最上面)，再分页加载其余条目。
+  if (page == 'Clips') {
+    loadPage(url, params);
+    return;
+  }
+  params.set('pinned', '1');
+  ajaxGet(url + '?' + params, null, function () {
+    if (this.status != 200) {
+      $('#loading-spinner').hide();
+      insertErrorAlert(!this.response ? this.status : this.response.message);
+      return;
+    }
+    insertMessages(this.response);
+    params.set('pinned', '0');
+    loadPage(url, params);
+  });
+}
+
+// loadPage 加载一页条目，插在已有条目的下面。还有下一页时显示 "Load more" 按钮。
+function loadPage(url, params) {
+  params.set('limit', pageSize);
+  const loadMoreBtn = $('#load-more-btn');
+  ajaxGet(url + '?' + params, loadMoreBtn, function () {
         if (this.status == 200) {
+          insertMessages(this.response.items, true);
 
           // 只在 Messages 页面显示高级功能，并且条目数太少时不显示高级功能
-          if (page == 'Messages' && this.response.length >= 5) {
+          if (page == 'Messages' && $('#all-messages .MsgID').length >= 5) {
             $('#commands-form').show();
           }
 
-          this.response.forEach(message => {
-
-            // 两种类型的不同操作
-            let item;
-            if (message.Type == 'TextMsg') {
-              item = insertTextMsg(message);
-            } else if (message.Type == 'FileMsg') {
-              item = insertFileMsg(message);
-            } else {
-              insertErrorAlert('Unknown message type: ' + message.Type);
-            }
-
-            // 两种类型的相同操作
-            doAfterInsert(item, message);
-          });
+          loadMoreBtn.off('click');
+          if (this.response.nextCursor) {
+            loadMoreBtn.show().click(() => {
+              params.set('cursor', this.response.nextCursor);
+              loadPage(url, params);
+            });
+          } else {
+            loadMoreBtn.hide();
+          }
         } else {
           let errMsg = !this.response ? this.status : this.response.message;
           insertErrorAlert(errMsg);
@@ -52,6 +100,28 @@ function initData() {
       });
 }
 
+// insertMessages 插入多个条目。atBottom 为 true 时按顺序插在已有条目的下面，
+// 否则每个条目都插在最上面 (因此后面的条目会排在上面)。
+function insertMessages(messages, atBottom) {
+  messages.forEach(message => {
+
+    // 两种类型的不同操作
+    let item;
+    if (message.Type == 'TextMsg') {
+      item = insertTextMsg(message);
+    } else if (message.Type == 'FileMsg') {
+      item = insertFileMsg(message);
+    } else {
+      insertErrorAlert('Unknown message type: ' + message.Type);
+      return;
+    }
+
+    // 两种类型的相同操作
+    doAfterInsert(item, message);
+    if (atBottom) item.appendTo('#all-messages');
+  });
+}
+
 // 两种类型的相同操作
 function doAfterInsert(item, message) {
 
@@ -67,16 +137,92 @@ function doAfterInsert(item, message) {
   item.find('.Icon').tooltip();
 
   // 如果当前时间超过保质期（当前时间在变灰时间之后），该卡片就会变灰。变灰表示已过期，即将被自动删除。
-  let expired = dayjs(message.UpdatedAt).add(TurnGrey.n, TurnGrey.unit);
-  if (page == 'Messages' && dayjs().isAfter(expired)) {
+  // 变灰时间由后端计算 (TurnGreyAt), 因为保存时间可在 config 里设置，也可以为单个消息设置过期时间。
+  if (page == 'Messages' && message.TurnGreyAt && dayjs().isAfter(dayjs(message.TurnGreyAt))) {
     item.addClass('bg-light');
     item.find('.InfoIcon').show();
     if (message.Type == 'TextMsg') item.find('.CopyIcon').hide();
     if (message.Type == 'FileMsg') item.find('.DownloadIcon').hide();
   }
 
-  // 顶置按钮
+  // 回收站里的条目：上升按钮用来恢复，删除按钮用来永久删除，并显示永久删除的时间。
+  if (page == 'Trash') {
+    item.find('.PinIcon').hide();
+    item.find('.InfoIcon')
+        .attr('title', '将于 ' + dayjs(message.DeleteAt).format('YYYY-MM-DD HH:mm') + ' 永久删除')
+        .tooltip('dispose').tooltip().show();
+  }
+
+  // 后台任务 (缩略图、书签的网页信息) 的状态，详情见 /api/jobs.
+  if (message.Processing == 'pending') {
+    $('<span class="badge badge-secondary ml-1"></span>').text('处理中')
+        .attr('title', '正在后台生成缩略图或获取网页信息，刷新页面查看结果')
+        .appendTo(item.find('.card-subtitle').first());
+  } else if (message.Processing == 'failed') {
+    $('<span class="badge badge-warning ml-1"></span>').text('处理失败')
+        .attr('title', '图片有问题，或者无法获取网页信息，详情见 /api/jobs')
+        .appendTo(item.find('.card-subtitle').first());
+  }
+
+  // 标签，点击标签只显示带有该标签的条目。
+  showTags(item, message.Tags);
+  const tagButton = item.find('.TagIcon');
+  if (page == 'Trash') tagButton.hide();
+  tagButton.click(() => {
+    const oldTags = message.Tags || [];
+    const input = window.prompt('标签 (以空格分隔)', oldTags.join(' '));
+    if (input === null) return;
+    const tags = input.split(/[\s,，]+/).map(t => t.replace(/^#+/, '').toLowerCase()).filter(t => t);
+    const added = tags.filter(t => !oldTags.includes(t));
+    const removed = oldTags.filter(t => !tags.includes(t));
+
+    // 先删除再添加，每一步都用返回的条目更新 message.Tags.
+    const kind = page == 'Clips' ? 'clip-tags' : 'tags';
+    const postTags = (action, list, next) => {
+      if (list.length == 0) return next();
+      let form = new FormData();
+      form.append('id', message.ID);
+      form.append('tags', list.join(' '));
+      ajaxPost(form, `/api/${action}-${kind}`, null, function () {
+        if (this.status == 200) {
+          message.Tags = this.response.Tags;
+          next();
+        } else {
+          let errMsg = !this.response ? this.status : this.response.message;
+          insertErrorAlert(errMsg, '#' + itemID);
+        }
+      });
+    };
+    postTags('remove', removed, () => postTags('add', added, () => showTags(item, message.Tags)));
+  });
+
+  // 固定按钮，固定的条目永不过期，也不会被批量删除。
+  const pinButton = item.find('.PinIcon');
+  setPinIcon(pinButton, message.Pinned);
+  pinButton.click(() => {
+    let form = new FormData();
+    form.append('id', message.ID);
+    let url = message.Pinned ? '/api/unpin' : '/api/pin';
+    ajaxPost(form, url, null, function () {
+      if (this.status == 200) {
+        message.Pinned = !message.Pinned;
+        setPinIcon(pinButton, message.Pinned);
+        if (message.Pinned) {
+          item.removeClass('bg-light');
+          item.find('.InfoIcon').hide();
+          if (message.Type == 'TextMsg') item.find('.CopyIcon').show();
+          if (message.Type == 'FileMsg') item.find('.DownloadIcon').show();
+        }
+      } else {
+        let errMsg = !this.response ? this.status : this.response.message;
+        insertErrorAlert(errMsg, '#' + itemID);
+      }
+    });
+  });
+
+  // 顶置按钮 (在回收站里是恢复按钮)
   let up_button = item.find('.UpIcon');
+  if (page == 'Trash') up_button.attr('title', 'restore').tooltip('dispose').tooltip();
   up_button.click(() => {
     let form = new FormData();
     form.append('id', message.ID);
@@ -84,8 +230,15 @@ function doAfterInsert(item, message) {
 
     let url = '/api/update-datetime';
     if (page == 'Clips') url = '/api/update-clip-datetime';
+    if (page == 'Trash') url = '/api/restore';
     ajaxPost(form, url, null, function () {
-          if (this.status == 200) {
+          if (this.status == 200 && page == 'Trash') {
+            up_button.tooltip('hide');
+            item.hide('slow', function () {
+              insertInfoAlert('id: ' + simple_id + ' is restored', '#' + itemID);
+              item.remove();
+            });
+          } else if (this.status == 200) {
             up_button.tooltip('hide');
             $('html').animate({scrollTop: 0}, 50);
             item.removeClass('bg-light');
@@ -108,8 +261,8 @@ function doAfterInsert(item, message) {
   const delete_button = item.find('.DeleteIcon');
   const yesButton = $('#yes-button');
 
-  // 如果是 TextMsg, 则不弹出对话框
-  if (message.Type == 'TextMsg') {
+  // 如果是 TextMsg, 则不弹出对话框 (删除后可以在回收站恢复)，但在回收站里是永久删除，需要确认。
+  if (message.Type == 'TextMsg' && page != 'Trash') {
     delete_button.click(event => {
       delete_button.tooltip('hide');
       doDelete(event, function () {
@@ -136,6 +289,9 @@ function doAfterInsert(item, message) {
       $('#confirm-question').text('Delete this file?');
       $('#filesize-in-modal').text('(' + fileSizeToString(message.FileSize) + ')');
     }
+    if (page == 'Trash') {
+      $('#confirm-question').text('Delete forever? This cannot be undone.');
+    }
 
     // 确认删除
     yesButton.off().click(e => doDelete(e, function () {
@@ -156,25 +312,95 @@ function doAfterInsert(item, message) {
     if (page == 'Clips') url = '/api/delete-clip';
     let form = new FormData();
     form.append('id', message.ID);
+    if (page == 'Trash') form.append('forever', '1');
     ajaxPost(form, url, yesButton, onload, function () {
       $('#delete-dialog').modal('hide');
     });
   }
 }
 
+// initSearch 初始化搜索页面，参数 q 与 type 可以放在网址里。
+function initSearch() {
+  const params = new URLSearchParams(window.location.search);
+  $('#search-input').val(params.get('q') || '');
+  $('#search-type').val(params.get('type') || '');
+
+  $('#search-form').submit(event => {
+    event.preventDefault();
+    const q = $('#search-input').val().trim();
+    if (!q) return;
+    let url = '/api/search?q=' + encodeURIComponent(q);
+    const type = $('#search-type').val();
+    if (type) url += '&type=' + type;
+
+    ajaxGet(url, $('#search-btn'), function () {
+      if (this.status == 200) {
+        $('.SearchResult').remove();
+        $('#search-count').text(this.response.length + ' 个结果');
+        // 每个卡片都插在最前面，因此倒序插入，相关度最高的才会在最上面。
+        this.response.slice().reverse().forEach(result => insertSearchResult(result));
+      } else {
+        let errMsg = !this.response ? this.status : this.response.message;
+        insertErrorAlert(errMsg);
+      }
+    });
+  });
+  if ($('#search-input').val()) $('#search-form').submit();
+}
+
+// insertSearchResult 插入一个搜索结果。文本消息与剪贴板文本显示摘要，
+// 摘要是后端转义过的 html, 只有 <mark> 标签。
+function insertSearchResult(result) {
+  let item;
+  if (result.Clip) {
+    // 剪贴板文本的 ID 可能与消息的 ID 相同，因此加上前缀。
+    item = insertTextMsg(Object.assign({}, result.Clip, {ID: 'clip-' + result.Clip.ID}));
+    item.attr('id', 'item-clip-' + result.Clip.ID);
+    item.find('.MsgID').text(simpleID(result.Clip.ID));
+    $('<span class="badge badge-info ml-1"></span>').text('clip').appendTo(item.find('.card-subtitle'));
+    item.find('.Icon').tooltip();
+    showTags(item, result.Clip.Tags);
+    item.find('.card-text').html(result.Snippet);
+  } else {
+    const message = result.Message;
+    item = message.Type == 'FileMsg' ? insertFileMsg(message) : insertTextMsg(message);
+    doAfterInsert(item, message);
+    if (message.Type == 'TextMsg' && message.FileType != 'gosend/anchor' && !message.Encrypted) {
+      item.find('.card-text').html(result.Snippet);
+    }
+  }
+  item.addClass('SearchResult');
+}
+
+// showTags 在卡片的 id 下方显示标签，用 text() 插入，不解析 html.
+function showTags(item, tags) {
+  item.find('.Tags').remove();
+  if (!tags || tags.length == 0) return;
+  let tagsElem = $('<div class="Tags mb-2"></div>');
+  tags.forEach(tag => {
+    $('<a class="badge badge-light mr-1"></a>')
+        .text('#' + tag)
+        .attr('href', '?tag=' + encodeURIComponent(tag))
+        .appendTo(tagsElem);
+  });
+  tagsElem.insertAfter(item.find('.card-subtitle').first());
+}
+
 function insertTextMsg(message) {
   const item = $('#text-msg-tmpl').contents().clone();
   // 插入时，要么插在 #file-msg-tmpl 后面，要么插在 #text-msg-tmpl 前面。
   item.insertAfter('#file-msg-tmpl');
 
-  // 如果是 gosend/anchor 则插入 html
+  // 如果是 gosend/anchor 则显示网页信息
   let copyText;
   const cardText = item.find('.card-text');
-  if (message.FileType == 'gosend/anchor') {
-    cardText.html(message.TextMsg);
-    const anchor = cardText.find('a');
-    anchor.addClass('text-info').attr('target', '_blank');
-    copyText = anchor.attr('href');
+  if (message.Encrypted) {
+    // 端到端加密的消息只能由持有密钥的客户端解密，这里只显示提示，复制时复制密文。
+    cardText.text('[端到端加密的消息]').addClass('text-muted');
+    copyText = message.TextMsg;
+  } else if (message.FileType == 'gosend/anchor') {
+    showLinkPreview(cardText, message);
+    copyText = message.TextMsg;
   } else {
     cardText.text(message.TextMsg);
     copyText = message.TextMsg;
@@ -206,6 +432,49 @@ function insertTextMsg(message) {
   return item;
 }
 
+// showLinkPreview 显示书签的网页信息。全部用 text() 与 attr() 插入，不解析 html,
+// 并且网址只接受 http 与 https.
+function showLinkPreview(cardText, message) {
+  const link = message.Link || {URL: message.TextMsg};
+  const url = isHttpURL(link.URL) ? link.URL : '';
+
+  const title = $('<a class="text-info" target="_blank" rel="noopener noreferrer"></a>')
+      .text(link.Title || link.URL);
+  if (url) title.attr('href', url);
+  cardText.empty().append(title);
+
+  const site = $('<small class="d-block text-muted mt-1"></small>');
+  if (isHttpURL(link.Favicon)) {
+    $('<img class="mr-1" width="16" height="16" alt="" referrerpolicy="no-referrer">')
+        .on('error', event => $(event.currentTarget).remove())
+        .attr('src', link.Favicon)
+        .appendTo(site);
+  }
+  site.append(document.createTextNode(link.SiteName || hostname(url)));
+  cardText.append(site);
+
+  if (link.Description) {
+    $('<small class="d-block mt-1"></small>').text(link.Description).appendTo(cardText);
+  }
+  if (link.Thumbnail) {
+    $('<img class="img-thumbnail d-block mt-2" alt="" style="max-height: 200px;">')
+        .attr('src', thumbURL(message.ID))
+        .appendTo(cardText);
+  }
+}
+
+function isHttpURL(s) {
+  return /^https?:\/\//i.test(s || '');
+}
+
+function hostname(url) {
+  try {
+    return new URL(url).hostname;
+  } catch (e) {
+    return '';
+  }
+}
+
 function insertFileMsg(message) {
   let item = $('#file-msg-tmpl').contents().clone();
   // 插入时，要么插在 #file-msg-tmpl 后面，要么插在 #text-msg-tmpl 前面。
@@ -225,14 +494,25 @@ function insertFileMsg(message) {
   }
 
   item.find('.card-text').text(message.FileName);
+  if (message.Encrypted) {
+    item.find('.card-text').prepend('[端到端加密] ');
+  }
   item.find('.FileSize').text(fileSizeToString(message.FileSize));
   item.find('.DownloadButton')
-      .attr('href', fileURL(message.ID))
+      .attr('href', downloadURL(message.ID))
       .attr('download', message.FileName);
 
   return item;
 }
 
+function setPinIcon(pinButton, pinned) {
+  pinButton
+      .toggleClass('text-primary', !!pinned)
+      .tooltip('dispose')
+      .attr('title', pinned ? 'unpin' : 'pin')
+      .tooltip();
+}
+
 // simpleID 取正常 id 的最后三个字符作为简化 id, 方便人眼辨认。
 function simpleID(id) {
   let len = id.length;
@@ -276,17 +556,35 @@ commands.change(event => {
     case 'zip-all-files':
       commandHelp.text('打包全部文件，不包括文字备忘。打包后，压缩包会显示在列表顶部。下载后请尽快删除以节省空间。');
       break;
+    case 'search':
+      commandHelp.text('搜索文本消息、文件名、书签、剪贴板文本与标签。');
+      break;
+    case 'rebuild-search-index':
+      commandHelp.text('重建全文检索的索引。一般不需要，索引会自动更新，只在搜索结果明显不对时使用。');
+      break;
+    case 'trash':
+      commandHelp.text('查看回收站。删除的项目会先移到回收站，可以恢复，超过保存时间后自动永久删除。回收站里的文件仍然占用容量。');
+      break;
+    case 'empty-trash':
+      commandHelp.text('永久删除回收站里的全部项目，释放其占用的容量，不可恢复。');
+      break;
     case 'delete-all-files':
-      commandHelp.text('删除全部文件，保留删除文字备忘。删除后本页面会自动刷新，被删除的文件不可恢复。');
+      commandHelp.text('把全部文件移到回收站，保留文字备忘。删除后本页面会自动刷新。');
       break;
     case 'delete-10-files':
-      commandHelp.text('删除列表底部 10 个文件，保留文字备忘。如果在列表底部有不想删除的文件，可点击其 “上升” 按钮使其上升至列表顶部，但如果一共只有 10 个文件或更少，则全部文件都会被删除。');
+      commandHelp.text('把列表底部 10 个文件移到回收站，保留文字备忘。如果在列表底部有不想删除的文件，可点击其 “上升” 按钮使其上升至列表顶部，但如果一共只有 10 个文件或更少，则全部文件都会被删除。');
       break;
     case 'delete-10-items':
-      commandHelp.text('删除列表底部 10 项，包括文件和文字备忘，被删除的项目不可恢复。');
+      commandHelp.text('把列表底部 10 项移到回收站，包括文件和文字备忘。');
       break;
     case 'delete-grey-items':
-      commandHelp.text('删除已变灰的项目(过期项目)，若有不想删除的项目可点击 “上升” 按钮使其上升至列表顶部，被删除的项目不可恢复。');
+      commandHelp.text('把已变灰的项目(过期项目)移到回收站，若有不想删除的项目可点击 “上升” 按钮使其上升至列表顶部。');
+      break;
+    case 'fsck':
+      commandHelp.text('检查数据库与文件是否一致：没有记录的文件、文件丢失的记录、缺少的缩略图、checksum 是否正确、总体积是否准确。只检查，不修改。');
+      break;
+    case 'fsck-repair':
+      commandHelp.text('检查并修复：删除没有记录的文件与文件丢失的记录，补上缩略图与 checksum, 重新计算总体积。checksum 不正确的文件无法修复，只会报告。');
       break;
     default:
       commandHelp.text('');
@@ -308,6 +606,14 @@ executeBtn.click(event => {
     window.location = '/static/bookmarks.html';
     return;
   }
+  if (command == 'trash') {
+    window.location = '/static/trash.html';
+    return;
+  }
+  if (command == 'search') {
+    window.location = '/static/search.html';
+    return;
+  }
 
   let form = new FormData();
   form.append('command', command);
@@ -321,6 +627,16 @@ executeBtn.click(event => {
         doAfterInsert(item, message);
         return;
       }
+      // fsck 的结果
+      if (this.response && this.response.Summary) {
+        insertInfoAlert(this.response.Summary, $('#all-messages'));
+        return;
+      }
+      // 重建搜索索引等命令的结果
+      if (this.response && this.response.message) {
+        insertInfoAlert(this.response.message, $('#all-messages'));
+        return;
+      }
       executeBtn.prop('disabled', true);
       window.location.reload();
     } else {
@@ -331,6 +647,22 @@ executeBtn.click(event => {
   });
 });
 
+// 清空回收站 (只在回收站页面)
+$('#empty-trash-btn').click(event => {
+  event.preventDefault();
+  if (!window.confirm('永久删除回收站里的全部项目？')) return;
+  let form = new FormData();
+  form.append('command', 'empty-trash');
+  ajaxPostWithSpinner(form, '/api/execute-command', 'empty-trash', function () {
+    if (this.status == 200) {
+      window.location.reload();
+    } else {
+      let errMsg = !this.response ? this.status : this.response.message;
+      insertErrorAlert(errMsg);
+    }
+  });
+});
+
 $('.NavbarBtn').tooltip();
 
 msgInput.focus();
@@ -103,7 +103,11 @@ async function checkHashUpload(i) {
     form.append('hashHex', fileSha256);
 
     ajaxPost(form, '/api/checksum', $('#upload-btn'), function() {
-        if (this.status == 200) {
+        // 如果返回的是一个 Message, 说明文件已存在，服务器已更新其日期，不需要再上传。
+        if (this.status == 200 && this.response && this.response.ID) {
+            setCardSuccess(file.itemID, 'OK. 文件已存在，已移至顶部。');
+            uploadOneByOne(i);
+        } else if (this.status == 200) {
             uploadFile(fileSha256, i);
         } else {
             let errMsg = !this.response ? this.status : this.response.message;
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Local 把文件保存在本地文件夹 Dir 里。
+type Local struct {
+	Dir string
+}
+
+// NewLocal .
+func NewLocal(dir string) *Local {
+	return &Local{Dir: dir}
+}
+
+func (local *Local) path(name string) (string, error) {
+	if name == "" || filepath.Base(name) != name || name == "." || name == ".." {
+		return "", errors.New("storage: invalid name: " + name)
+	}
+	return filepath.Join(local.Dir, name), nil
+}
+
+// Put 先写入临时文件再改名，避免读取到写了一半的文件。
+func (local *Local) Put(name string, r io.Reader, size int64) error {
+	filePath, err := local.path(name)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(local.Dir, name+".*.put")
+	if err != nil {
+		return err
+	}
+	_, err1 := io.CopyN(tmp, r, size)
+	err2 := tmp.Close()
+	if err1 != nil || err2 != nil {
+		_ = os.Remove(tmp.Name())
+		if err1 != nil {
+			return err1
+		}
+		return err2
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+// MoveFile 直接移动文件，filePath 应与 Dir 在同一个分区。
+func (local *Local) MoveFile(name, filePath string) error {
+	target, err := local.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filePath, target)
+}
+
+// Get .
+func (local *Local) Get(name string, offset, length int64) (io.ReadCloser, error) {
+	filePath, err := local.path(name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		return file, nil
+	}
+	return readCloser{io.LimitReader(file, length), file}, nil
+}
+
+// Stat .
+func (local *Local) Stat(name string) (info Info, err error) {
+	filePath, err := local.path(name)
+	if err != nil {
+		return
+	}
+	stat, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return info, ErrNotFound
+	}
+	if err != nil {
+		return
+	}
+	return Info{Name: name, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// Delete .
+func (local *Local) Delete(names ...string) error {
+	for _, name := range names {
+		filePath, err := local.path(name)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// List 只列出普通文件，不包括子文件夹。
+func (local *Local) List() (all []Info, err error) {
+	entries, err := ioutil.ReadDir(local.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		all = append(all, Info{
+			Name:    entry.Name(),
+			Size:    entry.Size(),
+			ModTime: entry.ModTime(),
+		})
+	}
+	return
+}
+
+// readCloser 让 io.LimitReader 等 reader 也能关闭底层的文件。
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,373 @@
+package storage
+
+// S3 兼容的对象存储 (AWS S3, MinIO 等)，只使用标准库，自行实现 Signature Version 4.
+// 使用 path-style 地址 (endpoint/bucket/key), MinIO 默认就是这种方式。
+// 上传时使用 UNSIGNED-PAYLOAD, 因此不需要预先计算整个文件的 sha256, 可以流式上传。
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat   = "20060102T150405Z"
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	emptySha256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// 超时设置。调用者往往持有 filesMutex, 一个卡住的连接不能一直阻塞上传与清理。
+// 除下载 (Get) 以外，每个请求都有总的时限，上传的时限按 s3MinPutRate 随体积增加；
+// 下载的内容可能很大，只限制连接与等待响应的时间。
+const (
+	s3DialTimeout    = 10 * time.Second
+	s3RequestTimeout = time.Minute
+	s3MinPutRate     = 64 << 10 // bytes per second
+)
+
+// newS3Client 返回设置了连接、TLS 握手与等待响应超时的 http.Client.
+func newS3Client() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   s3DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = s3DialTimeout
+	transport.ResponseHeaderTimeout = s3RequestTimeout
+	return &http.Client{Transport: transport}
+}
+
+// S3 把文件保存在 S3 兼容的对象存储里。
+type S3 struct {
+	Endpoint  string // 例如 http://127.0.0.1:9000
+	Region    string // MinIO 默认是 us-east-1
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // 全部对象的 key 的前缀，例如 "gosend/"
+
+	client *http.Client
+}
+
+// NewS3 .
+func NewS3(endpoint, region, bucket, accessKey, secretKey, prefix string) (*S3, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("storage: s3 endpoint must start with http:// or https://")
+	}
+	if bucket == "" {
+		return nil, errors.New("storage: s3 bucket is empty")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Prefix:    prefix,
+		client:    newS3Client(),
+	}, nil
+}
+
+// s3Error 是 S3 返回的错误信息。
+type s3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("storage: s3 %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func readS3Error(res *http.Response) error {
+	e := &s3Error{StatusCode: res.StatusCode}
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+	_ = xml.Unmarshal(body, e)
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	return e
+}
+
+func (s *S3) objectURL(name string) string {
+	return s.Endpoint + "/" + s.Bucket + "/" + s.Prefix + name
+}
+
+// newRequest 创建一个有时限的请求，读完响应后应调用 cancel.
+func newRequest(method, url string, body io.Reader, timeout time.Duration) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return req, cancel, nil
+}
+
+// do 签名并发送请求。如果 payloadHash 为空，表示 UNSIGNED-PAYLOAD.
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	if payloadHash == "" {
+		payloadHash = unsignedPayload
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// Put .
+func (s *S3) Put(name string, r io.Reader, size int64) error {
+	var body io.Reader = http.NoBody
+	if size > 0 {
+		body = io.LimitReader(r, size)
+	}
+	timeout := s3RequestTimeout + time.Duration(size/s3MinPutRate)*time.Second
+	req, cancel, err := newRequest(http.MethodPut, s.objectURL(name), body, timeout)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := s.do(req, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readS3Error(res)
+	}
+	return nil
+}
+
+// Get .
+func (s *S3) Get(name string, offset, length int64) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	if offset > 0 || length > 0 {
+		end := ""
+		if length > 0 {
+			end = strconv.FormatInt(offset+length-1, 10)
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%s", offset, end))
+	}
+	res, err := s.do(req, emptySha256)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		defer res.Body.Close()
+		return nil, readS3Error(res)
+	}
+	return res.Body, nil
+}
+
+// Stat .
+func (s *S3) Stat(name string) (info Info, err error) {
+	req, cancel, err := newRequest(http.MethodHead, s.objectURL(name), nil, s3RequestTimeout)
+	if err != nil {
+		return
+	}
+	defer cancel()
+	res, err := s.do(req, emptySha256)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return info, readS3Error(res)
+	}
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return Info{Name: name, Size: res.ContentLength, ModTime: modTime}, nil
+}
+
+// Delete S3 删除不存在的对象时也返回 204, 因此不需要特别处理找不到的情况。
+func (s *S3) Delete(names ...string) error {
+	for _, name := range names {
+		req, cancel, err := newRequest(http.MethodDelete, s.objectURL(name), nil, s3RequestTimeout)
+		if err != nil {
+			return err
+		}
+		res, err := s.do(req, emptySha256)
+		if err != nil {
+			cancel()
+			return err
+		}
+		if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+			err = readS3Error(res)
+		}
+		_ = res.Body.Close()
+		cancel()
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// listResult 是 ListObjectsV2 的返回结果。
+type listResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		Size         int64  `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List 使用 ListObjectsV2, 每次最多返回 1000 个，因此要循环读取。
+func (s *S3) List() (all []Info, err error) {
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if s.Prefix != "" {
+			query.Set("prefix", s.Prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, cancel, err := newRequest(http.MethodGet,
+			s.Endpoint+"/"+s.Bucket+"?"+query.Encode(), nil, s3RequestTimeout)
+		if err != nil {
+			return nil, err
+		}
+		res, err := s.do(req, emptySha256)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			err = readS3Error(res)
+			_ = res.Body.Close()
+			cancel()
+			return nil, err
+		}
+		var result listResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		_ = res.Body.Close()
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, s.Prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			modTime, _ := time.Parse(time.RFC3339, object.LastModified)
+			all = append(all, Info{Name: name, Size: object.Size, ModTime: modTime})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return all, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// sign 按 AWS Signature Version 4 给 req 签名。
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format(amzDateFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSha256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSha256(key, s.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode 按 AWS 的要求编码，只保留 A-Z a-z 0-9 - _ . ~,
+// encodeSlash 为 false 时保留 '/'.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ('A' <= ch && ch <= 'Z') || ('a' <= ch && ch <= 'z') ||
+			('0' <= ch && ch <= '9') || ch == '-' || ch == '_' || ch == '.' || ch == '~':
+			b.WriteByte(ch)
+		case ch == '/' && !encodeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,76 @@
+// Package storage 保存文件与缩略图，数据库 (bolt) 不在此列，仍然保存在本地。
+package storage // import "github.com/ahui2016/go-send/storage"
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// ErrNotFound 表示找不到该文件。
+var ErrNotFound = errors.New("storage: not found")
+
+// Info 是一个文件的基本信息。
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage 是文件存储的接口，name 一律是不含路径的文件名，例如 "1ka1.send".
+// 全部方法都以流的方式读写，不会把整个文件读入内存。
+type Storage interface {
+	// Put 把 r 写入 name, size 是 r 的长度。如果 name 已存在则覆盖。
+	Put(name string, r io.Reader, size int64) error
+
+	// Get 读取 name 从 offset 开始的 length 个字节，length < 0 表示一直读到末尾。
+	Get(name string, offset, length int64) (io.ReadCloser, error)
+
+	// Stat 获取 name 的信息，找不到时返回 ErrNotFound.
+	Stat(name string) (Info, error)
+
+	// Delete 删除全部 names, 忽略找不到文件的错误。
+	Delete(names ...string) error
+
+	// List 列出全部文件。
+	List() ([]Info, error)
+}
+
+// fileMover 是可选的接口，本地存储可以直接移动文件而不必复制。
+type fileMover interface {
+	MoveFile(name, filePath string) error
+}
+
+// PutFile 把本地文件 filePath 保存为 name, 成功后 filePath 会被删除。
+func PutFile(s Storage, name, filePath string) error {
+	if mover, ok := s.(fileMover); ok {
+		return mover.MoveFile(name, filePath)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	err = s.Put(name, file, stat.Size())
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
+
+// ReadAll 读取 name 的全部内容，只应该用于缩略图等小文件。
+func ReadAll(s Storage, name string) ([]byte, error) {
+	r, err := s.Get(name, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,507 @@
+package main
+
+// 断点续传，实现 tus 1.0 协议的 core, creation, termination, expiration 部分，
+// 因此现成的 tus 客户端 (例如 tus-js-client) 可以直接使用。
+// 协议说明 https://tus.io/protocols/resumable-upload.html
+//
+// Upload-Metadata 除了 filename 和 checksum 以外，还可以有 expires-in (见 readExpiresAt),
+// tags (见 readTags) 和端到端加密的参数 (见 readE2E)。
+//
+// 未完成的上传保存在 uploadsDir 里，每个上传有两个文件：
+// <id>.part 是已接收的数据，<id>.info 记录文件名、总长度等信息。
+// 收到全部数据后写入数据库并保存文件 (见 finishTusUpload)。如果此时出错 (例如磁盘已满、
+// 超过容量上限), 除非是 checksum 不符之类无法挽回的错误，否则保留这两个文件，
+// 之后的 HEAD (或不带数据的 PATCH) 会再次尝试完成，客户端不需要重新上传。
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ahui2016/go-send/model"
+	"github.com/ahui2016/goutil"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+	tusPartExt    = ".part"
+	tusInfoExt    = ".info"
+
+	// tusExpiration 未完成的上传超过这个时间就会被清理 (见 janitor.go)。
+	tusExpiration = time.Hour * 24
+)
+
+// tusLock 是一个上传的锁，避免同一个上传被同时写入，不同的上传互不影响。
+type tusLock struct {
+	mu sync.Mutex
+
+	// refs 是持有或等待该锁、以及正在完成该上传的请求数量，由 tusLocksMutex 保护。
+	// 降为零时从 tusLocks 删除，因此 tusLocks 只包含正在使用的锁，不会删除被持有的锁。
+	refs int
+
+	// finishing 表示该上传正在完成 (见 completeTusUpload), 由 mu 保护。
+	// 同一个上传同时只会完成一次，并且不会被删除或清理。
+	finishing bool
+}
+
+var (
+	tusLocksMutex sync.Mutex
+	tusLocks      = make(map[string]*tusLock)
+)
+
+// acquireTusLock 返回上传 id 的锁 (不锁定), 使用后必须调用 releaseTusLock.
+func acquireTusLock(id string) *tusLock {
+	tusLocksMutex.Lock()
+	defer tusLocksMutex.Unlock()
+	lock, ok := tusLocks[id]
+	if !ok {
+		lock = new(tusLock)
+		tusLocks[id] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+func releaseTusLock(id string, lock *tusLock) {
+	tusLocksMutex.Lock()
+	defer tusLocksMutex.Unlock()
+	if lock.refs--; lock.refs == 0 {
+		delete(tusLocks, id)
+	}
+}
+
+// lockTusUpload 锁定一个上传，返回用来解锁的函数。
+func lockTusUpload(id string) (unlock func()) {
+	lock := acquireTusLock(id)
+	lock.mu.Lock()
+	return func() {
+		lock.mu.Unlock()
+		releaseTusLock(id, lock)
+	}
+}
+
+// lockIdleTusUpload 与 lockTusUpload 一样锁定一个上传，但如果该上传正在完成，
+// 则不锁定并返回 errTusFinishing.
+func lockIdleTusUpload(id string) (unlock func(), err error) {
+	lock := acquireTusLock(id)
+	lock.mu.Lock()
+	if lock.finishing {
+		lock.mu.Unlock()
+		releaseTusLock(id, lock)
+		return nil, errTusFinishing
+	}
+	return func() {
+		lock.mu.Unlock()
+		releaseTusLock(id, lock)
+	}, nil
+}
+
+var errTusFinishing = errors.New("the upload is being processed")
+
+// tusUpload 是 <id>.info 的内容。
+type tusUpload struct {
+	ID        string
+	Length    int64
+	Offset    int64
+	Metadata  map[string]string
+	CreatedAt string // ISO8601
+}
+
+func tusPartPath(id string) string {
+	return filepath.Join(uploadsDir, id+tusPartExt)
+}
+
+func tusInfoPath(id string) string {
+	return filepath.Join(uploadsDir, id+tusInfoExt)
+}
+
+func (upload *tusUpload) filename() string {
+	if name := upload.Metadata["filename"]; name != "" {
+		return name
+	}
+	return upload.Metadata["name"]
+}
+
+func (upload *tusUpload) metadata(key string) string {
+	return upload.Metadata[key]
+}
+
+func (upload *tusUpload) expiresAt() time.Time {
+	createdAt, err := model.ParseTime(upload.CreatedAt)
+	if err != nil {
+		return time.Now()
+	}
+	return createdAt.Add(tusExpiration)
+}
+
+func (upload *tusUpload) save() error {
+	blob, err := json.Marshal(upload)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(tusInfoPath(upload.ID), blob, 0600)
+}
+
+// remove 删除上传的文件，调用者必须持有该上传的锁。
+func (upload *tusUpload) remove() error {
+	return goutil.DeleteFiles(tusPartPath(upload.ID), tusInfoPath(upload.ID))
+}
+
+func getTusUpload(id string) (*tusUpload, error) {
+	// id 由 goutil.NewID 生成，只含有字母和数字。
+	if id == "" || strings.ContainsAny(id, `./\`) {
+		return nil, errors.New("upload not found")
+	}
+	blob, err := ioutil.ReadFile(tusInfoPath(id))
+	if err != nil {
+		return nil, errors.New("upload not found")
+	}
+	upload := new(tusUpload)
+	err = json.Unmarshal(blob, upload)
+	return upload, err
+}
+
+// parseTusMetadata 解析 Upload-Metadata, 格式为 "key base64,key base64".
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, " ", 2)
+		if len(kv) == 1 {
+			metadata[kv[0]] = ""
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, errors.New("invalid Upload-Metadata")
+		}
+		metadata[kv[0]] = string(value)
+	}
+	return metadata, nil
+}
+
+// checkTusResumable 除了 OPTIONS 以外，每个请求都必须带有正确的 Tus-Resumable.
+func checkTusResumable(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	if c.Method() == fiber.MethodOptions {
+		return c.Next()
+	}
+	if c.Get("Tus-Resumable") != tusVersion {
+		c.Set("Tus-Version", tusVersion)
+		return jsonError(c, "unsupported tus version", fiber.StatusPreconditionFailed)
+	}
+	return c.Next()
+}
+
+func tusOptions(c *fiber.Ctx) error {
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	c.Set("Tus-Max-Size", strconv.FormatInt(capacity(), 10))
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func tusCreate(c *fiber.Ctx) error {
+	length, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return jsonError(c, "invalid Upload-Length", 400)
+	}
+	if length > capacity() {
+		return jsonError(c, "File Too Large", fiber.StatusRequestEntityTooLarge)
+	}
+	metadata, err := parseTusMetadata(c.Get("Upload-Metadata"))
+	if err != nil {
+		return jsonError(c, err.Error(), 400)
+	}
+	upload := &tusUpload{
+		ID:        goutil.NewID(),
+		Length:    length,
+		Metadata:  metadata,
+		CreatedAt: model.TimeNow(),
+	}
+	// 在接收数据之前检查全部 metadata, 以免上传完毕才发现参数有误。
+	if len(upload.filename()) < model.FileNameMinLength {
+		return jsonError(c, "filename is too short", 400)
+	}
+	if checksum := upload.Metadata["checksum"]; checksum != "" && !isSHA256(checksum) {
+		return jsonError(c, "invalid checksum", 400)
+	}
+	if _, err := readE2E(upload.metadata); err != nil {
+		return err
+	}
+	if _, err := readExpiresAt(upload.metadata); err != nil {
+		return err
+	}
+	if _, err := readTags(upload.metadata); err != nil {
+		return err
+	}
+
+	err = func() error {
+		defer lockTusUpload(upload.ID)()
+		if err := ioutil.WriteFile(tusPartPath(upload.ID), nil, 0600); err != nil {
+			return err
+		}
+		return upload.save()
+	}()
+	if err != nil {
+		return err
+	}
+	c.Location(strings.TrimSuffix(c.Path(), "/") + "/" + upload.ID)
+	c.Set("Upload-Expires", upload.expiresAt().UTC().Format(http.TimeFormat))
+
+	// 长度为零的上传不会有 PATCH, 因此在创建时就完成。
+	if upload.Length == 0 {
+		if err := completeTusUpload(c, upload.ID); err != nil {
+			return err
+		}
+	}
+	return c.SendStatus(fiber.StatusCreated)
+}
+
+// tusHead 返回已接收的长度。如果已接收全部数据但上次未能完成 (见 finishTusUpload),
+// 则再次尝试完成，因为客户端看到 Upload-Offset 等于 Upload-Length 就不会再发送 PATCH.
+func tusHead(c *fiber.Ctx) error {
+	id := c.Params("id")
+	upload, err := func() (*tusUpload, error) {
+		defer lockTusUpload(id)()
+		return getTusUpload(id)
+	}()
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	c.Set("Upload-Expires", upload.expiresAt().UTC().Format(http.TimeFormat))
+
+	if upload.Offset == upload.Length {
+		if err := completeTusUpload(c, id); err != nil {
+			return err
+		}
+	}
+	return c.SendStatus(fiber.StatusOK)
+}
+
+func tusPatch(c *fiber.Ctx) error {
+	if c.Get(fiber.HeaderContentType) != "application/offset+octet-stream" {
+		return jsonError(c, "wrong Content-Type", fiber.StatusUnsupportedMediaType)
+	}
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return jsonError(c, "invalid Upload-Offset", 400)
+	}
+
+	id := c.Params("id")
+	unlock := lockTusUpload(id)
+	upload, err := getTusUpload(id)
+	if err != nil {
+		unlock()
+		return jsonError(c, err.Error(), 404)
+	}
+	if offset != upload.Offset {
+		unlock()
+		return jsonError(c, "Upload-Offset does not match", fiber.StatusConflict)
+	}
+	chunk := c.Body()
+	if upload.Offset+int64(len(chunk)) > upload.Length {
+		unlock()
+		return jsonError(c, "exceeds Upload-Length", fiber.StatusRequestEntityTooLarge)
+	}
+	err = appendToPart(upload, chunk)
+	unlock()
+	if err != nil {
+		return err
+	}
+	c.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	c.Set("Upload-Expires", upload.expiresAt().UTC().Format(http.TimeFormat))
+
+	if upload.Offset == upload.Length {
+		if err := completeTusUpload(c, id); err != nil {
+			return err
+		}
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// appendToPart 把 chunk 追加到 <id>.part, 并更新 upload.Offset.
+// 如果只写入了一部分，也按实际写入的长度更新 Offset, 客户端可据此续传。
+func appendToPart(upload *tusUpload, chunk []byte) error {
+	part, err := os.OpenFile(tusPartPath(upload.ID), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	n, err1 := part.Write(chunk)
+	err2 := part.Close()
+	upload.Offset += int64(n)
+	err3 := upload.save()
+	return goutil.WrapErrors(err1, err2, err3)
+}
+
+// completeTusUpload 完成已接收全部数据的上传，成功时设置 Gosend-Message-Id.
+// 同一个上传正在被另一个请求完成时返回 423. 完成期间持有该上传的锁的引用，
+// 因此 finishing 一直保留到完成为止。
+func completeTusUpload(c *fiber.Ctx, id string) error {
+	lock := acquireTusLock(id)
+	defer releaseTusLock(id, lock)
+
+	lock.mu.Lock()
+	busy := lock.finishing
+	lock.finishing = true
+	lock.mu.Unlock()
+	if busy {
+		return jsonError(c, errTusFinishing.Error(), fiber.StatusLocked)
+	}
+	defer func() {
+		lock.mu.Lock()
+		lock.finishing = false
+		lock.mu.Unlock()
+	}()
+
+	message, err := finishTusUpload(id)
+	if err != nil {
+		return err
+	}
+	c.Set("Gosend-Message-Id", message.ID)
+	return nil
+}
+
+// finishTusUpload 与 uploadHandler 一样写入数据库并保存文件，然后删除该上传。
+// 只在 checksum 不符时删除上传的数据，其它错误 (例如磁盘已满、存储或数据库出错、
+// 超过容量上限) 都保留 <id>.part, 以便稍后再次尝试。
+// 只在锁定期间把 <id>.part 硬链接为临时文件，计算 sha256、压缩与保存都不持有该上传的锁。
+func finishTusUpload(id string) (*Message, error) {
+	var upload *tusUpload
+	tempPath := filepath.Join(filesDir, "tus-"+id+tempFileExt)
+	err := func() (err error) {
+		defer lockTusUpload(id)()
+		if upload, err = getTusUpload(id); err != nil {
+			return fiber.NewError(404, err.Error())
+		}
+		if upload.Offset != upload.Length {
+			return fiber.NewError(fiber.StatusConflict, "the upload is not complete")
+		}
+		// uploadsDir 与 filesDir 都在 dataDir 里，可以硬链接。
+		_ = os.Remove(tempPath)
+		return os.Link(tusPartPath(id), tempPath)
+	}()
+	if err != nil {
+		return nil, err
+	}
+	file, err := hashTempFile(upload.filename(), tempPath)
+	if err != nil {
+		_ = os.Remove(tempPath)
+		return nil, err
+	}
+	// insertFile 会移走临时文件，或者在压缩时换成另一个临时文件，出错时可能还在，这里一律删除。
+	defer func() { _ = file.remove() }()
+
+	if checksum := upload.Metadata["checksum"]; checksum != "" && checksum != file.Checksum {
+		removeTusUpload(id)
+		return nil, fiber.NewError(400, "checksums do not match")
+	}
+	// metadata 已在创建时检查过。过期时间从上传完成时算起。
+	if file.E2E, err = readE2E(upload.metadata); err != nil {
+		return nil, err
+	}
+	if file.ExpiresAt, err = readExpiresAt(upload.metadata); err != nil {
+		return nil, err
+	}
+	if file.Tags, err = readTags(upload.metadata); err != nil {
+		return nil, err
+	}
+
+	message, err := func() (*Message, error) {
+		filesMutex.Lock()
+		defer filesMutex.Unlock()
+
+		// 文件已存在时 insertFile 只更新日期，也算完成。
+		message, _, err := insertFile(file)
+		if err != nil {
+			return nil, err
+		}
+		// 自动删除过期条目。文件已经保存，因此这里出错只写入日志。
+		if err := deleteExpiredItems(); err != nil {
+			log.Print(err)
+		}
+		return message, nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+	removeTusUpload(id)
+	return message, nil
+}
+
+// removeTusUpload 锁定并删除一个上传。
+func removeTusUpload(id string) {
+	defer lockTusUpload(id)()
+	if upload, err := getTusUpload(id); err == nil {
+		if err := upload.remove(); err != nil {
+			log.Printf("tus: %s: %v", id, err)
+		}
+	}
+}
+
+func tusDelete(c *fiber.Ctx) error {
+	id := c.Params("id")
+	unlock, err := lockIdleTusUpload(id)
+	if err != nil {
+		return jsonError(c, err.Error(), fiber.StatusLocked)
+	}
+	defer unlock()
+
+	upload, err := getTusUpload(id)
+	if err != nil {
+		return jsonError(c, err.Error(), 404)
+	}
+	if err := upload.remove(); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// cleanExpiredUploads 删除过期的未完成上传 (正在完成的除外), 返回被删除的上传的 ID.
+func cleanExpiredUploads() (removed []string, err error) {
+	infoFiles, err := goutil.GetFilesByExt(uploadsDir, tusInfoExt)
+	if err != nil {
+		return nil, err
+	}
+	for _, infoFile := range infoFiles {
+		id := strings.TrimSuffix(filepath.Base(infoFile), tusInfoExt)
+		expired, err := func() (bool, error) {
+			unlock, err := lockIdleTusUpload(id)
+			if err != nil {
+				return false, nil
+			}
+			defer unlock()
+			upload, err := getTusUpload(id)
+			if err != nil {
+				log.Printf("tus: %s: %v", infoFile, err)
+				return false, nil
+			}
+			if time.Now().Before(upload.expiresAt()) {
+				return false, nil
+			}
+			return true, upload.remove()
+		}()
+		if err != nil {
+			return removed, err
+		}
+		if expired {
+			removed = append(removed, id)
+		}
+	}
+	return removed, nil
+}
@@ -1,28 +1,39 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"html"
+	"image"
+	"io"
 	"io/ioutil"
+	"log"
 	"mime/multipart"
-	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ahui2016/go-send/database"
 	"github.com/ahui2016/go-send/model"
+	"github.com/ahui2016/go-send/storage"
 	"github.com/ahui2016/goutil"
 	"github.com/ahui2016/goutil/graphics"
-	"github.com/ahui2016/goutil/zipper"
 	"github.com/gofiber/fiber/v2"
 )
 
 type (
 	// Message .
 	Message = model.Message
+
+	// ClipText .
+	ClipText = model.ClipText
 )
 
 func jsonMessage(c *fiber.Ctx, msg string) error {
@@ -43,25 +54,89 @@ func jsonErr500(c *fiber.Ctx, err error) error {
 }
 */
 
-func getFileHeaderContents(c *fiber.Ctx, key string) (
-	header *multipart.FileHeader, contents []byte, err error) {
+// uploadedFile 是已经写入 filesDir 的临时文件，写入的同时计算了体积和 checksum.
+type uploadedFile struct {
+	Name      string // 原文件名
+	TempPath  string
+	Size      int64
+	Checksum  string     // hex(sha256)
+	E2E       *e2eParams // 不为 nil 表示文件已由客户端加密
+	ExpiresAt string     // ISO8601, 为空表示使用默认的保存时间
+	Tags      []string
+}
 
-	header, err = c.FormFile(key)
+// receiveFile 把 FormFile(key) 写入临时文件，同时计算 sha256 和体积。
+// 注意这时请求体已经整个读入内存 (见 checkBodySize), 这里只是避免再复制一份。
+// 大文件应使用 readUploadForm 以流的方式读取。
+func receiveFile(c *fiber.Ctx, key string) (*uploadedFile, error) {
+	header, err := c.FormFile(key)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	file, err := header.Open()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	defer file.Close()
+	return saveTempFile(header.Filename, file)
+}
+
+// saveTempFile 把 src 写入 filesDir 里的临时文件，同时计算 sha256 和体积。
+// 临时文件与正式文件在同一个文件夹内，因此之后可以直接 os.Rename.
+func saveTempFile(name string, src io.Reader) (*uploadedFile, error) {
+	tmp, err := ioutil.TempFile(filesDir, "upload-*"+tempFileExt)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	size, err1 := io.Copy(io.MultiWriter(tmp, hash), src)
+	err2 := tmp.Close()
+	if err := goutil.WrapErrors(err1, err2); err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &uploadedFile{
+		Name:     name,
+		TempPath: tmp.Name(),
+		Size:     size,
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// hashTempFile 计算一个已存在的临时文件的 sha256 和体积。
+// 该文件必须与 filesDir 在同一个分区，以便之后 os.Rename.
+func hashTempFile(name, tempPath string) (*uploadedFile, error) {
+	file, err := os.Open(tempPath)
+	if err != nil {
+		return nil, err
 	}
 	defer file.Close()
 
-	// 将文件内容全部读入内存
-	contents, err = ioutil.ReadAll(file)
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return header, contents, nil
+	return &uploadedFile{
+		Name:     name,
+		TempPath: tempPath,
+		Size:     size,
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// isSHA256 判断 s 是否 sha256 的十六进制形式 (小写)。
+func isSHA256(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// remove 删除临时文件。如果临时文件已被移走，则什么都不做。
+func (file *uploadedFile) remove() error {
+	return goutil.DeleteFiles(file.TempPath)
 }
 
 /*
@@ -78,40 +153,321 @@ func getFile(c *fiber.Ctx, key string) (multipart.File, error) {
 }
 */
 
-// getFileContents gets contents from FormFile("file").
-// It also verifies the file has not been corrupted.
-func getFileContents(c *fiber.Ctx) ([]byte, error) {
-	_, contents, err := getFileHeaderContents(c, "file")
+// uploadForm 是以流的方式读取的 multipart 表单 (见 readUploadForm),
+// 其中的文件已写入 filesDir 里的临时文件。
+type uploadForm struct {
+	values map[string]string
+	files  map[string]*uploadedFile
+}
+
+// readUploadForm 从请求体的流里逐个读取 multipart 表单的各部分，文件直接写入临时文件，
+// 不会整个读入内存。请求体的总体积已由 checkBodySize 限制，其它字段合计不可超过 maxFormValuesSize.
+// 同名的字段或文件只保留第一个，与 c.FormValue 一致。出错时删除已写入的临时文件。
+func readUploadForm(c *fiber.Ctx) (*uploadForm, error) {
+	boundary := string(c.Request().Header.MultipartFormBoundary())
+	if boundary == "" {
+		return nil, fiber.NewError(fiber.StatusUnsupportedMediaType, "require multipart/form-data")
+	}
+	body := c.Context().RequestBodyStream()
+	if body == nil {
+		body = bytes.NewReader(c.Body())
+	}
+	form := &uploadForm{
+		values: make(map[string]string),
+		files:  make(map[string]*uploadedFile),
+	}
+	reader := multipart.NewReader(body, boundary)
+	valuesSize := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err != nil {
+			form.removeFiles()
+			return nil, fiber.NewError(400, err.Error())
+		}
+		key := part.FormName()
+		if part.FileName() == "" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, int64(maxFormValuesSize-valuesSize+1)))
+			valuesSize += len(value)
+			if err == nil && valuesSize > maxFormValuesSize {
+				err = fiber.ErrRequestEntityTooLarge
+			}
+			if err != nil {
+				form.removeFiles()
+				return nil, err
+			}
+			if _, ok := form.values[key]; !ok {
+				form.values[key] = string(value)
+			}
+			continue
+		}
+		file, err := saveTempFile(part.FileName(), part)
+		if err != nil {
+			form.removeFiles()
+			return nil, err
+		}
+		if _, ok := form.files[key]; ok {
+			_ = file.remove()
+			continue
+		}
+		form.files[key] = file
+	}
+}
+
+// value 返回字段 key 的值，可用作 readE2E 等函数的参数。
+func (form *uploadForm) value(key string) string {
+	return form.values[key]
+}
+
+// file 返回文件 key, 如果表单里没有该文件，则返回 nil.
+func (form *uploadForm) file(key string) *uploadedFile {
+	return form.files[key]
+}
+
+// removeFiles 删除表单里全部文件的临时文件 (已被移走的除外)。
+func (form *uploadForm) removeFiles() {
+	for _, file := range form.files {
+		_ = file.remove()
+	}
+}
+
+// checkedFile 返回文件 "file", 并根据文件内容检查 checksum 是否正确。
+func (form *uploadForm) checkedFile() (*uploadedFile, error) {
+	file := form.file("file")
+	if file == nil {
+		return nil, fiber.NewError(400, "file is required")
+	}
+	if file.Checksum != form.value("checksum") {
+		return nil, errors.New("checksums do not match")
+	}
+	return file, nil
+}
+
+// e2eParams 是端到端加密的参数，来自表单或 tus 的 Upload-Metadata,
+// 参数名为 encrypted (非空即可), cipher, nonce, wrapped-keys (JSON 数组)。
+type e2eParams struct {
+	Cipher      string
+	Nonce       string
+	WrappedKeys []model.WrappedKey
+}
+
+// readE2E 读取端到端加密的参数，如果参数 encrypted 为空，则返回 nil.
+func readE2E(get func(key string) string) (*e2eParams, error) {
+	if get("encrypted") == "" {
+		return nil, nil
+	}
+	e2e := &e2eParams{Cipher: get("cipher"), Nonce: get("nonce")}
+	if e2e.Cipher == "" || e2e.Nonce == "" {
+		return nil, fiber.NewError(400, "cipher and nonce are required for an encrypted message")
+	}
+	if keys := get("wrapped-keys"); keys != "" {
+		if err := json.Unmarshal([]byte(keys), &e2e.WrappedKeys); err != nil {
+			return nil, fiber.NewError(400, "invalid wrapped-keys")
+		}
+	}
+	return e2e, nil
+}
+
+// messageItem 是返回给前端的 Message, 附带计算出来的变灰时间与过期 (自动删除) 时间。
+// 回收站里的条目的 DeleteAt 是永久删除的时间。
+type messageItem struct {
+	Message
+	TurnGreyAt string // ISO8601
+	DeleteAt   string // ISO8601
+}
+
+func withExpiry(messages []Message) ([]messageItem, error) {
+	items := make([]messageItem, len(messages))
+	for i := range messages {
+		if messages[i].DeletedAt != "" {
+			purgeAt, err := trashPurgeAt(messages[i].DeletedAt)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = messageItem{messages[i], messages[i].DeletedAt, purgeAt}
+			continue
+		}
+		turnGreyAt, deleteAt, err := db.Expiry(&messages[i])
+		if err != nil {
+			return nil, err
+		}
+		items[i] = messageItem{messages[i], turnGreyAt, deleteAt}
+	}
+	return items, nil
+}
+
+// trashPurgeAt 返回回收站里的条目被永久删除的时间。
+func trashPurgeAt(deletedAt string) (string, error) {
+	t, err := model.ParseTime(deletedAt)
+	if err != nil {
+		return "", err
+	}
+	return model.FormatTime(t.Add(days(config.TrashDays))), nil
+}
+
+// readTimeRange 读取日期范围的参数 (日期或 RFC 3339 时间，见 model.TimeRange),
+// 返回 ISO8601 区间 [from, to).
+func readTimeRange(get func(key string) string, fromKey, toKey string) (from, to string, err error) {
+	from, to, err = model.TimeRange(get(fromKey), get(toKey))
+	if err != nil {
+		return "", "", fiber.NewError(400, err.Error())
+	}
+	return
+}
+
+// readExpiresAt 读取参数 expires-in (例如 "30m", "12h", "7d"), 返回过期时间 (ISO8601)。
+// 参数为空时返回空字符串，表示使用默认的保存时间。
+func readExpiresAt(get func(key string) string) (string, error) {
+	expiresIn := strings.TrimSpace(get("expires-in"))
+	if expiresIn == "" {
+		return "", nil
+	}
+	d, err := parseDuration(expiresIn)
+	if err != nil || d <= 0 {
+		return "", fiber.NewError(400, "invalid expires-in: "+expiresIn)
+	}
+	return model.FormatTime(time.Now().Add(d)), nil
+}
+
+// readTags 读取参数 tags (以逗号或空格分隔)。
+func readTags(get func(key string) string) ([]string, error) {
+	tags, err := model.ParseTags(get("tags"))
+	if err != nil {
+		return nil, fiber.NewError(400, err.Error())
+	}
+	return tags, nil
+}
+
+// textTags 返回参数 tags 与 textMsg 里的 #标签 的并集。
+func textTags(get func(key string) string, textMsg string) ([]string, error) {
+	tags, err := readTags(get)
 	if err != nil {
 		return nil, err
 	}
+	if tags, err = model.AddTags(tags, model.HashTags(textMsg)); err != nil {
+		return nil, fiber.NewError(400, err.Error())
+	}
+	return tags, nil
+}
 
-	// 根据文件内容生成 checksum 并检查其是否正确
-	if Sha256Hex(contents) != c.FormValue("checksum") {
-		return nil, errors.New("checksums do not match")
+// readListQuery 读取列表的参数 sort, order (asc 或 desc), cursor, limit, type, file-type,
+// min-size, max-size, created-from, created-to, updated-from, updated-to, tag, pinned (1 或 0).
+// 有 limit 或 cursor 时 paged 为 true, 默认从新到旧；否则不分页，为了兼容旧的客户端默认从旧到新。
+func readListQuery(get func(key string) string) (query *database.ListQuery, paged bool, err error) {
+	query = &database.ListQuery{
+		Sort:     get("sort"),
+		Cursor:   get("cursor"),
+		Type:     model.MsgType(get("type")),
+		FileType: get("file-type"),
+		Tag:      get("tag"),
+		Pinned:   get("pinned"),
+	}
+	if query.CreatedFrom, query.CreatedTo, err = readTimeRange(get, "created-from", "created-to"); err != nil {
+		return nil, false, err
+	}
+	if query.UpdatedFrom, query.UpdatedTo, err = readTimeRange(get, "updated-from", "updated-to"); err != nil {
+		return nil, false, err
+	}
+	limit := get("limit")
+	paged = limit != "" || query.Cursor != ""
+	query.Asc = !paged
+
+	switch query.Sort {
+	case "", database.SortByUpdated, database.SortByCreated, database.SortBySize, database.SortByName:
+	default:
+		return nil, false, fiber.NewError(400, "unknown sort: "+query.Sort)
+	}
+	switch order := get("order"); order {
+	case "":
+	case "asc", "desc":
+		query.Asc = order == "asc"
+	default:
+		return nil, false, fiber.NewError(400, "unknown order: "+order)
+	}
+	switch query.Type {
+	case "", model.TextMsg, model.FileMsg:
+	default:
+		return nil, false, fiber.NewError(400, "unknown type: "+string(query.Type))
+	}
+	switch query.Pinned {
+	case "", "0", "1":
+	default:
+		return nil, false, fiber.NewError(400, "invalid pinned: "+query.Pinned)
+	}
+	if paged {
+		query.Limit = defaultListLimit
+	}
+	if limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, false, fiber.NewError(400, "invalid limit: "+limit)
+		}
+		if query.Limit = n; n > maxListLimit {
+			query.Limit = maxListLimit
+		}
+	}
+	if query.MinSize, err = readSize(get, "min-size"); err != nil {
+		return nil, false, err
 	}
-	return contents, nil
+	if query.MaxSize, err = readSize(get, "max-size"); err != nil {
+		return nil, false, err
+	}
+	return query, paged, nil
 }
 
-// Sha256Hex .
-func Sha256Hex(data []byte) string {
-	sum := sha256.Sum256(data)
-	return hex.EncodeToString(sum[:])
+// readSize 读取以字节为单位的体积，为空时返回零。
+func readSize(get func(key string) string, key string) (int64, error) {
+	value := get(key)
+	if value == "" {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fiber.NewError(400, "invalid "+key+": "+value)
+	}
+	return size, nil
+}
+
+// listPage 不分页时直接返回 items (与旧的客户端兼容), 否则返回 items 与下一页的 cursor
+// (没有下一页时为空)。
+func listPage(c *fiber.Ctx, items interface{}, next string, paged bool) error {
+	if !paged {
+		return c.JSON(items)
+	}
+	return c.JSON(fiber.Map{"items": items, "nextCursor": next})
 }
 
-// checkImage 在 message 是图片是检查该图片能否正常使用，
-func checkImage(c *fiber.Ctx, message *Message, img []byte) error {
-	if message.IsImage() {
-		if _, err := graphics.Thumbnail(img, 0, 0); err != nil {
-			return errors.New("该图片有问题，拒绝接收")
+// parseDuration 与 time.ParseDuration 一样，另外支持以 "d" 表示天数，例如 "7d".
+func parseDuration(s string) (time.Duration, error) {
+	if n := strings.TrimSuffix(s, "d"); n != s {
+		days, err := strconv.Atoi(n)
+		if err != nil || days > 36500 {
+			return 0, fmt.Errorf("invalid duration: %s", s)
 		}
+		return time.Hour * 24 * time.Duration(days), nil
 	}
-	return nil
+	return time.ParseDuration(s)
+}
+
+// formValue 让 c.FormValue 可以用作 readE2E 的参数。
+func formValue(c *fiber.Ctx) func(key string) string {
+	return func(key string) string { return c.FormValue(key) }
 }
 
-func getThumbnail(c *fiber.Ctx) ([]byte, error) {
-	_, contents, err := getFileHeaderContents(c, "thumbnail")
-	return contents, err
+// apply 把 message 标记为端到端加密，e2e 为 nil 时什么都不做。
+func (e2e *e2eParams) apply(message *Message) error {
+	if e2e == nil {
+		return nil
+	}
+	return message.SetEncrypted(e2e.Cipher, e2e.Nonce, e2e.WrappedKeys)
+}
+
+// Sha256Hex .
+func Sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
 }
 
 // getFormValue checks if the c.FormValue(key) is empty or not,
@@ -156,42 +512,123 @@ func zipAllFiles() (message *Message, err error) {
 	if err != nil {
 		return
 	}
-	zipFilePath := localFilePath(message.ID)
-	err = zipper.Create(zipFilePath, zipperFiles(allFiles))
+
+	// 先在本地生成压缩包，再保存到 store.
+	tmp, err := ioutil.TempFile(filesDir, "zip-*"+tempFileExt)
 	if err != nil {
 		return
 	}
-	stat, err := os.Lstat(zipFilePath)
-	if err != nil {
+	err1 := writeZip(tmp, zipperFiles(allFiles))
+	err2 := tmp.Close()
+	zipFile, err3 := hashTempFile(message.FileName, tmp.Name())
+	defer func() { _ = goutil.DeleteFiles(tmp.Name()) }()
+	if err = goutil.WrapErrors(err1, err2, err3); err != nil {
+		return
+	}
+
+	message.FileSize = zipFile.Size
+	message.StoredSize = zipFile.Size
+	message.Checksum = zipFile.Checksum
+	existed, err := db.Insert(message)
+	if err != nil || existed {
 		return
 	}
-	message.FileSize = stat.Size()
-	err = db.Insert(message)
+	err = storage.PutFile(store, originName(message.ID), zipFile.TempPath)
 	return
 }
 
-// zipperFiles 将文件转换为 zipper.File 形式，会剔除 GosendZip, 避免重复打包。
-func zipperFiles(fileMessages []Message) (files []zipper.File) {
-	for i := range fileMessages {
-		message := fileMessages[i]
+// archiveEntry 是压缩包里的一个文件。
+type archiveEntry struct {
+	Name    string // 在压缩包里的文件名
+	Message Message
+}
+
+// open 返回原始内容，文本消息的内容就是 TextMsg.
+func (entry *archiveEntry) open() (io.ReadCloser, error) {
+	if entry.Message.Type == model.TextMsg {
+		return ioutil.NopCloser(strings.NewReader(entry.Message.TextMsg)), nil
+	}
+	return openFile(&entry.Message)
+}
+
+// modTime 返回 UpdatedAt, 用作压缩包里的文件时间。
+func (entry *archiveEntry) modTime() time.Time {
+	t, err := model.ParseTime(entry.Message.UpdatedAt)
+	if err != nil {
+		return time.Now()
+	}
+	return t.Local()
+}
+
+// zipperFiles 将消息转换为 archiveEntry 形式，会剔除 GosendZip, 避免重复打包。
+// 文件使用原文件名，文本消息命名为 <ID>.txt, 同名的文件会被改名为 "name (2).ext" 等。
+func zipperFiles(messages []Message) (files []archiveEntry) {
+	used := make(map[string]bool)
+	for i := range messages {
+		message := messages[i]
 		if message.FileType == model.GosendZip {
 			continue
 		}
-		file := zipper.File{
-			Name: message.FileName,
-			Path: localFilePath(message.ID),
+		name := message.ID + ".txt"
+		if message.Type == model.FileMsg {
+			name = message.FileName
 		}
-		files = append(files, file)
+		files = append(files, archiveEntry{uniqueName(name, used), message})
 	}
 	return
 }
 
+// uniqueName 去除 name 里的路径，并在 name 已被使用时加上序号，然后把结果记录在 used 里。
+func uniqueName(name string, used map[string]bool) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	unique := name
+	for i := 2; used[strings.ToLower(unique)]; i++ {
+		unique = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	used[strings.ToLower(unique)] = true
+	return unique
+}
+
+// writeZip 从 store 读取 files 的原始内容并打包写入 w, 找不到的文件会被忽略。
+func writeZip(w io.Writer, files []archiveEntry) error {
+	zipWriter := zip.NewWriter(w)
+	for i := range files {
+		src, err := files[i].open()
+		if err == storage.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		header := &zip.FileHeader{
+			Name:     files[i].Name,
+			Method:   zip.Deflate,
+			Modified: files[i].modTime(),
+		}
+		fileInZip, err := zipWriter.CreateHeader(header)
+		if err == nil {
+			_, err = io.Copy(fileInZip, src)
+		}
+		_ = src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zipWriter.Close()
+}
+
+// deleteOldFiles 把最老的 n 个文件移到回收站，下同。
 func deleteOldFiles(n int) error {
 	files, err := db.OldFiles(n)
 	if err != nil {
 		return err
 	}
-	return deleteItems(files)
+	return db.TrashMessages(files)
 }
 
 func deleteOldItems(n int) error {
@@ -199,7 +636,7 @@ func deleteOldItems(n int) error {
 	if err != nil {
 		return err
 	}
-	return deleteItems(items)
+	return db.TrashMessages(items)
 }
 
 func deleteGreyItems() error {
@@ -207,7 +644,7 @@ func deleteGreyItems() error {
 	if err != nil {
 		return err
 	}
-	return deleteItems(items)
+	return db.TrashMessages(items)
 }
 
 func deleteExpiredItems() error {
@@ -221,6 +658,16 @@ func deleteExpiredItems() error {
 	return deleteItems(items)
 }
 
+// emptyTrash 永久删除回收站里的全部条目。
+func emptyTrash() error {
+	items, err := db.TrashedItems()
+	if err != nil || len(items) == 0 {
+		return err
+	}
+	return deleteItems(items)
+}
+
+// deleteItems 永久删除 items 及其文件 (不经过回收站)。
 func deleteItems(items []Message) error {
 	if err := deleteFilesAndThumb(items); err != nil {
 		return err
@@ -228,53 +675,117 @@ func deleteItems(items []Message) error {
 	return db.DeleteMessages(items)
 }
 
+// deleteAllFiles 把全部文件移到回收站，但保留 Pinned 的文件。
+// 没有对应记录的文件不在此列，可用 fsck 清理。
 func deleteAllFiles() error {
-	err1 := os.RemoveAll(filesDir)
-	err2 := os.Mkdir(filesDir, 0700)
-	err3 := db.DeleteAllFiles()
-	return goutil.WrapErrors(err1, err2, err3)
+	return db.TrashAllFiles()
 }
 
 func deleteFilesAndThumb(files []Message) error {
-	var filePaths []string
+	var names []string
 	for _, file := range files {
 		originFile, thumb := getFileAndThumb(file.ID)
-		filePaths = append(filePaths, originFile, thumb)
+		names = append(names, originFile, thumb)
 	}
-	return goutil.DeleteFiles(filePaths...)
+	return store.Delete(names...)
 }
 
-func writeFile(message *Message, fileContents []byte) error {
-	file, thumb := getFileAndThumb(message.ID)
-	err := ioutil.WriteFile(file, fileContents, 0600)
+// insertFile 把已接收的文件写入数据库，然后移动到正式位置。
+// 如果已存在内容相同的文件，则只更新该文件的日期并返回该文件 (existed 为 true),
+// 临时文件由调用者删除。
+// 各种上传方式都使用此函数，确保每个文件都有 checksum.
+func insertFile(file *uploadedFile) (message *Message, existed bool, err error) {
+	message, err = db.NewFileMsg(file.Name)
 	if err != nil {
-		return err
+		return nil, false, err
+	}
+	message.Checksum = file.Checksum
+	message.FileSize = file.Size
+	message.ExpiresAt = file.ExpiresAt
+	message.Tags = file.Tags
+
+	// 端到端加密的文件不是图片，也不值得压缩，因此不会检查图片或压缩。
+	if err := file.E2E.apply(message); err != nil {
+		return nil, false, err
+	}
+	if err := checkImage(message, file.TempPath); err != nil {
+		return nil, false, err
+	}
+	if err := compressFile(message, file); err != nil {
+		return nil, false, err
 	}
 
-	// 如果是图片, 一律生成缩略图
-	if message.IsImage() {
-		err := goutil.BytesToThumb(fileContents, thumb)
-		if err != nil {
-			return err
+	// 至此，message 的全部内容都已经填充完毕，可以写入数据库。
+	existed, err = db.Insert(message)
+	if err != nil || existed {
+		return message, existed, err
+	}
+
+	// 数据库操作成功，移动文件。
+	// 不可在数据库操作结束之前移动文件，因为数据库操作发生错误时不应保存文件。
+	// 保存文件失败时删除刚写入的记录，否则重试时会被当作已存在的文件。
+	if err := storage.PutFile(store, originName(message.ID), file.TempPath); err != nil {
+		if err2 := db.Delete(message.ID); err2 != nil {
+			log.Printf("delete %s: %v", message.ID, err2)
 		}
+		return message, false, err
+	}
+
+	// 如果是图片，在后台检查图片并生成缩略图 (见 jobs.go)。
+	if message.IsImage() && !message.Encrypted {
+		return message, false, addJob(model.ThumbnailJob, message)
+	}
+	return message, false, nil
+}
+
+// checkImage 在 message 是图片时只读取图片的头部 (格式与尺寸) 进行检查，
+// 明显有问题的图片在上传时就拒绝，完整的检查与缩略图在后台进行 (见 makeThumbnail)。
+func checkImage(message *Message, filePath string) error {
+	if !message.IsImage() {
+		return nil
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, _, err := image.DecodeConfig(f); err != nil {
+		return fiber.NewError(400, "该图片有问题，拒绝接收")
 	}
 	return nil
 }
 
-// createAnchor 为了安全必须在 getTitle 成功后才生成 html,
-// 否则原封不动返回 s。
-func createAnchor(s string) (anchor string, ok bool) {
-	var link, title string
-	link, ok = isHttpURL(s)
-	if ok {
-		title, ok = getTitle(link)
-		if ok {
-			title = html.EscapeString(title)
-			anchor = fmt.Sprintf(`<a href="%s">%s</a>`, link, title)
-			return
-		}
+// putThumb 生成缩略图并保存到 store.
+func putThumb(thumb string, img []byte) error {
+	buf, err := graphics.Thumbnail(img, 0, 0)
+	if err != nil {
+		return err
+	}
+	return store.Put(thumb, buf, int64(buf.Len()))
+}
+
+// insertTextMsg 把文本消息写入数据库。如果内容是网址，则在后台获取网页信息 (见 jobs.go)。
+// 如果内容已存在，Insert 会把 message 替换为已存在的条目，因此 expiresAt 等设置只对新条目有效；
+// 但已存在的条目如果是普通文本 (例如当时无法获取网页)，则再获取一次。
+func insertTextMsg(textMsg, expiresAt string, tags []string) (*Message, error) {
+	addr, isURL := isHttpURL(textMsg)
+	if isURL {
+		textMsg = addr
+	}
+
+	message, err := db.NewTextMsg(textMsg)
+	if err != nil {
+		return nil, err
+	}
+	message.ExpiresAt = expiresAt
+	message.Tags = tags
+	if _, err := db.Insert(message); err != nil {
+		return nil, err
+	}
+	if !isURL || message.Link != nil || message.Encrypted || message.Processing == model.JobPending {
+		return message, nil
 	}
-	return s, false
+	return message, addJob(model.LinkPreviewJob, message)
 }
 
 // isHttpURL 当 s 是一个有效网址时返回该网址与 true, 否则返回 false.
@@ -286,30 +797,3 @@ func isHttpURL(s string) (addr string, ok bool) {
 	}
 	return addr, true
 }
-
-// getTitle 获取一个有效网址 addr 的网页的 title.
-func getTitle(addr string) (title string, ok bool) {
-	res, err := http.Get(addr)
-	if err != nil {
-		return "", false
-	}
-	defer func() { _ = res.Body.Close() }()
-
-	reTitle := regexp.MustCompile(`<title ?.*>(.+)</title>`)
-	blob := make([]byte, 1024)
-	for {
-		_, err := res.Body.Read(blob)
-		// 我服了，有的网站在 title 里加换行符
-		headStr := strings.ReplaceAll(string(blob), "\n", " ")
-		matches := reTitle.FindStringSubmatch(headStr)
-		// 这个 matches 要么为空，要么包含两个元素
-		if len(matches) >= 2 {
-			return matches[1], true
-		}
-
-		// 由于 EOF 也属于错误，但即使 EOF 也有可能读取出一些数据，因此 err 延后处理。
-		if err != nil {
-			return "", false
-		}
-	}
-}